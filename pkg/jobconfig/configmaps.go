@@ -0,0 +1,64 @@
+package jobconfig
+
+import (
+	"fmt"
+	"path/filepath"
+
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/sets"
+	prowconfig "k8s.io/test-infra/prow/config"
+)
+
+// MaxConfigMapSize is the maximum size of the data Kubernetes accepts in a
+// single ConfigMap
+const MaxConfigMapSize = 1024 * 1024
+
+// EstimateConfigMapSizes returns, for every ConfigMap that the jobs for
+// org/repo are uploaded into, the size in bytes of the files WriteToDir would
+// write for those jobs, including their file names. Existing files are not
+// taken into account and the job config is not modified.
+func EstimateConfigMapSizes(org, repo string, jobConfig *prowconfig.JobConfig) (map[string]int, error) {
+	sizes := map[string]int{}
+	o := newWriteOptions(nil)
+	files := shardJobConfig(org, repo, o, CloneJobConfig(jobConfig), func(prowconfig.JobBase, string) {})
+	for file, part := range files {
+		info, err := extractInfoFromPath(filepath.Join(org, repo, file))
+		if err != nil {
+			return nil, fmt.Errorf("failed to determine info for %s: %w", file, err)
+		}
+		data, err := o.marshalCanonical(part)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal %s: %w", file, err)
+		}
+		sizes[info.ConfigMapName()] += len(file) + len(data)
+	}
+	return sizes, nil
+}
+
+// ConfigMapNamesForJobConfig returns the names of the ConfigMaps that the jobs
+// for org/repo are uploaded into once WriteToDir writes them. The job config
+// is not modified.
+func ConfigMapNamesForJobConfig(org, repo string, jobConfig *prowconfig.JobConfig) (sets.String, error) {
+	files := shardJobConfig(org, repo, newWriteOptions(nil), CloneJobConfig(jobConfig), func(prowconfig.JobBase, string) {})
+	var paths []string
+	for file := range files {
+		paths = append(paths, filepath.Join(org, repo, file))
+	}
+	return ConfigMapsForPaths(paths)
+}
+
+// ValidateConfigMapSizes checks that the jobs for org/repo do not take more
+// than budget bytes in any of the ConfigMaps they are uploaded into
+func ValidateConfigMapSizes(org, repo string, jobConfig *prowconfig.JobConfig, budget int) error {
+	sizes, err := EstimateConfigMapSizes(org, repo, jobConfig)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, name := range sets.StringKeySet(sizes).List() {
+		if sizes[name] > budget {
+			errs = append(errs, fmt.Errorf("jobs for %s/%s take %d bytes in ConfigMap %s, more than the budget of %d bytes", org, repo, sizes[name], name, budget))
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
@@ -0,0 +1,116 @@
+package jobconfig
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+	prowapi "k8s.io/test-infra/prow/apis/prowjobs/v1"
+	prowconfig "k8s.io/test-infra/prow/config"
+)
+
+func TestEstimateConfigMapSizes(t *testing.T) {
+	jobConfig := &prowconfig.JobConfig{
+		PresubmitsStatic: map[string][]prowconfig.Presubmit{"org/repo": {
+			{JobBase: prowconfig.JobBase{Name: "a"}, Brancher: prowconfig.Brancher{Branches: []string{"master"}}},
+			{JobBase: prowconfig.JobBase{Name: "b"}, Brancher: prowconfig.Brancher{Branches: []string{"release-4.12"}}},
+		}},
+		Periodics: []prowconfig.Periodic{
+			{JobBase: prowconfig.JobBase{Name: "c", UtilityConfig: prowconfig.UtilityConfig{ExtraRefs: []prowapi.Refs{{Org: "org", Repo: "repo", BaseRef: "release-4.12"}}}}},
+		},
+	}
+	sizes, err := EstimateConfigMapSizes("org", "repo", jobConfig)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if diff := cmp.Diff([]string{"job-config-4.12", "job-config-master-presubmits"}, sets.StringKeySet(sizes).List()); diff != "" {
+		t.Fatalf("configmaps differ from expected:\n%s", diff)
+	}
+	for name, size := range sizes {
+		if size == 0 {
+			t.Errorf("expected a non-zero size for %s", name)
+		}
+	}
+	if sizes["job-config-4.12"] <= sizes["job-config-master-presubmits"] {
+		t.Errorf("expected the ConfigMap holding two files to be larger, got %v", sizes)
+	}
+
+	// the estimate is the size of the file as it is written
+	file := "org-repo-master-presubmits.yaml"
+	path := filepath.Join(t.TempDir(), file)
+	if err := WriteToFile(path, &prowconfig.JobConfig{PresubmitsStatic: map[string][]prowconfig.Presubmit{"org/repo": {
+		{JobBase: prowconfig.JobBase{Name: "a"}, Brancher: prowconfig.Brancher{Branches: []string{"master"}}},
+	}}}); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	written, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read file: %v", err)
+	}
+	if expected := len(file) + len(written); sizes["job-config-master-presubmits"] != expected {
+		t.Errorf("expected job-config-master-presubmits to take %d bytes, got %d", expected, sizes["job-config-master-presubmits"])
+	}
+}
+
+func TestConfigMapNamesForJobConfig(t *testing.T) {
+	periodic := func(org, repo, branch string) prowconfig.Periodic {
+		return prowconfig.Periodic{JobBase: prowconfig.JobBase{Name: branch, UtilityConfig: prowconfig.UtilityConfig{ExtraRefs: []prowapi.Refs{{Org: org, Repo: repo, BaseRef: branch}}}}}
+	}
+	jobConfig := &prowconfig.JobConfig{
+		PresubmitsStatic: map[string][]prowconfig.Presubmit{
+			"org/repo": {
+				{JobBase: prowconfig.JobBase{Name: "a"}, Brancher: prowconfig.Brancher{Branches: []string{"^master$"}}},
+				{JobBase: prowconfig.JobBase{Name: "b"}, Brancher: prowconfig.Brancher{Branches: []string{"^release-4\\.12$"}}},
+			},
+			"org/other": {{JobBase: prowconfig.JobBase{Name: "c"}, Brancher: prowconfig.Brancher{Branches: []string{"release-4.11"}}}},
+		},
+		PostsubmitsStatic: map[string][]prowconfig.Postsubmit{"org/repo": {
+			{JobBase: prowconfig.JobBase{Name: "d"}, Brancher: prowconfig.Brancher{Branches: []string{"main"}}},
+		}},
+		Periodics: []prowconfig.Periodic{periodic("org", "repo", "master"), periodic("org", "repo", "openshift-4.13"), periodic("org", "other", "release-4.10")},
+	}
+	expected := sets.NewString("job-config-master-presubmits", "job-config-4.12", "job-config-main-postsubmits", "job-config-master-periodics", "job-config-4.13")
+	configMaps, err := ConfigMapNamesForJobConfig("org", "repo", jobConfig)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if diff := cmp.Diff(expected.List(), configMaps.List()); diff != "" {
+		t.Errorf("configmaps differ from expected:\n%s", diff)
+	}
+}
+
+func TestValidateConfigMapSizes(t *testing.T) {
+	var jobs []prowconfig.Presubmit
+	for i := 0; i < 100; i++ {
+		jobs = append(jobs, prowconfig.Presubmit{JobBase: prowconfig.JobBase{Name: fmt.Sprintf("pull-ci-org-repo-master-job-%d", i)}})
+	}
+	jobConfig := &prowconfig.JobConfig{PresubmitsStatic: map[string][]prowconfig.Presubmit{"org/repo": jobs}}
+
+	testCases := []struct {
+		name        string
+		budget      int
+		expectedErr bool
+	}{
+		{
+			name:   "config fitting in the budget is valid",
+			budget: MaxConfigMapSize,
+		},
+		{
+			name:        "config overflowing the budget is invalid",
+			budget:      1024,
+			expectedErr: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := ValidateConfigMapSizes("org", "repo", jobConfig, tc.budget)
+			if (err != nil) != tc.expectedErr {
+				t.Errorf("expected error: %t, got: %v", tc.expectedErr, err)
+			}
+		})
+	}
+}
@@ -1,14 +1,25 @@
 package jobconfig
 
 import (
+	"archive/tar"
+	"bytes"
+	stdgzip "compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/fs"
-	"io/ioutil"
+	"math/rand"
 	"os"
+	"path"
 	"path/filepath"
 	"regexp"
 	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/ghodss/yaml"
 	"github.com/sirupsen/logrus"
@@ -16,7 +27,9 @@ import (
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/selection"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
 	"k8s.io/apimachinery/pkg/util/sets"
+	prowapi "k8s.io/test-infra/prow/apis/prowjobs/v1"
 	prowconfig "k8s.io/test-infra/prow/config"
 
 	cioperatorapi "github.com/openshift/ci-tools/pkg/api"
@@ -41,13 +54,48 @@ const (
 	PostsubmitPrefix             = "branch"
 	PeriodicPrefix               = "periodic"
 	newlyGenerated         label = "newly-generated"
+
+	// PruneExemptAnnotation marks a generated job that Prune keeps even when
+	// it was not newly generated. It is a temporary escape hatch for phased
+	// migrations and should be removed once the job is generated again or
+	// deleted for good.
+	PruneExemptAnnotation = "ci-operator.openshift.io/prowgen-prune-exempt"
+)
+
+// DefaultGeneratorOwnedLabels are the labels generators derive from their
+// configuration. When a generated job is merged into an existing one, labels
+// of the existing job outside of this set were added by hand and are kept.
+var DefaultGeneratorOwnedLabels = sets.NewString(
+	LabelGenerator,
+	ProwJobLabelVariant,
+	JobReleaseKey,
+	ReleaseControllerLabel,
+	cioperatorapi.PromotionJobLabelKey,
+	cioperatorapi.NoBuildsLabel,
+	cioperatorapi.ClusterLabel,
+	cioperatorapi.CloudLabel,
+	cioperatorapi.CloudClusterProfileLabel,
+	cioperatorapi.KVMDeviceLabel,
 )
 
+// PruneExempt determines if the job is exempt from pruning
+func PruneExempt(job prowconfig.JobBase) bool {
+	return job.Annotations[PruneExemptAnnotation] == "true"
+}
+
 // SimpleBranchRegexp matches a branch name that does not appear to be a regex (lacks wildcard,
 // group, or other modifiers). For instance, `master` is considered simple, `master-.*` would
 // not.
 var SimpleBranchRegexp = regexp.MustCompile(`^[\w\-.]+$`)
 
+// IsSimpleBranch determines whether the branch should be taken literally rather
+// than as a regex. Dots are allowed, so `release-4.12` is simple even though
+// its dot would match any character as a regex, while `release-4\.12` and
+// `master|main` are not.
+func IsSimpleBranch(branch string) bool {
+	return SimpleBranchRegexp.MatchString(branch)
+}
+
 // Info describes the metadata for a Prow job configuration file
 type Info struct {
 	Org    string
@@ -57,45 +105,161 @@ type Info struct {
 	Type string
 	// Filename is the full path to the file on disk
 	Filename string
+	// Separator separates the org, repo, branch and type in the file name,
+	// DefaultFilenameSeparator is used when empty
+	Separator string
+}
+
+// JobType returns the type of ProwJob contained in this file
+func (i *Info) JobType() JobType {
+	return JobType(i.Type)
+}
+
+// DefaultFilenameSeparator separates the org, repo, branch and type in job
+// configuration file names unless configured otherwise
+const DefaultFilenameSeparator = "-"
+
+func (i *Info) separator() string {
+	if i.Separator == "" {
+		return DefaultFilenameSeparator
+	}
+	return i.Separator
 }
 
 // Basename returns the unique name for this file in the config
 func (i *Info) Basename() string {
 	parts := []string{i.Org, i.Repo, i.Branch, i.Type}
-	if i.Type == "periodics" && i.Branch == "" {
+	if i.JobType() == Periodics && i.Branch == "" {
 		parts = []string{i.Org, i.Repo, i.Type}
 	}
-	return fmt.Sprintf("%s.yaml", strings.Join(parts, "-"))
+	return fmt.Sprintf("%s.yaml", strings.Join(parts, i.separator()))
+}
+
+// RelativePath returns the path to the file under the job configuration dir
+func (i *Info) RelativePath() string {
+	return filepath.Join(i.Org, i.Repo, i.Basename())
+}
+
+// FullPath returns the path to the file in the job configuration dir baseDir
+func (i *Info) FullPath(baseDir string) string {
+	return filepath.Join(baseDir, i.RelativePath())
 }
 
 // ConfigMapName returns the configmap in which we expect this file to be uploaded
 func (i *Info) ConfigMapName() string {
+	return ConfigMapNameForBranch(i.Branch, i.Type, i.JobType() == Periodics && i.Branch == "")
+}
+
+// ConfigMapNameForBranch returns the configmap in which jobs of the given type
+// for the branch are uploaded. Periodics that are not correlated to a branch
+// are uploaded to the same configmap regardless of branch and type.
+func ConfigMapNameForBranch(branch, jobType string, isUncorrelatedPeriodic bool) string {
 	// put periodics not directly correlated to code in the misc job
-	if i.Type == "periodics" && i.Branch == "" {
+	if isUncorrelatedPeriodic {
 		return fmt.Sprintf("job-config-%s", cioperatorapi.FlavorForBranch(""))
 	}
-	flavor := cioperatorapi.FlavorForBranch(i.Branch)
+	flavor := cioperatorapi.FlavorForBranch(branch)
 	if flavor == "master" || flavor == "main" {
-		return fmt.Sprintf("job-config-%s-%s", flavor, i.Type)
+		return fmt.Sprintf("job-config-%s-%s", flavor, jobType)
 	}
 
 	return fmt.Sprintf("job-config-%s", flavor)
 }
 
+// ConfigMapsForPaths returns the names of the configmaps into which the job
+// configuration files at the given paths are uploaded. Paths without a YAML
+// extension and paths that are not laid out like job configuration files are
+// ignored, so any list of changed files can be passed. Files under the
+// ci-operator/jobs tree that are misnamed or misplaced match no configmap and
+// are reported as errors, along with the configmaps matched by the others.
+func ConfigMapsForPaths(paths []string) (sets.String, error) {
+	configMaps := sets.NewString()
+	var errs []error
+	for _, path := range paths {
+		if ext := filepath.Ext(path); ext != ".yaml" && ext != ".yml" {
+			continue
+		}
+		info, err := extractInfoFromPath(path)
+		if err != nil {
+			if !errors.Is(err, ErrNotConfigPath) && inJobsTree(path) {
+				errs = append(errs, fmt.Errorf("%s does not match any configmap: %w", path, err))
+			}
+			continue
+		}
+		configMaps.Insert(info.ConfigMapName())
+	}
+	return configMaps, utilerrors.NewAggregate(errs)
+}
+
+// jobsTreePath is the path to the job configuration files in the release repo
+const jobsTreePath = "ci-operator/jobs"
+
+// inJobsTree determines whether path is under the job configuration tree of
+// the release repo
+func inJobsTree(path string) bool {
+	slashed := "/" + filepath.ToSlash(filepath.Clean(path))
+	return strings.Contains(slashed, "/"+jobsTreePath+"/")
+}
+
+// JobType is the type of the jobs in a job configuration file
+type JobType string
+
+const (
+	Presubmits  JobType = "presubmits"
+	Postsubmits JobType = "postsubmits"
+	Periodics   JobType = "periodics"
+)
+
+// jobTypes are the types of jobs that the names of job configuration files end with
+var jobTypes = []JobType{Presubmits, Postsubmits, Periodics}
+
+// ParseJobType returns the job type named s, or an error when s is not one
+// of the known job types
+func ParseJobType(s string) (JobType, error) {
+	for _, jobType := range jobTypes {
+		if s == string(jobType) {
+			return jobType, nil
+		}
+	}
+	return "", fmt.Errorf("unknown job type %q, expected one of %q", s, jobTypes)
+}
+
+var (
+	// ErrNotConfigPath is returned for paths that are not laid out like the
+	// paths of job configuration files, i.e. files that are not job config
+	ErrNotConfigPath = errors.New("not a job configuration file path")
+	// ErrMalformedName is returned for files named after the org and repo
+	// they are in, like job configuration files, but from whose name the
+	// job type cannot be determined
+	ErrMalformedName = errors.New("malformed job configuration file name")
+	// ErrMisplacedFile is returned for files named like job configuration
+	// files, but for another org and repo than the directory they are in
+	ErrMisplacedFile = errors.New("job configuration file in the wrong directory")
+)
+
 // We use the directory/file naming convention to encode useful information
 // about component repository information.
 // The convention for prow job config files in this repo:
 // ci-operator/jobs/ORGANIZATION/COMPONENT/ORGANIZATION-COMPONENT-BRANCH-JOBTYPE.yaml
 func extractInfoFromPath(configFilePath string) (*Info, error) {
-	configSpecDir := filepath.Dir(configFilePath)
+	return extractInfoFromPathWithSeparator(configFilePath, DefaultFilenameSeparator)
+}
+
+// extractInfoFromPathWithSeparator is extractInfoFromPath for file names
+// whose parts are separated by separator
+func extractInfoFromPathWithSeparator(configFilePath, separator string) (*Info, error) {
+	// parse the cleaned path so that trailing slashes, doubled slashes and dot
+	// segments do not end up in the parts of the name
+	cleanPath := filepath.Clean(configFilePath)
+	configSpecDir := filepath.Dir(cleanPath)
 	repo := filepath.Base(configSpecDir)
 	if repo == "." || repo == "/" {
-		return nil, fmt.Errorf("could not extract repo from '%s'", configFilePath)
+		return nil, fmt.Errorf("%w: could not extract repo from '%s'", ErrNotConfigPath, configFilePath)
 	}
 
 	org := filepath.Base(filepath.Dir(configSpecDir))
 	if org == "." || org == "/" {
-		return nil, fmt.Errorf("could not extract org from '%s'", configFilePath)
+		return nil, fmt.Errorf("%w: could not extract org from '%s'", ErrNotConfigPath, configFilePath)
 	}
 
 	// take org/repo/org-repo-branch-type.yaml and:
@@ -104,102 +268,736 @@ func extractInfoFromPath(configFilePath string) (*Info, error) {
 	// strip the "org-repo-" prefix, then
 	// isolate the "-type" suffix, then
 	// extract the branch
-	basename := filepath.Base(configFilePath)
-	basenameWithoutSuffix := strings.TrimSuffix(basename, filepath.Ext(configFilePath))
-	orgRepo := fmt.Sprintf("%s-%s-", org, repo)
+	basename := filepath.Base(cleanPath)
+	basenameWithoutSuffix := strings.TrimSuffix(basename, filepath.Ext(cleanPath))
+	orgRepo := org + separator + repo + separator
 	if !strings.HasPrefix(basenameWithoutSuffix, orgRepo) {
-		return nil, fmt.Errorf("file name was not prefixed with %q: %q", orgRepo, basenameWithoutSuffix)
+		for _, candidate := range jobTypes {
+			if strings.HasSuffix(basenameWithoutSuffix, separator+string(candidate)) {
+				return nil, fmt.Errorf("%w: file name was not prefixed with %q: %q", ErrMisplacedFile, orgRepo, basenameWithoutSuffix)
+			}
+		}
+		return nil, fmt.Errorf("%w: file name was not prefixed with %q: %q", ErrNotConfigPath, orgRepo, basenameWithoutSuffix)
 	}
 	branchType := strings.TrimPrefix(basenameWithoutSuffix, orgRepo)
-	typeIndex := strings.LastIndex(branchType, "-")
-	var branch, jobType string
-	if typeIndex == -1 {
-		if branchType != "periodics" {
-			return nil, fmt.Errorf("file name does not contain job type: %q", basenameWithoutSuffix)
-		}
-		branch = ""
-		jobType = "periodics"
+	var branch, rawType string
+	if idx := strings.LastIndex(branchType, separator); idx != -1 {
+		branch, rawType = branchType[:idx], branchType[idx+len(separator):]
 	} else {
-		branch = branchType[:typeIndex]
-		jobType = branchType[typeIndex+1:]
+		rawType = branchType
+	}
+	jobType, err := ParseJobType(rawType)
+	if err != nil {
+		return nil, fmt.Errorf("%w: file name does not contain job type: %q: %v", ErrMalformedName, basenameWithoutSuffix, err)
+	}
+	// only periodics may not be configured for a branch
+	if branch == "" && jobType != Periodics {
+		return nil, fmt.Errorf("%w: file name does not contain branch for %s: %q", ErrMalformedName, jobType, basenameWithoutSuffix)
 	}
 
-	return &Info{
+	info := &Info{
 		Org:      org,
 		Repo:     repo,
 		Branch:   branch,
-		Type:     jobType,
+		Type:     string(jobType),
 		Filename: configFilePath,
-	}, nil
+	}
+	if separator != DefaultFilenameSeparator {
+		info.Separator = separator
+	}
+	return info, nil
+}
+
+// WalkOptions configure how job configuration files are read when walking a
+// directory
+type WalkOptions struct {
+	// ReadTimeout bounds the time spent reading a single file, no bound is
+	// applied when zero. A file that cannot be read in time is treated like
+	// any other file that fails to be read.
+	ReadTimeout time.Duration
+	// Extensions are the file extensions of job configuration files, files
+	// with other extensions are ignored. Files with the ".json" extension are
+	// parsed as JSON, all others as YAML. Defaults to ".yaml" and ".yml".
+	Extensions []string
+	// StrictGlobs are glob patterns, matched with filepath.Match against
+	// paths relative to the job configuration directory, even when only a
+	// subdirectory of it is walked. As with filepath.Match, * does not match
+	// /, so "org/*" matches no file while "org/*/*" matches all the files of
+	// the org. Files matching any of them that cannot be identified as job
+	// configuration or cannot be read cause the walk to fail instead of only
+	// being logged. Malformed patterns fail the walk before it starts.
+	StrictGlobs []string
+	// Strict makes problems with any file fail the walk, as if StrictGlobs
+	// matched every path
+	Strict bool
+	// IncludeHidden makes the walk consider files and directories whose
+	// names start with a dot, like editor temporary files and .git, which
+	// are skipped by default
+	IncludeHidden bool
+	// OnFileRead, when set, is called with the time spent reading and parsing
+	// each file, whether or not reading succeeded. Files are read concurrently,
+	// so it must be safe for concurrent use.
+	OnFileRead func(info *Info, d time.Duration)
+	// Separator separates the org, repo, branch and type in file names.
+	// Defaults to DefaultFilenameSeparator.
+	Separator string
+	// Workers is the number of files read concurrently, GOMAXPROCS when not
+	// positive
+	Workers int
+	// OnProgress, when set, is called every ProgressInterval and once more
+	// when the walk ends with the progress made so far. Calls are made from
+	// a single goroutine, so it does not need to be safe for concurrent use.
+	OnProgress func(progress WalkProgress)
+	// ProgressInterval is the interval between calls to OnProgress. Defaults
+	// to a second.
+	ProgressInterval time.Duration
+	// OutputBuffer is the number of files that can be read ahead of the
+	// callback. Files are read concurrently but handed to the callback one at
+	// a time, so without a buffer readers wait for the callback as soon as it
+	// is slower than them. A larger buffer keeps readers busy while the
+	// callback catches up, at the cost of holding as many parsed files in
+	// memory. Defaults to no buffer.
+	OutputBuffer int
+
+	// readFile reads the raw contents of a file, it is only overridden in tests
+	// and when reading from an fs.FS
+	readFile func(path string) ([]byte, error)
+	// walkDir walks the file tree rooted at root, it is only overridden when
+	// reading from an fs.FS
+	walkDir func(root string, fn fs.WalkDirFunc) error
+	// onSkipped, when set, is called for every file that is skipped because
+	// it cannot be identified as job configuration or cannot be read, along
+	// with the reason why
+	onSkipped func(path string, err error)
+}
+
+type WalkOption func(*WalkOptions)
+
+// WithReadTimeout bounds the time spent reading a single file
+func WithReadTimeout(timeout time.Duration) WalkOption {
+	return func(o *WalkOptions) {
+		o.ReadTimeout = timeout
+	}
+}
+
+// WithExtensions sets the file extensions of job configuration files
+func WithExtensions(extensions ...string) WalkOption {
+	return func(o *WalkOptions) {
+		o.Extensions = extensions
+	}
+}
+
+// WithStrictGlobs sets the glob patterns of paths for which problems are
+// reported as errors
+func WithStrictGlobs(globs ...string) WalkOption {
+	return func(o *WalkOptions) {
+		o.StrictGlobs = globs
+	}
+}
+
+// WithFileReadHook sets a function to call with the time spent reading each file
+func WithFileReadHook(hook func(info *Info, d time.Duration)) WalkOption {
+	return func(o *WalkOptions) {
+		o.OnFileRead = hook
+	}
+}
+
+// WithWalkSeparator sets the separator used in the names of the files read
+func WithWalkSeparator(separator string) WalkOption {
+	return func(o *WalkOptions) {
+		o.Separator = separator
+	}
+}
+
+// WithWorkers caps the number of files read concurrently
+func WithWorkers(workers int) WalkOption {
+	return func(o *WalkOptions) {
+		o.Workers = workers
+	}
+}
+
+// WithOutputBuffer lets up to size files be read ahead of the callback
+func WithOutputBuffer(size int) WalkOption {
+	return func(o *WalkOptions) {
+		o.OutputBuffer = size
+	}
+}
+
+// WithHiddenFiles makes the walk consider hidden files and directories
+func WithHiddenFiles() WalkOption {
+	return func(o *WalkOptions) {
+		o.IncludeHidden = true
+	}
+}
+
+// WithStrict makes problems with any file fail the walk instead of only
+// being logged
+func WithStrict() WalkOption {
+	return func(o *WalkOptions) {
+		o.Strict = true
+	}
+}
+
+// WalkProgress describes the progress of a walk over job configuration files
+type WalkProgress struct {
+	// Discovered is the number of job configuration files found so far
+	Discovered int64
+	// Processed is the number of files read so far, successfully or not
+	Processed int64
+}
+
+// WithProgress sets a function to call every interval with the progress of
+// the walk, the default interval is used when it is not positive
+func WithProgress(interval time.Duration, onProgress func(progress WalkProgress)) WalkOption {
+	return func(o *WalkOptions) {
+		o.ProgressInterval = interval
+		o.OnProgress = onProgress
+	}
+}
+
+// walkProgress counts the files a walk discovers and processes without
+// locking, reporting them from a single goroutine
+type walkProgress struct {
+	discovered atomic.Int64
+	processed  atomic.Int64
+	done       chan struct{}
+	finished   chan struct{}
+}
+
+// startProgress starts reporting progress as configured in o, the returned
+// progress must be stopped once the walk ends
+func (o *WalkOptions) startProgress() *walkProgress {
+	p := &walkProgress{done: make(chan struct{}), finished: make(chan struct{})}
+	if o.OnProgress == nil {
+		close(p.finished)
+		return p
+	}
+	interval := o.ProgressInterval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	go func() {
+		defer close(p.finished)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				o.OnProgress(p.snapshot())
+			case <-p.done:
+				o.OnProgress(p.snapshot())
+				return
+			}
+		}
+	}()
+	return p
+}
+
+func (p *walkProgress) snapshot() WalkProgress {
+	return WalkProgress{Discovered: p.discovered.Load(), Processed: p.processed.Load()}
+}
+
+// stop reports the final progress and waits for reporting to finish
+func (p *walkProgress) stop() {
+	close(p.done)
+	<-p.finished
+}
+
+// withFS makes the walk read files from fsys instead of the OS filesystem
+func withFS(fsys fs.FS) WalkOption {
+	return func(o *WalkOptions) {
+		o.readFile = func(path string) ([]byte, error) {
+			data, err := fs.ReadFile(fsys, path)
+			if err != nil {
+				return nil, err
+			}
+			return gzip.ReadBytesMaybeGZIP(data)
+		}
+		o.walkDir = func(root string, fn fs.WalkDirFunc) error {
+			return fs.WalkDir(fsys, root, fn)
+		}
+	}
+}
+
+func newWalkOptions(opts []WalkOption) *WalkOptions {
+	o := &WalkOptions{
+		Extensions: []string{".yaml", ".yml"},
+		Separator:  DefaultFilenameSeparator,
+		readFile:   gzip.ReadFileMaybeGZIP,
+		walkDir:    filepath.WalkDir,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// validateStrictGlobs ensures that the strict globs are well-formed, as a
+// malformed one would never match and silently make the walk lenient
+func (o *WalkOptions) validateStrictGlobs() error {
+	var errs []error
+	for _, glob := range o.StrictGlobs {
+		if _, err := filepath.Match(glob, ""); err != nil {
+			errs = append(errs, fmt.Errorf("invalid strict glob %q: %w", glob, err))
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// isStrict determines if problems with the file at path, found when walking
+// configDir, should be reported as errors
+func (o *WalkOptions) isStrict(configDir, path string) bool {
+	if o.Strict {
+		return true
+	}
+	rel, err := filepath.Rel(configDir, path)
+	if err != nil {
+		return false
+	}
+	for _, glob := range o.StrictGlobs {
+		if matched, err := filepath.Match(glob, rel); err == nil && matched {
+			return true
+		}
+	}
+	return false
+}
+
+func (o *WalkOptions) hasExtension(path string) bool {
+	ext := filepath.Ext(path)
+	for _, extension := range o.Extensions {
+		if ext == extension {
+			return true
+		}
+	}
+	return false
+}
+
+// readFromFile reads Prow job config from a file, honoring the read timeout
+// and the cancellation of ctx. When either expires, the goroutine reading the
+// file is abandoned and exits whenever the underlying read returns.
+func (o *WalkOptions) readFromFile(ctx context.Context, path string) (*prowconfig.JobConfig, error) {
+	if o.ReadTimeout <= 0 && ctx.Done() == nil {
+		return readFromFileWith(path, o.readFile)
+	}
+	readCtx := ctx
+	if o.ReadTimeout > 0 {
+		var cancel context.CancelFunc
+		readCtx, cancel = context.WithTimeout(ctx, o.ReadTimeout)
+		defer cancel()
+	}
+	type result struct {
+		jobConfig *prowconfig.JobConfig
+		err       error
+	}
+	resultCh := make(chan result, 1)
+	go func() {
+		jobConfig, err := readFromFileWith(path, o.readFile)
+		resultCh <- result{jobConfig: jobConfig, err: err}
+	}()
+	select {
+	case r := <-resultCh:
+		return r.jobConfig, r.err
+	case <-readCtx.Done():
+		if err := ctx.Err(); err != nil {
+			return nil, fmt.Errorf("failed to read Prow job config: %w", err)
+		}
+		return nil, fmt.Errorf("failed to read Prow job config (timed out after %s)", o.ReadTimeout)
+	}
+}
+
+// ErrStopWalk can be returned by the callbacks passed to the functions
+// operating on job configuration directories to stop the walk early. The walk
+// then returns without error, unless errors were encountered before stopping.
+var ErrStopWalk = errors.New("stop walking job configuration")
+
+func OperateOnJobConfigDir(configDir string, callback func(*prowconfig.JobConfig, *Info) error, opts ...WalkOption) error {
+	return OperateOnJobConfigSubdir(configDir, "", callback, opts...)
 }
 
-func OperateOnJobConfigDir(configDir string, callback func(*prowconfig.JobConfig, *Info) error) error {
-	return OperateOnJobConfigSubdir(configDir, "", callback)
+func OperateOnJobConfigSubdir(configDir, subDir string, callback func(*prowconfig.JobConfig, *Info) error, opts ...WalkOption) error {
+	return OperateOnJobConfigSubdirWithContext(context.Background(), configDir, subDir, callback, opts...)
 }
 
-func OperateOnJobConfigSubdir(configDir, subDir string, callback func(*prowconfig.JobConfig, *Info) error) error {
+// OperateOnJobConfigSubdirWithContext is OperateOnJobConfigSubdir that stops
+// when ctx is cancelled, abandoning the files being read, and then returns the
+// error of ctx along with the errors encountered before.
+func OperateOnJobConfigSubdirWithContext(ctx context.Context, configDir, subDir string, callback func(*prowconfig.JobConfig, *Info) error, opts ...WalkOption) error {
+	o := newWalkOptions(opts)
+	progress := o.startProgress()
+	defer progress.stop()
+	// stop is closed when the callback stops the walk, after which no more
+	// files are read and the remaining ones are drained without processing
+	stop := make(chan struct{})
 	inputCh := make(chan *Info)
+	errCh := make(chan error)
 	produce := func() error {
+		// errors are sent before inputCh is closed: once it is, the walk can
+		// complete and errCh be closed before a returned error is sent
 		defer close(inputCh)
-		return OperateOnJobConfigSubdirPaths(configDir, subDir, func(info *Info) error {
-			inputCh <- info
-			return nil
-		})
+		if err := OperateOnJobConfigSubdirPaths(configDir, subDir, func(info *Info) error {
+			progress.discovered.Add(1)
+			select {
+			case inputCh <- info:
+				return nil
+			case <-stop:
+				return ErrStopWalk
+			case <-ctx.Done():
+				return ErrStopWalk
+			}
+		}, opts...); err != nil {
+			errCh <- err
+		}
+		return nil
 	}
 	type item struct {
 		config *prowconfig.JobConfig
 		info   *Info
 	}
-	outputCh := make(chan item)
+	outputBuffer := o.OutputBuffer
+	if outputBuffer < 0 {
+		outputBuffer = 0
+	}
+	outputCh := make(chan item, outputBuffer)
 	map_ := func() error {
 		for info := range inputCh {
-			configPart, err := readFromFile(info.Filename)
+			select {
+			case <-stop:
+				continue
+			case <-ctx.Done():
+				continue
+			default:
+			}
+			start := time.Now()
+			configPart, err := o.readFromFile(ctx, info.Filename)
+			progress.processed.Add(1)
+			if o.OnFileRead != nil {
+				o.OnFileRead(info, time.Since(start))
+			}
+			if err != nil && ctx.Err() != nil {
+				// the walk is cancelled, which is reported once it ends
+				continue
+			}
 			if err != nil {
+				if o.isStrict(configDir, info.Filename) {
+					errCh <- fmt.Errorf("%s: %w", info.Filename, err)
+					continue
+				}
 				logrus.WithField("source-file", info.Filename).WithError(err).Error("Failed to read Prow job config")
+				if o.onSkipped != nil {
+					o.onSkipped(info.Filename, err)
+				}
 				continue
 			}
 			outputCh <- item{configPart, info}
 		}
 		return nil
 	}
-	errCh := make(chan error)
 	reduce := func() error {
+		stopped := false
 		for i := range outputCh {
-			if err := callback(i.config, i.info); err != nil {
+			if stopped || ctx.Err() != nil {
+				continue
+			}
+			if err := callback(i.config, i.info); errors.Is(err, ErrStopWalk) {
+				stopped = true
+				close(stop)
+			} else if err != nil {
 				errCh <- err
 			}
 		}
 		return nil
 	}
 	done := func() { close(outputCh) }
-	return util.ProduceMapReduce(0, produce, map_, reduce, done, errCh)
+	workers := o.Workers
+	if workers < 0 {
+		workers = 0
+	}
+	err := util.ProduceMapReduce(workers, produce, map_, reduce, done, errCh)
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return utilerrors.NewAggregate([]error{err, fmt.Errorf("walking job configuration was interrupted: %w", ctxErr)})
+	}
+	return err
+}
+
+// OperateOnJobConfigSubdirWithConcurrency is OperateOnJobConfigSubdir with at
+// most workers files being read concurrently, GOMAXPROCS when not positive
+func OperateOnJobConfigSubdirWithConcurrency(configDir, subDir string, workers int, callback func(*prowconfig.JobConfig, *Info) error, opts ...WalkOption) error {
+	return OperateOnJobConfigSubdir(configDir, subDir, callback, append(opts, WithWorkers(workers))...)
 }
 
-func OperateOnJobConfigSubdirPaths(configDir, subDir string, callback func(*Info) error) error {
-	if err := filepath.WalkDir(filepath.Join(configDir, subDir), func(path string, info fs.DirEntry, err error) error {
+func OperateOnJobConfigSubdirPaths(configDir, subDir string, callback func(*Info) error, opts ...WalkOption) error {
+	o := newWalkOptions(opts)
+	if err := o.validateStrictGlobs(); err != nil {
+		return err
+	}
+	var errs []error
+	root := filepath.Join(configDir, subDir)
+	if err := o.walkDir(root, func(path string, info fs.DirEntry, err error) error {
 		logger := logrus.WithField("source-file", path)
 		if err != nil {
 			logger.WithError(err).Error("Failed to walk file/directory")
 			return nil
 		}
+		if !o.IncludeHidden && path != root && strings.HasPrefix(info.Name(), ".") {
+			if info.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
 
-		if !info.IsDir() && filepath.Ext(path) == ".yaml" {
-			info, err := extractInfoFromPath(path)
+		if !info.IsDir() && o.hasExtension(path) {
+			info, err := extractInfoFromPathWithSeparator(path, o.Separator)
 			if err != nil {
-				logger.WithError(err).Warn("Failed to determine info for prow job config")
+				if o.isStrict(configDir, path) {
+					errs = append(errs, err)
+					return nil
+				}
+				if errors.Is(err, ErrNotConfigPath) {
+					logger.WithError(err).Debug("Ignoring file that is not a Prow job config")
+				} else {
+					logger.WithError(err).Warn("Failed to determine info for prow job config")
+				}
+				if o.onSkipped != nil {
+					o.onSkipped(path, err)
+				}
 				return nil
 			}
 			return callback(info)
 		}
 		return nil
-	}); err != nil {
+	}); err != nil && !errors.Is(err, ErrStopWalk) {
 		return fmt.Errorf("failed to operator on Prow job configs: %w", err)
 	}
-	return nil
+	return utilerrors.NewAggregate(errs)
+}
+
+// ForEachJob calls fn for every job configured in the files in dir, along with
+// the information about the file the job is in. Unlike ReadFromDir, jobs are
+// not accumulated: only the files being processed are held in memory. Errors
+// returned by fn are aggregated; fn can return ErrStopWalk to end the walk.
+func ForEachJob(dir string, fn func(info *Info, job prowconfig.JobBase) error, opts ...WalkOption) error {
+	return OperateOnJobConfigDir(dir, func(jobConfig *prowconfig.JobConfig, info *Info) error {
+		var errs []error
+		var stop bool
+		forEachJob(jobConfig, func(_, _ string, job prowconfig.JobBase) {
+			if stop {
+				return
+			}
+			if err := fn(info, job); errors.Is(err, ErrStopWalk) {
+				stop = true
+			} else if err != nil {
+				errs = append(errs, err)
+			}
+		})
+		if stop {
+			return ErrStopWalk
+		}
+		return utilerrors.NewAggregate(errs)
+	}, opts...)
+}
+
+// LocateJob returns the information about the file in dir in which the job
+// with the given name is configured. It is an error for no file or for more
+// than one file to configure a job with that name; the walk stops as soon as a
+// second file is found.
+func LocateJob(dir, jobName string, opts ...WalkOption) (*Info, error) {
+	var found []*Info
+	if err := ForEachJob(dir, func(info *Info, job prowconfig.JobBase) error {
+		if job.Name != jobName {
+			return nil
+		}
+		if len(found) != 0 && found[len(found)-1].Filename == info.Filename {
+			return nil
+		}
+		found = append(found, info)
+		if len(found) > 1 {
+			return ErrStopWalk
+		}
+		return nil
+	}, opts...); err != nil {
+		return nil, err
+	}
+	switch len(found) {
+	case 0:
+		return nil, fmt.Errorf("no job named %s is configured in %s", jobName, dir)
+	case 1:
+		return found[0], nil
+	default:
+		return nil, fmt.Errorf("job %s is configured in more than one file: %s and %s", jobName, found[0].Filename, found[1].Filename)
+	}
 }
 
 // ReadFromDir reads Prow job config from a directory and merges into one config
-func ReadFromDir(dir string) (*prowconfig.JobConfig, error) {
+func ReadFromDir(dir string, opts ...WalkOption) (*prowconfig.JobConfig, error) {
+	jobConfig, _, err := ReadFromDirWithStats(dir, opts...)
+	return jobConfig, err
+}
+
+// OperateOnJobConfigFS is OperateOnJobConfigDir for a directory of fsys
+func OperateOnJobConfigFS(fsys fs.FS, configDir string, callback func(*prowconfig.JobConfig, *Info) error, opts ...WalkOption) error {
+	return OperateOnJobConfigDir(configDir, callback, append([]WalkOption{withFS(fsys)}, opts...)...)
+}
+
+// ReadFromFS is ReadFromDir for a directory of fsys
+func ReadFromFS(fsys fs.FS, dir string, opts ...WalkOption) (*prowconfig.JobConfig, error) {
+	return ReadFromDir(dir, append([]WalkOption{withFS(fsys)}, opts...)...)
+}
+
+// ReadFromTarGz is ReadFromDir for a gzipped tarball holding a directory of
+// job configuration files, without extracting it to disk
+func ReadFromTarGz(r io.Reader, opts ...WalkOption) (*prowconfig.JobConfig, error) {
+	fsys, err := tarGzFS(r)
+	if err != nil {
+		return nil, err
+	}
+	return ReadFromFS(fsys, ".", opts...)
+}
+
+// tarGzFS loads the regular files of a gzipped tarball into memory
+func tarGzFS(r io.Reader) (fs.FS, error) {
+	gzipReader, err := stdgzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress the archive: %w", err)
+	}
+	defer gzipReader.Close()
+	fsys := archiveFS{}
+	tarReader := tar.NewReader(gzipReader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the archive: %w", err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		name := strings.TrimPrefix(path.Clean("/"+header.Name), "/")
+		data, err := io.ReadAll(tarReader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s from the archive: %w", header.Name, err)
+		}
+		fsys[name] = archiveFileInfo{name: path.Base(name), data: data, mode: fs.FileMode(header.Mode).Perm(), modTime: header.ModTime}
+	}
+	return fsys, nil
+}
+
+// archiveFS is a read-only file system holding the regular files of an
+// archive, keyed by their slash-separated paths; directories are implied by
+// the paths of the files in them
+type archiveFS map[string]archiveFileInfo
+
+func (fsys archiveFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	if file, ok := fsys[name]; ok {
+		return &archiveFile{Reader: bytes.NewReader(file.data), info: file}, nil
+	}
+	prefix := name + "/"
+	if name == "." {
+		prefix = ""
+	}
+	children := map[string]fs.DirEntry{}
+	for filePath, file := range fsys {
+		if !strings.HasPrefix(filePath, prefix) {
+			continue
+		}
+		child, _, inSubdir := strings.Cut(strings.TrimPrefix(filePath, prefix), "/")
+		if inSubdir {
+			file = archiveFileInfo{name: child, mode: fs.ModeDir | 0755}
+		}
+		children[child] = fs.FileInfoToDirEntry(file)
+	}
+	if len(children) == 0 && name != "." {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	dir := &archiveDir{info: archiveFileInfo{name: path.Base(name), mode: fs.ModeDir | 0755}}
+	for _, child := range sets.StringKeySet(children).List() {
+		dir.entries = append(dir.entries, children[child])
+	}
+	return dir, nil
+}
+
+// archiveFileInfo describes a file or directory in an archiveFS and holds
+// the content of files
+type archiveFileInfo struct {
+	name    string
+	data    []byte
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func (i archiveFileInfo) Name() string       { return i.name }
+func (i archiveFileInfo) Size() int64        { return int64(len(i.data)) }
+func (i archiveFileInfo) Mode() fs.FileMode  { return i.mode }
+func (i archiveFileInfo) ModTime() time.Time { return i.modTime }
+func (i archiveFileInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i archiveFileInfo) Sys() interface{}   { return nil }
+
+// archiveFile is a file of an archiveFS opened for reading
+type archiveFile struct {
+	*bytes.Reader
+	info archiveFileInfo
+}
+
+func (f *archiveFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *archiveFile) Close() error               { return nil }
+
+// archiveDir is a directory of an archiveFS opened for listing
+type archiveDir struct {
+	info    archiveFileInfo
+	entries []fs.DirEntry
+}
+
+func (d *archiveDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *archiveDir) Close() error               { return nil }
+
+func (d *archiveDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.name, Err: errors.New("is a directory")}
+}
+
+func (d *archiveDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(d.entries) {
+		n = len(d.entries)
+	}
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
+
+// ReadStats counts the files considered when reading job configuration
+type ReadStats struct {
+	// Visited is the number of files with a job configuration extension
+	Visited int
+	// Parsed is the number of files that were read successfully
+	Parsed int
+	// Skipped is the number of files that were ignored because they could
+	// not be identified as job configuration or could not be read
+	Skipped int
+}
+
+// ReadFromDirWithStats is ReadFromDir that also reports how many files were
+// read and how many were skipped
+func ReadFromDirWithStats(dir string, opts ...WalkOption) (*prowconfig.JobConfig, ReadStats, error) {
+	var stats ReadStats
+	var lock sync.Mutex
+	countSkipped := func(o *WalkOptions) {
+		o.onSkipped = func(string, error) {
+			lock.Lock()
+			defer lock.Unlock()
+			stats.Skipped++
+		}
+	}
 	jobConfig := &prowconfig.JobConfig{
 		PresubmitsStatic:  map[string][]prowconfig.Presubmit{},
 		PostsubmitsStatic: map[string][]prowconfig.Postsubmit{},
@@ -207,14 +1005,149 @@ func ReadFromDir(dir string) (*prowconfig.JobConfig, error) {
 	}
 	if err := OperateOnJobConfigDir(dir, func(config *prowconfig.JobConfig, elements *Info) error {
 		Append(jobConfig, config)
+		lock.Lock()
+		defer lock.Unlock()
+		stats.Parsed++
 		return nil
-	}); err != nil {
+	}, append(opts, countSkipped)...); err != nil {
+		return nil, ReadStats{}, fmt.Errorf("failed to load all Prow jobs: %w", err)
+	}
+	stats.Visited = stats.Parsed + stats.Skipped
+	return jobConfig, stats, nil
+}
+
+// ReadFromRepoDir reads the job configuration files of the org/repo
+// directory in configDir. Files in the directory that are named for another
+// repo or whose job type cannot be determined, like files in nested
+// directories, are reported as errors.
+func ReadFromRepoDir(configDir, org, repo string, opts ...WalkOption) (*prowconfig.JobConfig, error) {
+	jobConfig := &prowconfig.JobConfig{
+		PresubmitsStatic:  map[string][]prowconfig.Presubmit{},
+		PostsubmitsStatic: map[string][]prowconfig.Postsubmit{},
+		Periodics:         []prowconfig.Periodic{},
+	}
+	var errs []error
+	var lock sync.Mutex
+	collectMisnamed := func(o *WalkOptions) {
+		o.onSkipped = func(path string, err error) {
+			if errors.Is(err, ErrMisplacedFile) || errors.Is(err, ErrMalformedName) {
+				lock.Lock()
+				defer lock.Unlock()
+				errs = append(errs, fmt.Errorf("%s: %w", path, err))
+			}
+		}
+	}
+	if err := OperateOnJobConfigSubdir(configDir, filepath.Join(org, repo), func(config *prowconfig.JobConfig, info *Info) error {
+		if info.Org != org || info.Repo != repo {
+			lock.Lock()
+			defer lock.Unlock()
+			errs = append(errs, fmt.Errorf("%s: configures %s/%s instead of %s/%s", info.Filename, info.Org, info.Repo, org, repo))
+			return nil
+		}
+		Append(jobConfig, config)
+		return nil
+	}, append(opts, collectMisnamed)...); err != nil {
+		errs = append(errs, err)
+	}
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("failed to load Prow jobs for %s/%s: %w", org, repo, utilerrors.NewAggregate(errs))
+	}
+	return jobConfig, nil
+}
+
+// ReadFromDirByRepo reads the Prow job configuration in dir like ReadFromDir
+// does, but keeps the jobs of every component apart, keyed by the "org/repo"
+// directory the files are filed under.
+func ReadFromDirByRepo(dir string, opts ...WalkOption) (map[string]*prowconfig.JobConfig, error) {
+	byRepo := map[string]*prowconfig.JobConfig{}
+	// files are read in parallel, but callbacks are called one at a time
+	if err := OperateOnJobConfigDir(dir, func(config *prowconfig.JobConfig, info *Info) error {
+		key := fmt.Sprintf("%s/%s", info.Org, info.Repo)
+		jobConfig, ok := byRepo[key]
+		if !ok {
+			jobConfig = &prowconfig.JobConfig{
+				PresubmitsStatic:  map[string][]prowconfig.Presubmit{},
+				PostsubmitsStatic: map[string][]prowconfig.Postsubmit{},
+				Periodics:         []prowconfig.Periodic{},
+			}
+			byRepo[key] = jobConfig
+		}
+		Append(jobConfig, config)
+		return nil
+	}, opts...); err != nil {
 		return nil, fmt.Errorf("failed to load all Prow jobs: %w", err)
 	}
+	return byRepo, nil
+}
 
+// ReadReposFromDir reads the Prow job configuration for the given "org/repo"
+// repos only, walking just their subdirectories of dir. Repos without any job
+// configuration are ignored.
+func ReadReposFromDir(dir string, repos []string, opts ...WalkOption) (*prowconfig.JobConfig, error) {
+	jobConfig := &prowconfig.JobConfig{
+		PresubmitsStatic:  map[string][]prowconfig.Presubmit{},
+		PostsubmitsStatic: map[string][]prowconfig.Postsubmit{},
+		Periodics:         []prowconfig.Periodic{},
+	}
+	var errs []error
+	for _, repo := range repos {
+		if parts := strings.Split(repo, "/"); len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			errs = append(errs, fmt.Errorf("invalid repo %q, expected org/repo", repo))
+			continue
+		}
+		if err := OperateOnJobConfigSubdir(dir, repo, func(config *prowconfig.JobConfig, _ *Info) error {
+			Append(jobConfig, config)
+			return nil
+		}, opts...); err != nil {
+			errs = append(errs, fmt.Errorf("failed to load Prow jobs for %s: %w", repo, err))
+		}
+	}
+	if len(errs) > 0 {
+		return nil, utilerrors.NewAggregate(errs)
+	}
 	return jobConfig, nil
 }
 
+// FindJobFiles returns the sorted paths of all files in dir that define a job
+// with the given name, whatever its type
+func FindJobFiles(dir, jobName string) ([]string, error) {
+	var files []string
+	if err := OperateOnJobConfigDir(dir, func(jobConfig *prowconfig.JobConfig, info *Info) error {
+		if hasJob(jobConfig, jobName) {
+			files = append(files, info.Filename)
+		}
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("failed to find files defining %s: %w", jobName, err)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// hasJob determines if the job config defines a job with the given name
+func hasJob(jobConfig *prowconfig.JobConfig, jobName string) bool {
+	for _, jobs := range jobConfig.PresubmitsStatic {
+		for _, job := range jobs {
+			if job.Name == jobName {
+				return true
+			}
+		}
+	}
+	for _, jobs := range jobConfig.PostsubmitsStatic {
+		for _, job := range jobs {
+			if job.Name == jobName {
+				return true
+			}
+		}
+	}
+	for _, job := range jobConfig.Periodics {
+		if job.Name == jobName {
+			return true
+		}
+	}
+	return false
+}
+
 // Append merges job configuration from part into dest
 // Jobs are assumed to not overlap.
 func Append(dest, part *prowconfig.JobConfig) {
@@ -245,19 +1178,142 @@ func Append(dest, part *prowconfig.JobConfig) {
 	dest.Periodics = append(dest.Periodics, part.Periodics...)
 }
 
-// readFromFile reads Prow job config from a YAML file
-func readFromFile(path string) (*prowconfig.JobConfig, error) {
-	data, err := gzip.ReadFileMaybeGZIP(path)
+// AppendStrict merges job configuration from part into dest like Append does,
+// but fails without modifying dest when part holds jobs with the same name as
+// jobs in dest: presubmits and postsubmits for the same repo, or periodics.
+func AppendStrict(dest, part *prowconfig.JobConfig) error {
+	var errs []error
+	for _, repo := range sets.StringKeySet(part.PresubmitsStatic).List() {
+		existing := sets.NewString()
+		for _, job := range dest.PresubmitsStatic[repo] {
+			existing.Insert(job.Name)
+		}
+		for _, job := range part.PresubmitsStatic[repo] {
+			if existing.Has(job.Name) {
+				errs = append(errs, fmt.Errorf("presubmit %s for %s is already defined", job.Name, repo))
+			}
+		}
+	}
+	for _, repo := range sets.StringKeySet(part.PostsubmitsStatic).List() {
+		existing := sets.NewString()
+		for _, job := range dest.PostsubmitsStatic[repo] {
+			existing.Insert(job.Name)
+		}
+		for _, job := range part.PostsubmitsStatic[repo] {
+			if existing.Has(job.Name) {
+				errs = append(errs, fmt.Errorf("postsubmit %s for %s is already defined", job.Name, repo))
+			}
+		}
+	}
+	existing := sets.NewString()
+	for _, job := range dest.Periodics {
+		existing.Insert(job.Name)
+	}
+	for _, job := range part.Periodics {
+		if existing.Has(job.Name) {
+			errs = append(errs, fmt.Errorf("periodic %s is already defined", job.Name))
+		}
+	}
+	if len(errs) > 0 {
+		return utilerrors.NewAggregate(errs)
+	}
+	Append(dest, part)
+	return nil
+}
+
+// AppendDeduplicated merges job configuration from part into dest like Append
+// does, but skips jobs in part that are identical to a job in dest or to an
+// earlier job in part, as happens when overlapping directories are read. Jobs
+// are compared in their canonical serialized form. It fails without modifying
+// dest when part holds jobs that differ from another job with the same name:
+// presubmits and postsubmits for the same repo and branches, or periodics.
+func AppendDeduplicated(dest, part *prowconfig.JobConfig) error {
+	var errs []error
+	deduplicated := &prowconfig.JobConfig{}
+	// isNew records the job and determines whether it was not seen before
+	isNew := func(seen map[string]string, identity, description string, job interface{}) bool {
+		hash, err := hashJob(job)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to hash %s: %w", description, err))
+			return false
+		}
+		if previous, ok := seen[identity]; ok {
+			if previous != hash {
+				errs = append(errs, fmt.Errorf("%s is already defined differently", description))
+			}
+			return false
+		}
+		seen[identity] = hash
+		return true
+	}
+
+	for _, repo := range sets.StringKeySet(part.PresubmitsStatic).List() {
+		seen := map[string]string{}
+		for _, job := range dest.PresubmitsStatic[repo] {
+			isNew(seen, jobIdentity(job.Name, job.Brancher), describeJob("presubmit", repo, job.Name), job)
+		}
+		for _, job := range part.PresubmitsStatic[repo] {
+			if isNew(seen, jobIdentity(job.Name, job.Brancher), describeJob("presubmit", repo, job.Name), job) {
+				if deduplicated.PresubmitsStatic == nil {
+					deduplicated.PresubmitsStatic = map[string][]prowconfig.Presubmit{}
+				}
+				deduplicated.PresubmitsStatic[repo] = append(deduplicated.PresubmitsStatic[repo], job)
+			}
+		}
+	}
+	for _, repo := range sets.StringKeySet(part.PostsubmitsStatic).List() {
+		seen := map[string]string{}
+		for _, job := range dest.PostsubmitsStatic[repo] {
+			isNew(seen, jobIdentity(job.Name, job.Brancher), describeJob("postsubmit", repo, job.Name), job)
+		}
+		for _, job := range part.PostsubmitsStatic[repo] {
+			if isNew(seen, jobIdentity(job.Name, job.Brancher), describeJob("postsubmit", repo, job.Name), job) {
+				if deduplicated.PostsubmitsStatic == nil {
+					deduplicated.PostsubmitsStatic = map[string][]prowconfig.Postsubmit{}
+				}
+				deduplicated.PostsubmitsStatic[repo] = append(deduplicated.PostsubmitsStatic[repo], job)
+			}
+		}
+	}
+	seen := map[string]string{}
+	for _, job := range dest.Periodics {
+		isNew(seen, job.Name, describeJob("periodic", "", job.Name), job)
+	}
+	for _, job := range part.Periodics {
+		if isNew(seen, job.Name, describeJob("periodic", "", job.Name), job) {
+			deduplicated.Periodics = append(deduplicated.Periodics, job)
+		}
+	}
+	if len(errs) > 0 {
+		return utilerrors.NewAggregate(errs)
+	}
+	Append(dest, deduplicated)
+	return nil
+}
+
+// ReadJobConfigFromFile reads Prow job config from a file, which may be
+// gzipped. Files with the .json extension are parsed as JSON, all others as
+// YAML; empty files are an error.
+func ReadJobConfigFromFile(path string) (*prowconfig.JobConfig, error) {
+	return readFromFileWith(path, gzip.ReadFileMaybeGZIP)
+}
+
+func readFromFileWith(path string, readFile func(string) ([]byte, error)) (*prowconfig.JobConfig, error) {
+	data, err := readFile(path)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read Prow job config (%w)", err)
 	}
 
+	unmarshal := yaml.Unmarshal
+	if filepath.Ext(path) == ".json" {
+		unmarshal = json.Unmarshal
+	}
 	var jobConfig *prowconfig.JobConfig
-	if err := yaml.Unmarshal(data, &jobConfig); err != nil {
+	if err := unmarshal(data, &jobConfig); err != nil {
 		return nil, fmt.Errorf("failed to load Prow job config (%w)", err)
 	}
 	if jobConfig == nil { // happens when `data` is empty
-		return nil, fmt.Errorf("failed to load Prow job config")
+		return nil, fmt.Errorf("failed to load Prow job config (file is empty)")
 	}
 
 	return jobConfig, nil
@@ -267,21 +1323,236 @@ func readFromFile(path string) (*prowconfig.JobConfig, error) {
 // into files in that directory. Jobs are sharded by branch and by type. If
 // target files already exist and contain Prow job configuration, the jobs will
 // be merged. Jobs will be pruned based on the provided Generator that match the matchLabels set
-func WriteToDir(jobDir, org, repo string, jobConfig *prowconfig.JobConfig, generator Generator, matchLabels labels.Set) error {
+func WriteToDir(jobDir, org, repo string, jobConfig *prowconfig.JobConfig, generator Generator, matchLabels labels.Set, opts ...WriteOption) error {
+	plan, err := planWriteToDir(jobDir, org, repo, jobConfig, generator, matchLabels, newWriteOptions(opts))
+	if err != nil {
+		return err
+	}
+	return plan.apply(filepath.Join(jobDir, org, repo))
+}
+
+// WriteAllToDir writes the jobs for every org/repo in the job config like
+// WriteToDir does for a single one. Presubmits and postsubmits belong to the
+// repo they are configured for, periodics to the repo of their primary extra
+// ref only, so that periodics referencing many repos are written once;
+// periodics without extra refs are not written.
+func WriteAllToDir(jobDir string, jobConfig *prowconfig.JobConfig, generator Generator, matchLabels labels.Set, opts ...WriteOption) error {
+	repos := sets.NewString()
+	periodics := map[string][]prowconfig.Periodic{}
+	var errs []error
+	for _, key := range append(sets.StringKeySet(jobConfig.PresubmitsStatic).List(), sets.StringKeySet(jobConfig.PostsubmitsStatic).List()...) {
+		if parts := strings.Split(key, "/"); len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			errs = append(errs, fmt.Errorf("jobs are configured for %q, which is not an org/repo", key))
+			continue
+		}
+		repos.Insert(key)
+	}
+	for _, job := range jobConfig.Periodics {
+		if ref := primaryRef(job); ref != nil {
+			key := fmt.Sprintf("%s/%s", ref.Org, ref.Repo)
+			repos.Insert(key)
+			periodics[key] = append(periodics[key], job)
+		}
+	}
+	if len(errs) != 0 {
+		return utilerrors.NewAggregate(errs)
+	}
+	for _, key := range repos.List() {
+		parts := strings.Split(key, "/")
+		forRepo := *jobConfig
+		forRepo.Periodics = periodics[key]
+		if err := WriteToDir(jobDir, parts[0], parts[1], &forRepo, generator, matchLabels, opts...); err != nil {
+			errs = append(errs, fmt.Errorf("failed to write jobs for %s: %w", key, err))
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// WriteToDirDryRun determines the changes WriteToDir would make to jobDir
+// without touching the filesystem or modifying the job config
+func WriteToDirDryRun(jobDir, org, repo string, jobConfig *prowconfig.JobConfig, generator Generator, matchLabels labels.Set, opts ...WriteOption) (*WritePlan, error) {
+	return planWriteToDir(jobDir, org, repo, CloneJobConfig(jobConfig), generator, matchLabels, newWriteOptions(opts))
+}
+
+func planWriteToDir(jobDir, org, repo string, jobConfig *prowconfig.JobConfig, generator Generator, matchLabels labels.Set, o *WriteOptions) (*WritePlan, error) {
+	// jobs are merged by name or by identity, so both are recorded
 	allJobs := sets.String{}
+	files := shardJobConfig(org, repo, o, jobConfig, func(job prowconfig.JobBase, identity string) {
+		job.Labels[string(generator)] = string(newlyGenerated)
+		job.Labels[LabelGenerator] = string(generator)
+		allJobs.Insert(job.Name, identity)
+	})
+	if err := checkShardCollisions(org, repo, files, o); err != nil {
+		return nil, err
+	}
+
+	prune := func(jobConfig *prowconfig.JobConfig) (*prowconfig.JobConfig, error) {
+		return Prune(jobConfig, generator, matchLabels)
+	}
+	return planComponentDir(filepath.Join(jobDir, org, repo), files, allJobs, prune, o)
+}
+
+// primaryRef returns the extra ref of the repository a periodic is configured
+// for: the ref cloned into the working directory or, when none is marked as
+// such, the first one. Periodics without extra refs have none.
+func primaryRef(job prowconfig.Periodic) *prowapi.Refs {
+	for i := range job.ExtraRefs {
+		if job.ExtraRefs[i].WorkDir {
+			return &job.ExtraRefs[i]
+		}
+	}
+	if len(job.ExtraRefs) == 0 {
+		return nil
+	}
+	return &job.ExtraRefs[0]
+}
+
+// refForRepo returns the extra ref a periodic is filed under when the jobs of
+// org/repo are written: the ref cloned into the working directory when one is
+// marked as such, otherwise the ref for org/repo in any position. Periodics
+// that are not configured for org/repo have none.
+func refForRepo(job prowconfig.Periodic, org, repo string) *prowapi.Refs {
+	if ref := primaryRef(job); ref != nil && ref.WorkDir {
+		if ref.Org == org && ref.Repo == repo {
+			return ref
+		}
+		return nil
+	}
+	for i := range job.ExtraRefs {
+		if job.ExtraRefs[i].Org == org && job.ExtraRefs[i].Repo == repo {
+			return &job.ExtraRefs[i]
+		}
+	}
+	return nil
+}
+
+// checkShardCollisions ensures that the jobs sharded into a file come from a
+// single branch. Branches that differ only in characters dropped from file
+// names are written to the same file, where the jobs for one branch overwrite
+// the same-named jobs for the other and which no longer tells them apart.
+// Branches are compared without regular expression anchors and escapes, so
+// "master" and "^master$" are the same branch. When BranchLabel is configured
+// to group branches into files on purpose, only jobs that would be merged as
+// the same job are reported.
+func checkShardCollisions(org, repo string, files map[string]*prowconfig.JobConfig, o *WriteOptions) error {
+	var errs []error
+	for _, file := range sets.StringKeySet(files).List() {
+		sources := map[string]sets.String{}
+		branches := map[string][]string{}
+		record := func(jobType, identity string, jobBranches []string) {
+			var branch, source string
+			if len(jobBranches) > 0 {
+				branch, source = strings.Join(jobBranches, ","), branchSource(jobBranches[0])
+			}
+			// branches that leave nothing for a file name label fall back to
+			// the default branch, like jobs without branches
+			if MakeRegexFilenameLabelWithDefault(source, "") == "" {
+				source = o.DefaultBranch
+			}
+			if sources[source] == nil {
+				sources[source] = sets.NewString()
+			}
+			sources[source].Insert(branch)
+			key := jobType + " " + identity
+			branches[key] = append(branches[key], branch)
+		}
+		for _, jobs := range files[file].PresubmitsStatic {
+			for _, job := range jobs {
+				record("presubmit", jobIdentity(job.Name, job.Brancher), job.Branches)
+			}
+		}
+		for _, jobs := range files[file].PostsubmitsStatic {
+			for _, job := range jobs {
+				record("postsubmit", o.Merge.postsubmitIdentity(job), job.Branches)
+			}
+		}
+		for _, job := range files[file].Periodics {
+			record("periodic", job.Name, []string{refForRepo(job, org, repo).BaseRef})
+		}
+		if !o.groupsBranches {
+			if len(sources) > 1 {
+				var colliding []string
+				for _, source := range sets.StringKeySet(sources).List() {
+					colliding = append(colliding, sources[source].List()...)
+				}
+				errs = append(errs, fmt.Errorf("jobs for different branches would be written to %s and overwrite each other (branches: %s)", file, strings.Join(colliding, "; ")))
+			}
+			continue
+		}
+		for _, key := range sets.StringKeySet(branches).List() {
+			if len(branches[key]) > 1 {
+				errs = append(errs, fmt.Errorf("%s is configured %d times for %s (branches: %s), only one would be kept", key, len(branches[key]), file, strings.Join(branches[key], "; ")))
+			}
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// branchSource returns the branch a branch regular expression stands for,
+// without anchors and escapes
+func branchSource(branch string) string {
+	branch = strings.TrimSuffix(strings.TrimPrefix(branch, "^"), "$")
+	var source strings.Builder
+	escaped := false
+	for _, c := range branch {
+		if c == '\\' && !escaped {
+			escaped = true
+			continue
+		}
+		escaped = false
+		source.WriteRune(c)
+	}
+	return source.String()
+}
+
+// WritePlan describes the changes writing job configuration makes to a
+// directory. All paths include the directory written to.
+type WritePlan struct {
+	// Written holds the content of the files that are created or modified,
+	// keyed by path
+	Written map[string][]byte
+	// Removed are the sorted paths of existing files that are removed
+	// because no jobs are left in them
+	Removed []string
+	// Untouched are the sorted paths of existing files that are left as they are
+	Untouched []string
+}
+
+// apply makes the planned changes to the files in dir
+func (p *WritePlan) apply(dir string) error {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+	for _, path := range sets.StringKeySet(p.Written).List() {
+		if err := writeFileAtomically(path, p.Written[path], 0664); err != nil {
+			return err
+		}
+	}
+	for _, path := range p.Removed {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// shardJobConfig splits the jobs configured for org/repo into the files they
+// are written to, keyed by file basename, with file names built as configured
+// in o. Jobs are sharded by branch and by
+// type, and visit is called for every job that is included along with the
+// identity the job is merged by.
+func shardJobConfig(org, repo string, o *WriteOptions, jobConfig *prowconfig.JobConfig, visit func(job prowconfig.JobBase, identity string)) map[string]*prowconfig.JobConfig {
 	files := map[string]*prowconfig.JobConfig{}
 	key := fmt.Sprintf("%s/%s", org, repo)
 	for _, job := range jobConfig.PresubmitsStatic[key] {
-		job.Labels[string(generator)] = string(newlyGenerated)
-		job.Labels[LabelGenerator] = string(generator)
-		allJobs.Insert(job.Name)
-		branch := "master"
+		visit(job.JobBase, jobIdentity(job.Name, job.Brancher))
+		branch := o.DefaultBranch
 		if len(job.Branches) > 0 {
 			branch = job.Branches[0]
 			// branches may be regexps, strip regexp characters and trailing dashes / slashes
-			branch = MakeRegexFilenameLabel(branch)
+			branch = o.BranchLabel(branch)
 		}
-		file := fmt.Sprintf("%s-%s-%s-presubmits.yaml", org, repo, branch)
+		file := strings.Join([]string{org, repo, branch, string(Presubmits)}, o.Separator) + ".yaml"
 		if _, ok := files[file]; ok {
 			files[file].PresubmitsStatic[key] = append(files[file].PresubmitsStatic[key], job)
 		} else {
@@ -291,16 +1562,14 @@ func WriteToDir(jobDir, org, repo string, jobConfig *prowconfig.JobConfig, gener
 		}
 	}
 	for _, job := range jobConfig.PostsubmitsStatic[key] {
-		job.Labels[string(generator)] = string(newlyGenerated)
-		job.Labels[LabelGenerator] = string(generator)
-		allJobs.Insert(job.Name)
-		branch := "master"
+		visit(job.JobBase, o.Merge.postsubmitIdentity(job))
+		branch := o.DefaultBranch
 		if len(job.Branches) > 0 {
 			branch = job.Branches[0]
 			// branches may be regexps, strip regexp characters and trailing dashes / slashes
-			branch = MakeRegexFilenameLabel(branch)
+			branch = o.BranchLabel(branch)
 		}
-		file := fmt.Sprintf("%s-%s-%s-postsubmits.yaml", org, repo, branch)
+		file := strings.Join([]string{org, repo, branch, string(Postsubmits)}, o.Separator) + ".yaml"
 		if _, ok := files[file]; ok {
 			files[file].PostsubmitsStatic[key] = append(files[file].PostsubmitsStatic[key], job)
 		} else {
@@ -310,91 +1579,353 @@ func WriteToDir(jobDir, org, repo string, jobConfig *prowconfig.JobConfig, gener
 		}
 	}
 	for _, job := range jobConfig.Periodics {
-		if len(job.ExtraRefs) == 0 {
+		ref := refForRepo(job, org, repo)
+		if ref == nil {
 			continue
 		}
-		if job.ExtraRefs[0].Org != org || job.ExtraRefs[0].Repo != repo {
-			continue
+		visit(job.JobBase, job.Name)
+		branch := o.BranchLabel(ref.BaseRef)
+		file := strings.Join([]string{org, repo, branch, string(Periodics)}, o.Separator) + ".yaml"
+		if _, ok := files[file]; ok {
+			files[file].Periodics = append(files[file].Periodics, job)
+		} else {
+			files[file] = &prowconfig.JobConfig{Periodics: []prowconfig.Periodic{job}}
+		}
+	}
+	return files
+}
+
+// mergeIntoComponentDir merges the job configuration in files, keyed by file
+// basename, into the files of a component directory, as planned by
+// planComponentDir.
+func mergeIntoComponentDir(jobDirForComponent string, files map[string]*prowconfig.JobConfig, allJobs sets.String, prune func(*prowconfig.JobConfig) (*prowconfig.JobConfig, error), o *WriteOptions) error {
+	plan, err := planComponentDir(jobDirForComponent, files, allJobs, prune, o)
+	if err != nil {
+		return err
+	}
+	return plan.apply(jobDirForComponent)
+}
+
+// planComponentDir plans merging the job configuration in files, keyed by file
+// basename, into the files of a component directory. Existing files are passed
+// through prune before being written; when prune is nil, existing files that
+// are not being merged into are left untouched. Files for excluded branches are
+// neither merged into nor written. Files whose content would not change are
+// left untouched.
+func planComponentDir(jobDirForComponent string, files map[string]*prowconfig.JobConfig, allJobs sets.String, prune func(*prowconfig.JobConfig) (*prowconfig.JobConfig, error), o *WriteOptions) (*WritePlan, error) {
+	plan := &WritePlan{Written: map[string][]byte{}}
+	for file := range files {
+		if info, err := extractInfoFromPathWithSeparator(filepath.Join(jobDirForComponent, file), o.Separator); err == nil && o.isExcluded(info) {
+			delete(files, file)
+		}
+	}
+	record := func(path string, jobConfig *prowconfig.JobConfig) error {
+		current, err := gzip.ReadFileMaybeGZIP(path)
+		exists := err == nil
+		if len(jobConfig.PresubmitsStatic) == 0 && len(jobConfig.PostsubmitsStatic) == 0 && len(jobConfig.Periodics) == 0 {
+			switch {
+			case exists && o.KeepEmptyFiles:
+				plan.Untouched = append(plan.Untouched, path)
+			case exists:
+				plan.Removed = append(plan.Removed, path)
+			}
+			return nil
+		}
+		data, err := o.marshal(jobConfig)
+		if err != nil {
+			return fmt.Errorf("failed to marshal the job config (%w)", err)
+		}
+		if exists && bytes.Equal(current, data) {
+			plan.Untouched = append(plan.Untouched, path)
+			return nil
+		}
+		plan.Written[path] = data
+		return nil
+	}
+	if _, err := os.Stat(jobDirForComponent); err == nil {
+		if err := OperateOnJobConfigSubdir(jobDirForComponent, "", func(jobConfig *prowconfig.JobConfig, info *Info) error {
+			if o.isExcluded(info) {
+				plan.Untouched = append(plan.Untouched, info.Filename)
+				return nil
+			}
+			file := filepath.Base(info.Filename)
+			generated, ok := files[file]
+			if !ok && prune == nil {
+				plan.Untouched = append(plan.Untouched, info.Filename)
+				return nil
+			}
+			if ok {
+				delete(files, file)
+				if len(generated.PresubmitsStatic) != 0 || len(generated.PostsubmitsStatic) != 0 || len(generated.Periodics) != 0 {
+					mergeJobConfig(jobConfig, generated, allJobs, o.Merge)
+					Canonicalize(jobConfig)
+				}
+			}
+			if prune != nil {
+				var err error
+				if jobConfig, err = prune(jobConfig); err != nil {
+					return err
+				}
+			}
+			return record(info.Filename, jobConfig)
+		}, WithWalkSeparator(o.Separator)); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	for file, jobConfig := range files {
+		if prune != nil {
+			var err error
+			if jobConfig, err = prune(jobConfig); err != nil {
+				return nil, err
+			}
+		}
+		Canonicalize(jobConfig)
+		if err := record(filepath.Join(jobDirForComponent, file), jobConfig); err != nil {
+			return nil, err
+		}
+	}
+	sort.Strings(plan.Removed)
+	sort.Strings(plan.Untouched)
+	return plan, nil
+}
+
+// MergeDirs merges the Prow job configuration found in srcDir into destDir.
+// Files keep the names they have in srcDir. Jobs from srcDir replace jobs
+// with the same name in the matching destDir component following the rules
+// used by WriteToDir, and jobs in destDir that are not defined in srcDir are
+// kept. Unlike WriteToDir, no jobs are labeled as generated and nothing is pruned.
+func MergeDirs(destDir, srcDir string) error {
+	type component struct {
+		files   map[string]*prowconfig.JobConfig
+		allJobs sets.String
+	}
+	components := map[string]*component{}
+	if err := OperateOnJobConfigDir(srcDir, func(jobConfig *prowconfig.JobConfig, info *Info) error {
+		key := filepath.Join(info.Org, info.Repo)
+		c, ok := components[key]
+		if !ok {
+			c = &component{files: map[string]*prowconfig.JobConfig{}, allJobs: sets.NewString()}
+			components[key] = c
+		}
+		file := filepath.Base(info.Filename)
+		if existing, ok := c.files[file]; ok {
+			Append(existing, jobConfig)
+		} else {
+			c.files[file] = jobConfig
+		}
+		for _, jobs := range jobConfig.PresubmitsStatic {
+			for _, job := range jobs {
+				c.allJobs.Insert(job.Name, jobIdentity(job.Name, job.Brancher))
+			}
+		}
+		for _, jobs := range jobConfig.PostsubmitsStatic {
+			for _, job := range jobs {
+				c.allJobs.Insert(job.Name, jobIdentity(job.Name, job.Brancher))
+			}
+		}
+		for _, job := range jobConfig.Periodics {
+			c.allJobs.Insert(job.Name)
 		}
-		job.Labels[string(generator)] = string(newlyGenerated)
-		job.Labels[LabelGenerator] = string(generator)
-		allJobs.Insert(job.Name)
-		branch := MakeRegexFilenameLabel(job.ExtraRefs[0].BaseRef)
-		file := fmt.Sprintf("%s-%s-%s-periodics.yaml", org, repo, branch)
-		if _, ok := files[file]; ok {
-			files[file].Periodics = append(files[file].Periodics, job)
-		} else {
-			files[file] = &prowconfig.JobConfig{Periodics: []prowconfig.Periodic{job}}
+		return nil
+	}); err != nil {
+		return fmt.Errorf("failed to read job config from %s: %w", srcDir, err)
+	}
+	var errs []error
+	for _, key := range sets.StringKeySet(components).List() {
+		c := components[key]
+		if err := mergeIntoComponentDir(filepath.Join(destDir, key), c.files, c.allJobs, nil, newWriteOptions(nil)); err != nil {
+			errs = append(errs, fmt.Errorf("failed to merge %s: %w", key, err))
 		}
 	}
+	return utilerrors.NewAggregate(errs)
+}
 
-	jobDirForComponent := filepath.Join(jobDir, org, repo)
-	if err := os.MkdirAll(jobDirForComponent, os.ModePerm); err != nil {
-		return err
-	}
-	if err := OperateOnJobConfigSubdir(jobDirForComponent, "", func(jobConfig *prowconfig.JobConfig, info *Info) error {
-		file := filepath.Base(info.Filename)
-		if generated, ok := files[file]; ok {
-			delete(files, file)
-			if len(generated.PresubmitsStatic) != 0 || len(generated.PostsubmitsStatic) != 0 || len(generated.Periodics) != 0 {
-				mergeJobConfig(jobConfig, generated, allJobs)
-				sortConfigFields(jobConfig)
+// CheckTreeUpToDate determines which job configuration files in srcDir would
+// change if they were read and written back the way WriteToDir writes them,
+// i.e. with their jobs sorted and serialized canonically. Files without any
+// jobs would be removed and are reported as well. The returned paths are
+// relative to srcDir and sorted; an empty list means the tree is up to date.
+// Files that cannot be read, or that are misnamed or misplaced, are reported
+// as errors instead of being skipped.
+func CheckTreeUpToDate(srcDir string) ([]string, error) {
+	o := newWriteOptions(nil)
+	var changed []string
+	var errs []error
+	var lock sync.Mutex
+	collectSkipped := func(walk *WalkOptions) {
+		walk.onSkipped = func(path string, err error) {
+			if errors.Is(err, ErrNotConfigPath) {
+				return
 			}
+			lock.Lock()
+			defer lock.Unlock()
+			errs = append(errs, fmt.Errorf("%s: %w", path, err))
 		}
-		jobConfig, err := Prune(jobConfig, generator, matchLabels)
+	}
+	if err := OperateOnJobConfigDir(srcDir, func(jobConfig *prowconfig.JobConfig, info *Info) error {
+		rel, err := filepath.Rel(srcDir, info.Filename)
 		if err != nil {
 			return err
 		}
-		return WriteToFile(info.Filename, jobConfig)
-	}); err != nil {
-		return err
+		if len(jobConfig.PresubmitsStatic) == 0 && len(jobConfig.PostsubmitsStatic) == 0 && len(jobConfig.Periodics) == 0 {
+			changed = append(changed, rel)
+			return nil
+		}
+		expected, err := o.marshalCanonical(jobConfig)
+		if err != nil {
+			return fmt.Errorf("failed to marshal the job config from %s (%w)", rel, err)
+		}
+		current, err := gzip.ReadFileMaybeGZIP(info.Filename)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", rel, err)
+		}
+		if !bytes.Equal(current, expected) {
+			changed = append(changed, rel)
+		}
+		return nil
+	}, collectSkipped); err != nil {
+		errs = append(errs, err)
 	}
-	for file, jobConfig := range files {
-		jobConfig, err := Prune(jobConfig, generator, matchLabels)
+	if len(errs) > 0 {
+		return nil, utilerrors.NewAggregate(errs)
+	}
+	sort.Strings(changed)
+	return changed, nil
+}
+
+// VerifyDirMatches determines which job configuration files in jobDir differ
+// from what WriteToDir would produce when writing the generated job config
+// with the given generator and match labels, i.e. whether the result of a
+// generation run is already on disk. Only the components that generated has
+// jobs for are checked. The returned paths are relative to jobDir and sorted;
+// an empty list means the directory is in sync. jobDir is not modified.
+func VerifyDirMatches(jobDir string, generated *prowconfig.JobConfig, generator Generator, matchLabels labels.Set, opts ...WriteOption) ([]string, error) {
+	components := sets.NewString()
+	for repo := range generated.PresubmitsStatic {
+		components.Insert(repo)
+	}
+	for repo := range generated.PostsubmitsStatic {
+		components.Insert(repo)
+	}
+	for _, job := range generated.Periodics {
+		if ref := primaryRef(job); ref != nil {
+			components.Insert(fmt.Sprintf("%s/%s", ref.Org, ref.Repo))
+		}
+	}
+	mismatched := sets.NewString()
+	for _, component := range components.List() {
+		orgRepo := strings.Split(component, "/")
+		if len(orgRepo) != 2 {
+			return nil, fmt.Errorf("invalid repo %q, expected org/repo", component)
+		}
+		plan, err := WriteToDirDryRun(jobDir, orgRepo[0], orgRepo[1], generated, generator, matchLabels, opts...)
 		if err != nil {
-			return err
+			return nil, fmt.Errorf("failed to plan writing %s: %w", component, err)
 		}
-		sortConfigFields(jobConfig)
-		if err := WriteToFile(filepath.Join(jobDirForComponent, file), jobConfig); err != nil {
-			return err
+		for _, path := range append(sets.StringKeySet(plan.Written).List(), plan.Removed...) {
+			rel, err := filepath.Rel(jobDir, path)
+			if err != nil {
+				return nil, err
+			}
+			mismatched.Insert(rel)
 		}
 	}
-	return nil
+	return mismatched.List(), nil
+}
+
+// jobIdentity identifies a job when merging same-named jobs: jobs with the
+// same name that target different branches are distinct jobs
+func jobIdentity(name string, brancher prowconfig.Brancher) string {
+	if len(brancher.Branches) == 0 {
+		return name
+	}
+	return fmt.Sprintf("%s@%s", name, strings.Join(brancher.Branches, ","))
+}
+
+// MergeJobConfig merges jobs from source into destination. Jobs are matched by
+// name; presubmits and postsubmits that share their name with others are
+// matched by branches as well. Jobs in both are merged with MergePresubmits,
+// MergePostsubmits and MergePeriodics, jobs only in source are added and jobs
+// only in destination are kept.
+func MergeJobConfig(destination, source *prowconfig.JobConfig) {
+	mergeJobConfig(destination, source, sets.NewString(), MergeOptions{})
+}
+
+// MergeJobConfigWithOptions is MergeJobConfig with jobs matched and merged as
+// configured in o
+func MergeJobConfigWithOptions(destination, source *prowconfig.JobConfig, o MergeOptions) {
+	mergeJobConfig(destination, source, sets.NewString(), o)
+}
+
+// keyJobsForMerge indexes the old and new jobs by the key they are matched on
+// when merging: their name when no other old or new job has it, so that jobs
+// whose branches changed are still merged with their customizations, and their
+// identity otherwise, so that same-named jobs for different branches are told
+// apart
+func keyJobsForMerge[T any](oldJobs, newJobs []T, name, identity func(T) string) (map[string]T, map[string]T) {
+	oldNames, newNames := map[string]int{}, map[string]int{}
+	for _, job := range oldJobs {
+		oldNames[name(job)]++
+	}
+	for _, job := range newJobs {
+		newNames[name(job)]++
+	}
+	key := func(job T) string {
+		if n := name(job); oldNames[n] <= 1 && newNames[n] <= 1 {
+			return n
+		}
+		return identity(job)
+	}
+	oldKeyed, newKeyed := map[string]T{}, map[string]T{}
+	for _, job := range oldJobs {
+		oldKeyed[key(job)] = job
+	}
+	for _, job := range newJobs {
+		newKeyed[key(job)] = job
+	}
+	return oldKeyed, newKeyed
+}
+
+// mergedJobNames lists the identities of the new and old jobs being merged in
+// order, so that merged jobs come out in the same order whether or not they
+// are sorted afterwards
+func mergedJobNames[T any](newJobs, oldJobs map[string]T) []string {
+	return sets.StringKeySet(newJobs).Union(sets.StringKeySet(oldJobs)).List()
 }
 
 // Given two JobConfig, merge jobs from the `source` one to to `destination`
-// one. Jobs are matched by name. All jobs from `source` will be present in
-// `destination` - if there were jobs with the same name in `destination`, they
+// one. Presubmits and postsubmits are matched by name, and by branches as well
+// when there are many jobs with the same name; periodics are matched by name
+// and o can configure postsubmits to be matched by name alone. All jobs
+// from `source` will be present in `destination` - if there were jobs with the same name in `destination`, they
 // will be updated. All jobs in `destination` that are not overwritten this
 // way and are not otherwise in the set of all jobs being written stay untouched.
-func mergeJobConfig(destination, source *prowconfig.JobConfig, allJobs sets.String) {
+func mergeJobConfig(destination, source *prowconfig.JobConfig, allJobs sets.String, o MergeOptions) {
 	// We do the same thing for all jobs
 	if source.PresubmitsStatic != nil {
 		if destination.PresubmitsStatic == nil {
 			destination.PresubmitsStatic = map[string][]prowconfig.Presubmit{}
 		}
 		for repo, jobs := range source.PresubmitsStatic {
-			oldJobs := map[string]prowconfig.Presubmit{}
-			newJobs := map[string]prowconfig.Presubmit{}
-			for _, job := range destination.PresubmitsStatic[repo] {
-				oldJobs[job.Name] = job
-			}
-			for _, job := range jobs {
-				newJobs[job.Name] = job
-			}
+			oldJobs, newJobs := keyJobsForMerge(destination.PresubmitsStatic[repo], jobs, func(job prowconfig.Presubmit) string {
+				return job.Name
+			}, func(job prowconfig.Presubmit) string {
+				return jobIdentity(job.Name, job.Brancher)
+			})
 
 			var mergedJobs []prowconfig.Presubmit
-			for newJobName := range newJobs {
-				newJob := newJobs[newJobName]
-				if oldJob, existed := oldJobs[newJobName]; existed {
-					mergedJobs = append(mergedJobs, mergePresubmits(&oldJob, &newJob))
-				} else {
+			for _, name := range mergedJobNames(newJobs, oldJobs) {
+				newJob, updated := newJobs[name]
+				oldJob, existed := oldJobs[name]
+				switch {
+				case updated && existed:
+					mergedJobs = append(mergedJobs, o.mergePresubmits(&oldJob, &newJob))
+				case updated:
 					mergedJobs = append(mergedJobs, newJob)
-				}
-			}
-			for oldJobName := range oldJobs {
-				if _, updated := newJobs[oldJobName]; !updated && !allJobs.Has(oldJobName) {
-					mergedJobs = append(mergedJobs, oldJobs[oldJobName])
+				case !allJobs.Has(name):
+					mergedJobs = append(mergedJobs, oldJob)
 				}
 			}
 			destination.PresubmitsStatic[repo] = mergedJobs
@@ -405,27 +1936,25 @@ func mergeJobConfig(destination, source *prowconfig.JobConfig, allJobs sets.Stri
 			destination.PostsubmitsStatic = map[string][]prowconfig.Postsubmit{}
 		}
 		for repo, jobs := range source.PostsubmitsStatic {
-			oldJobs := map[string]prowconfig.Postsubmit{}
-			newJobs := map[string]prowconfig.Postsubmit{}
-			for _, job := range destination.PostsubmitsStatic[repo] {
-				oldJobs[job.Name] = job
-			}
-			for _, job := range jobs {
-				newJobs[job.Name] = job
-			}
+			oldJobs, newJobs := keyJobsForMerge(destination.PostsubmitsStatic[repo], jobs, func(job prowconfig.Postsubmit) string {
+				return job.Name
+			}, o.postsubmitIdentity)
 
 			var mergedJobs []prowconfig.Postsubmit
-			for newJobName := range newJobs {
-				newJob := newJobs[newJobName]
-				if oldJob, existed := oldJobs[newJobName]; existed {
-					mergedJobs = append(mergedJobs, mergePostsubmits(&oldJob, &newJob))
-				} else {
+			for _, name := range mergedJobNames(newJobs, oldJobs) {
+				newJob, updated := newJobs[name]
+				oldJob, existed := oldJobs[name]
+				switch {
+				case updated && existed:
+					merged := o.mergePostsubmits(&oldJob, &newJob)
+					if o.KeepPostsubmitBranches {
+						merged.Brancher = oldJob.Brancher
+					}
+					mergedJobs = append(mergedJobs, merged)
+				case updated:
 					mergedJobs = append(mergedJobs, newJob)
-				}
-			}
-			for oldJobName := range oldJobs {
-				if _, updated := newJobs[oldJobName]; !updated && !allJobs.Has(oldJobName) {
-					mergedJobs = append(mergedJobs, oldJobs[oldJobName])
+				case !allJobs.Has(name):
+					mergedJobs = append(mergedJobs, oldJob)
 				}
 			}
 			destination.PostsubmitsStatic[repo] = mergedJobs
@@ -445,27 +1974,26 @@ func mergeJobConfig(destination, source *prowconfig.JobConfig, allJobs sets.Stri
 		}
 
 		var mergedJobs []prowconfig.Periodic
-		for newJobName := range newJobs {
-			newJob := newJobs[newJobName]
-			if oldJob, existed := oldJobs[newJobName]; existed {
-				mergedJobs = append(mergedJobs, mergePeriodics(&oldJob, &newJob))
-			} else {
+		for _, name := range mergedJobNames(newJobs, oldJobs) {
+			newJob, updated := newJobs[name]
+			oldJob, existed := oldJobs[name]
+			switch {
+			case updated && existed:
+				mergedJobs = append(mergedJobs, o.mergePeriodics(&oldJob, &newJob))
+			case updated:
 				mergedJobs = append(mergedJobs, newJob)
-			}
-		}
-		for oldJobName := range oldJobs {
-			if _, updated := newJobs[oldJobName]; !updated && !allJobs.Has(oldJobName) {
-				mergedJobs = append(mergedJobs, oldJobs[oldJobName])
+			case !allJobs.Has(name):
+				mergedJobs = append(mergedJobs, oldJob)
 			}
 		}
 		destination.Periodics = mergedJobs
 	}
 }
 
-// mergePresubmits merges the two configurations, preferring fields
+// MergePresubmits merges the two configurations, preferring fields
 // in the new configuration unless the fields are set in the old
 // configuration and cannot be derived from the ci-operator configuration
-func mergePresubmits(old, new *prowconfig.Presubmit) prowconfig.Presubmit {
+func MergePresubmits(old, new *prowconfig.Presubmit) prowconfig.Presubmit {
 	merged := *new
 
 	merged.AlwaysRun = old.AlwaysRun
@@ -476,6 +2004,19 @@ func mergePresubmits(old, new *prowconfig.Presubmit) prowconfig.Presubmit {
 	if old.Cluster != "" {
 		merged.Cluster = old.Cluster
 	}
+	merged.Spec = mergeNodeSelector(old.Spec, new.Spec)
+	merged.Labels = mergeManualEntries(old.Labels, new.Labels, DefaultGeneratorOwnedLabels)
+	merged.Annotations = mergeManualEntries(old.Annotations, new.Annotations, nil)
+	// triggers and rerun commands differing from every form generated for
+	// the old context were customized and are kept; default ones, including
+	// legacy defaults, are regenerated so that renamed jobs get the new ones
+	shortName := strings.TrimPrefix(old.Context, "ci/prow/")
+	if old.Trigger != "" && old.Trigger != new.Trigger && !isDefaultTrigger(old.Trigger, shortName) {
+		merged.Trigger = old.Trigger
+	}
+	if old.RerunCommand != "" && old.RerunCommand != new.RerunCommand && old.RerunCommand != prowconfig.DefaultRerunCommandFor(shortName) {
+		merged.RerunCommand = old.RerunCommand
+	}
 	if new.RunIfChanged != "" || new.SkipIfOnlyChanged != "" {
 		merged.RunIfChanged = new.RunIfChanged
 		merged.SkipIfOnlyChanged = new.SkipIfOnlyChanged
@@ -495,10 +2036,17 @@ func mergePresubmits(old, new *prowconfig.Presubmit) prowconfig.Presubmit {
 	return merged
 }
 
-// mergePostsubmits merges the two configurations, preferring fields
+// isDefaultTrigger determines whether the trigger is one Prow generated for the
+// job, either in its current or in its legacy form
+func isDefaultTrigger(trigger, shortName string) bool {
+	return trigger == prowconfig.DefaultTriggerFor(shortName) ||
+		trigger == fmt.Sprintf(`(?m)^/test (?:.*? )?%s(?: .*?)?$`, shortName)
+}
+
+// MergePostsubmits merges the two configurations, preferring fields
 // in the new configuration unless the fields are set in the old
 // configuration and cannot be derived from the ci-operator configuration
-func mergePostsubmits(old, new *prowconfig.Postsubmit) prowconfig.Postsubmit {
+func MergePostsubmits(old, new *prowconfig.Postsubmit) prowconfig.Postsubmit {
 	merged := *new
 
 	if _, ok := merged.Labels[cioperatorapi.PromotionJobLabelKey]; !ok {
@@ -507,14 +2055,16 @@ func mergePostsubmits(old, new *prowconfig.Postsubmit) prowconfig.Postsubmit {
 	if old.Cluster != "" {
 		merged.Cluster = old.Cluster
 	}
+	merged.Spec = mergeNodeSelector(old.Spec, new.Spec)
+	merged.Labels = mergeManualEntries(old.Labels, new.Labels, DefaultGeneratorOwnedLabels)
 
 	return merged
 }
 
-// mergePeriodics merges the two configurations, preferring fields
+// MergePeriodics merges the two configurations, preferring fields
 // in the new configuration unless the fields are set in the old
 // configuration and cannot be derived from the ci-operator configuration
-func mergePeriodics(old, new *prowconfig.Periodic) prowconfig.Periodic {
+func MergePeriodics(old, new *prowconfig.Periodic) prowconfig.Periodic {
 	merged := *new
 
 	merged.MaxConcurrency = old.MaxConcurrency
@@ -522,13 +2072,53 @@ func mergePeriodics(old, new *prowconfig.Periodic) prowconfig.Periodic {
 	if old.Cluster != "" {
 		merged.Cluster = old.Cluster
 	}
+	merged.Spec = mergeNodeSelector(old.Spec, new.Spec)
+	merged.Labels = mergeManualEntries(old.Labels, new.Labels, DefaultGeneratorOwnedLabels)
+
+	return merged
+}
+
+// mergeManualEntries returns the labels or annotations of a merged job.
+// Entries on the old job that the new job does not set were added by hand
+// and are kept, unless their key is owned by the generator.
+func mergeManualEntries(old, new map[string]string, owned sets.String) map[string]string {
+	var merged map[string]string
+	for key, value := range old {
+		if _, set := new[key]; set || owned.Has(key) {
+			continue
+		}
+		if merged == nil {
+			merged = make(map[string]string, len(old)+len(new))
+			for key, value := range new {
+				merged[key] = value
+			}
+		}
+		merged[key] = value
+	}
+	if merged == nil {
+		return new
+	}
+	return merged
+}
 
+// mergeNodeSelector returns the pod spec of a merged job. Node selectors are
+// owned by operators who pin jobs to specific node pools, so a selector set on
+// the old job is kept unless the generated job sets one of its own.
+func mergeNodeSelector(old, new *v1.PodSpec) *v1.PodSpec {
+	if old == nil || new == nil || len(old.NodeSelector) == 0 || len(new.NodeSelector) != 0 {
+		return new
+	}
+	merged := new.DeepCopy()
+	merged.NodeSelector = old.NodeSelector
 	return merged
 }
 
-// sortConfigFields sorts array fields inside of job configurations so
-// that their serialized form is stable and deterministic
-func sortConfigFields(jobConfig *prowconfig.JobConfig) {
+// SortJobConfig sorts array fields inside of job configurations so
+// that their serialized form is stable and deterministic. The job config is
+// sorted in place. Tools writing job configuration should sort it this way to
+// produce the same output as WriteToDir; Canonicalize additionally drops
+// empty fields.
+func SortJobConfig(jobConfig *prowconfig.JobConfig) {
 	for repo := range jobConfig.PresubmitsStatic {
 		sort.Slice(jobConfig.PresubmitsStatic[repo], func(i, j int) bool {
 			return jobConfig.PresubmitsStatic[repo][i].Name < jobConfig.PresubmitsStatic[repo][j].Name
@@ -573,49 +2163,414 @@ func sortPodSpec(spec *v1.PodSpec) {
 		for container := range spec.Containers {
 			if len(spec.Containers[container].VolumeMounts) > 0 {
 				sort.Slice(spec.Containers[container].VolumeMounts, func(i, j int) bool {
-					return spec.Containers[container].VolumeMounts[i].Name < spec.Containers[container].VolumeMounts[j].Name
+					return volumeMountLess(spec.Containers[container].VolumeMounts[i], spec.Containers[container].VolumeMounts[j])
 				})
 			}
-			if len(spec.Containers[container].Command) == 1 && spec.Containers[container].Command[0] == "ci-operator" {
-				if len(spec.Containers[container].Args) > 0 {
-					sort.Strings(spec.Containers[container].Args)
-				}
+			if args := ciOperatorFlags(spec.Containers[container]); len(args) > 0 {
+				sort.Strings(args)
 			}
 			if len(spec.Containers[container].Env) > 0 {
 				sort.Slice(spec.Containers[container].Env, func(i, j int) bool {
-					return spec.Containers[container].Env[i].Name < spec.Containers[container].Env[j].Name
+					return envVarLess(spec.Containers[container].Env[i], spec.Containers[container].Env[j])
 				})
 			}
 		}
 	}
 }
 
-// WriteToFile writes Prow job config to a YAML file
-func WriteToFile(path string, jobConfig *prowconfig.JobConfig) error {
-	if len(jobConfig.PresubmitsStatic) == 0 && len(jobConfig.PostsubmitsStatic) == 0 && len(jobConfig.Periodics) == 0 {
+// ciOperatorFlags returns the part of the container args holding the flags
+// passed to ci-operator, which can be sorted. All args are flags when
+// ci-operator is the command; when it is run through a wrapper, either as the
+// last element of the command or as an arg, the args following it are only
+// considered flags if each is a single --flag=value token, as reordering would
+// otherwise break positional arguments or flags taking separate values.
+func ciOperatorFlags(container v1.Container) []string {
+	if len(container.Command) == 1 && container.Command[0] == "ci-operator" {
+		return container.Args
+	}
+	var args []string
+	if len(container.Command) > 0 && filepath.Base(container.Command[len(container.Command)-1]) == "ci-operator" {
+		args = container.Args
+	} else {
+		for i, arg := range container.Args {
+			if filepath.Base(arg) == "ci-operator" {
+				args = container.Args[i+1:]
+				break
+			}
+		}
+	}
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "--") || !strings.Contains(arg, "=") {
+			return nil
+		}
+	}
+	return args
+}
+
+// envVarLess orders env vars by name and, as several vars may share a name,
+// by their value so that the order does not depend on the input order
+func envVarLess(a, b v1.EnvVar) bool {
+	if a.Name != b.Name {
+		return a.Name < b.Name
+	}
+	if a.Value != b.Value {
+		return a.Value < b.Value
+	}
+	return a.ValueFrom.String() < b.ValueFrom.String()
+}
+
+// volumeMountLess orders volume mounts by name and then by where they are
+// mounted, as the same volume may be mounted in several places
+func volumeMountLess(a, b v1.VolumeMount) bool {
+	if a.Name != b.Name {
+		return a.Name < b.Name
+	}
+	if a.MountPath != b.MountPath {
+		return a.MountPath < b.MountPath
+	}
+	return a.SubPath < b.SubPath
+}
+
+// ProwKeyOrder is the order in which Prow itself lays out the top-level keys
+// of job configuration
+var ProwKeyOrder = []string{"presubmits", "postsubmits", "periodics"}
+
+// WriteOptions configure how job configuration is written to files
+type WriteOptions struct {
+	// KeyOrder is the order in which top-level keys are serialized. Keys
+	// that are not listed follow in alphabetical order, which is also the
+	// order used for all keys when KeyOrder is empty.
+	KeyOrder []string
+	// ExcludedBranches are branches WriteToDir does not touch: jobs for them
+	// are neither merged nor written and their existing files are left as
+	// they are. Branches are compared after being normalized into file name
+	// labels, so regular expressions match the file their jobs are written to.
+	ExcludedBranches sets.String
+	// Separator separates the org, repo, branch and type in the names of
+	// the files written and of the existing files merged into. Defaults to
+	// DefaultFilenameSeparator.
+	Separator string
+	// BranchLabel maps the branch jobs are configured for to the label used
+	// for it in file names, which allows grouping the jobs of many branches
+	// into a single file. Defaults to MakeRegexFilenameLabel, falling back
+	// to DefaultBranch instead of "master".
+	BranchLabel func(branch string) string
+	// DefaultBranch is the branch used in the names of the files holding
+	// jobs that are not configured for any branch. Defaults to "master".
+	DefaultBranch string
+	// Merge controls how generated jobs are merged into existing ones
+	Merge MergeOptions
+	// KeepEmptyFiles leaves existing files alone instead of removing them
+	// when the job config to be written to them has no jobs
+	KeepEmptyFiles bool
+
+	// groupsBranches is set when BranchLabel is configured, in which case
+	// the jobs of many branches are written to one file on purpose
+	groupsBranches bool
+}
+
+// MergeOptions control how generated jobs are merged into existing ones
+type MergeOptions struct {
+	// KeepPostsubmitBranches matches postsubmits by name alone and keeps the
+	// branches of the existing postsubmit instead of the generated ones. Jobs
+	// are only merged with jobs in the file they are written to, so branches
+	// with different labels need a BranchLabel that maps them to one file.
+	KeepPostsubmitBranches bool
+	// PresubmitResolver, PostsubmitResolver and PeriodicResolver return the
+	// job an existing job and the generated job it matches are merged into.
+	// They default to MergePresubmits, MergePostsubmits and MergePeriodics.
+	// The branches of postsubmits are kept after resolving when
+	// KeepPostsubmitBranches is set.
+	PresubmitResolver  func(old, new *prowconfig.Presubmit) prowconfig.Presubmit
+	PostsubmitResolver func(old, new *prowconfig.Postsubmit) prowconfig.Postsubmit
+	PeriodicResolver   func(old, new *prowconfig.Periodic) prowconfig.Periodic
+	// GeneratorOwnedLabels replaces DefaultGeneratorOwnedLabels as the labels
+	// of existing jobs that are not kept when the generated job does not set
+	// them. It does not apply to jobs merged by a resolver.
+	GeneratorOwnedLabels sets.String
+}
+
+func (o MergeOptions) mergePresubmits(old, new *prowconfig.Presubmit) prowconfig.Presubmit {
+	if o.PresubmitResolver != nil {
+		return o.PresubmitResolver(old, new)
+	}
+	merged := MergePresubmits(old, new)
+	if o.GeneratorOwnedLabels != nil {
+		merged.Labels = mergeManualEntries(old.Labels, new.Labels, o.GeneratorOwnedLabels)
+	}
+	return merged
+}
+
+func (o MergeOptions) mergePostsubmits(old, new *prowconfig.Postsubmit) prowconfig.Postsubmit {
+	if o.PostsubmitResolver != nil {
+		return o.PostsubmitResolver(old, new)
+	}
+	merged := MergePostsubmits(old, new)
+	if o.GeneratorOwnedLabels != nil {
+		merged.Labels = mergeManualEntries(old.Labels, new.Labels, o.GeneratorOwnedLabels)
+	}
+	return merged
+}
+
+func (o MergeOptions) mergePeriodics(old, new *prowconfig.Periodic) prowconfig.Periodic {
+	if o.PeriodicResolver != nil {
+		return o.PeriodicResolver(old, new)
+	}
+	merged := MergePeriodics(old, new)
+	if o.GeneratorOwnedLabels != nil {
+		merged.Labels = mergeManualEntries(old.Labels, new.Labels, o.GeneratorOwnedLabels)
+	}
+	return merged
+}
+
+// postsubmitIdentity identifies a postsubmit when merging
+func (o MergeOptions) postsubmitIdentity(job prowconfig.Postsubmit) string {
+	if o.KeepPostsubmitBranches {
+		return job.Name
+	}
+	return jobIdentity(job.Name, job.Brancher)
+}
+
+type WriteOption func(*WriteOptions)
+
+// WithKeyOrder serializes the listed top-level keys first, in that order
+func WithKeyOrder(keys ...string) WriteOption {
+	return func(o *WriteOptions) {
+		o.KeyOrder = keys
+	}
+}
+
+// WithExcludedBranches makes WriteToDir leave the given branches untouched
+func WithExcludedBranches(branches ...string) WriteOption {
+	return func(o *WriteOptions) {
+		o.ExcludedBranches = sets.NewString(branches...)
+	}
+}
+
+// isExcluded determines if the file described by info is for an excluded branch
+func (o *WriteOptions) isExcluded(info *Info) bool {
+	if info.Branch == "" {
+		return false
+	}
+	for branch := range o.ExcludedBranches {
+		if o.BranchLabel(branch) == info.Branch {
+			return true
+		}
+	}
+	return false
+}
+
+// WithKeepEmptyFiles leaves existing files for job configs without jobs alone
+// instead of removing them
+func WithKeepEmptyFiles() WriteOption {
+	return func(o *WriteOptions) {
+		o.KeepEmptyFiles = true
+	}
+}
+
+// WithWriteSeparator sets the separator used in the names of the files written
+func WithWriteSeparator(separator string) WriteOption {
+	return func(o *WriteOptions) {
+		o.Separator = separator
+	}
+}
+
+// WithBranchLabel sets the function mapping branches to the labels used for
+// them in file names
+func WithBranchLabel(branchLabel func(branch string) string) WriteOption {
+	return func(o *WriteOptions) {
+		o.BranchLabel = branchLabel
+	}
+}
+
+// WithDefaultBranch sets the branch jobs that are not configured for any
+// branch are written for
+func WithDefaultBranch(branch string) WriteOption {
+	return func(o *WriteOptions) {
+		o.DefaultBranch = branch
+	}
+}
+
+// WithMergeOptions sets how generated jobs are merged into existing ones
+func WithMergeOptions(merge MergeOptions) WriteOption {
+	return func(o *WriteOptions) {
+		o.Merge = merge
+	}
+}
+
+func newWriteOptions(opts []WriteOption) *WriteOptions {
+	o := &WriteOptions{Separator: DefaultFilenameSeparator, DefaultBranch: "master"}
+	for _, opt := range opts {
+		opt(o)
+	}
+	o.groupsBranches = o.BranchLabel != nil
+	if o.BranchLabel == nil {
+		o.BranchLabel = func(branch string) string {
+			return MakeRegexFilenameLabelWithDefault(branch, o.DefaultBranch)
+		}
+	}
+	return o
+}
+
+// marshal serializes the job config to YAML, honoring the key order
+func (o *WriteOptions) marshal(jobConfig *prowconfig.JobConfig) ([]byte, error) {
+	if len(o.KeyOrder) == 0 {
+		return yaml.Marshal(*jobConfig)
+	}
+	raw, err := json.Marshal(*jobConfig)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return nil, err
+	}
+	var keys []string
+	for _, key := range o.KeyOrder {
+		if _, ok := fields[key]; ok {
+			keys = append(keys, key)
+		}
+	}
+	keys = append(keys, sets.StringKeySet(fields).Difference(sets.NewString(o.KeyOrder...)).List()...)
+
+	// serialize each key on its own so that every section is formatted
+	// exactly like it would be by yaml.Marshal
+	var out bytes.Buffer
+	for _, key := range keys {
+		rawField, err := json.Marshal(map[string]json.RawMessage{key: fields[key]})
+		if err != nil {
+			return nil, err
+		}
+		field, err := yaml.JSONToYAML(rawField)
+		if err != nil {
+			return nil, err
+		}
+		out.Write(field)
+	}
+	return out.Bytes(), nil
+}
+
+// MarshalCanonical serializes the job config to YAML in the canonical form it
+// is written in: the bytes are the content WriteToFile writes for the job
+// config, so they can be hashed to detect changes. The job config is not
+// modified.
+func MarshalCanonical(jobConfig *prowconfig.JobConfig, opts ...WriteOption) ([]byte, error) {
+	return newWriteOptions(opts).marshalCanonical(jobConfig)
+}
+
+func (o *WriteOptions) marshalCanonical(jobConfig *prowconfig.JobConfig) ([]byte, error) {
+	canonical := CloneJobConfig(jobConfig)
+	Canonicalize(canonical)
+	return o.marshal(canonical)
+}
+
+// WriteToFile writes Prow job config to a YAML file, gzipped when the path
+// ends in .gz. Files that already hold the serialized job config are not
+// rewritten and files for job configs without jobs are removed, unless
+// WithKeepEmptyFiles is passed.
+func WriteToFile(path string, jobConfig *prowconfig.JobConfig, opts ...WriteOption) error {
+	return newWriteOptions(opts).writeToFile(path, jobConfig)
+}
+
+func (o *WriteOptions) writeToFile(path string, jobConfig *prowconfig.JobConfig) error {
+	canonical := CloneJobConfig(jobConfig)
+	Canonicalize(canonical)
+	if len(canonical.PresubmitsStatic) == 0 && len(canonical.PostsubmitsStatic) == 0 && len(canonical.Periodics) == 0 {
+		if o.KeepEmptyFiles {
+			return nil
+		}
 		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
 			return err
 		}
 		return nil
 	}
-	jobConfigAsYaml, err := yaml.Marshal(*jobConfig)
+	jobConfigAsYaml, err := o.marshal(canonical)
 	if err != nil {
 		return fmt.Errorf("failed to marshal the job config (%w)", err)
 	}
-	if err := ioutil.WriteFile(path, jobConfigAsYaml, 0664); err != nil {
+	// leave files that already have this content alone to keep their mtime
+	if current, err := gzip.ReadFileMaybeGZIP(path); err == nil && bytes.Equal(current, jobConfigAsYaml) {
+		return nil
+	}
+	if strings.HasSuffix(path, ".gz") {
+		if jobConfigAsYaml, err = gzip.Compress(jobConfigAsYaml); err != nil {
+			return fmt.Errorf("failed to compress the job config (%w)", err)
+		}
+	}
+	return writeFileAtomically(path, jobConfigAsYaml, 0664)
+}
+
+// writeTempFile writes the content of a file being replaced; it is a variable
+// so that tests can simulate failures in the middle of a write
+var writeTempFile = func(f *os.File, data []byte) error {
+	_, err := f.Write(data)
+	return err
+}
+
+// writeFileAtomically writes data to a temporary file next to path and renames
+// it into place, so that an interrupted write never leaves a truncated file.
+// An existing file keeps its permissions; new files are created with perm,
+// subject to the umask like with os.WriteFile. When path is a symlink, the
+// file it links to is replaced and the link is kept.
+func writeFileAtomically(path string, data []byte, perm os.FileMode) error {
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	var existingPerm *os.FileMode
+	if info, err := os.Stat(path); err == nil {
+		mode := info.Mode().Perm()
+		existingPerm = &mode
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	tmp, err := createTempFile(path, perm)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := writeTempFile(tmp, data); err != nil {
+		tmp.Close()
 		return err
 	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if existingPerm != nil {
+		if err := os.Chmod(tmp.Name(), *existingPerm); err != nil {
+			return err
+		}
+	}
+	return os.Rename(tmp.Name(), path)
+}
 
-	return nil
+// createTempFile creates a new, hidden file next to path. Unlike os.CreateTemp,
+// the file is created with perm, subject to the umask.
+func createTempFile(path string, perm os.FileMode) (*os.File, error) {
+	for attempt := 0; ; attempt++ {
+		name := filepath.Join(filepath.Dir(path), fmt.Sprintf(".%s.%d", filepath.Base(path), rand.Uint32()))
+		f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, perm)
+		if os.IsExist(err) && attempt < 100 {
+			continue
+		}
+		return f, err
+	}
 }
 
 var regexParts = regexp.MustCompile(`[^\w\-.]+`)
 
 func MakeRegexFilenameLabel(possibleRegex string) string {
+	return MakeRegexFilenameLabelWithDefault(possibleRegex, "master")
+}
+
+// MakeRegexFilenameLabelWithDefault is MakeRegexFilenameLabel falling back
+// to the given branch instead of "master" when nothing is left of the regex
+func MakeRegexFilenameLabelWithDefault(possibleRegex, fallback string) string {
 	label := regexParts.ReplaceAllString(possibleRegex, "")
 	label = strings.TrimLeft(strings.TrimRight(label, "-._"), "-._")
 	if len(label) == 0 {
-		label = "master"
+		label = fallback
 	}
 	return label
 }
@@ -657,31 +2612,136 @@ func staleSelectorFor(generator Generator, pruneLabels labels.Set) (labels.Selec
 	return ls, nil
 }
 
-// Prune removes all generated jobs of the supplied Generator with values that are NOT newly-generated.
+// PruneOptions configure which jobs Prune removes in addition to stale
+// generated ones
+type PruneOptions struct {
+	// RemoveShadowed removes jobs that were not generated by the generator
+	// but have the same name as a job it generated, as happens while
+	// hand-written jobs are migrated to generated ones. Presubmits and
+	// postsubmits collide with jobs of the same type for the same repo,
+	// periodics with any periodic.
+	RemoveShadowed bool
+	// Org and Repo, when set, restrict pruning to the presubmits and
+	// postsubmits for that repo and the periodics whose primary ref is that
+	// repo. Other jobs are kept as they are, newly generated or not.
+	Org, Repo string
+}
+
+type PruneOption func(*PruneOptions)
+
+// WithRemoveShadowed makes Prune remove jobs that collide by name with
+// generated jobs
+func WithRemoveShadowed() PruneOption {
+	return func(o *PruneOptions) {
+		o.RemoveShadowed = true
+	}
+}
+
+// WithPrunedRepo makes Prune only prune the jobs for org/repo
+func WithPrunedRepo(org, repo string) PruneOption {
+	return func(o *PruneOptions) {
+		o.Org, o.Repo = org, repo
+	}
+}
+
+// inScope determines whether jobs configured for the repo are pruned
+func (o *PruneOptions) inScope(org, repo string) bool {
+	if o.Org == "" && o.Repo == "" {
+		return true
+	}
+	return org == o.Org && repo == o.Repo
+}
+
+// periodicInScope determines whether the periodic is pruned
+func (o *PruneOptions) periodicInScope(job prowconfig.Periodic) bool {
+	if o.Org == "" && o.Repo == "" {
+		return true
+	}
+	ref := primaryRef(job)
+	return ref != nil && o.inScope(ref.Org, ref.Repo)
+}
+
+// PruneRepo prunes the job config like Prune does, but only touches the jobs
+// for org/repo, as is needed when only that repo was generated again
+func PruneRepo(jobConfig *prowconfig.JobConfig, generator Generator, pruneLabels labels.Set, org, repo string, opts ...PruneOption) (*prowconfig.JobConfig, error) {
+	return Prune(jobConfig, generator, pruneLabels, append(opts, WithPrunedRepo(org, repo))...)
+}
+
+// Prune removes all generated jobs of the supplied Generator with values that are NOT newly-generated,
+// unless they are exempt from pruning with the PruneExemptAnnotation.
 // Prune() returns the resulting job config (which may even be completely empty).
-func Prune(jobConfig *prowconfig.JobConfig, generator Generator, pruneLabels labels.Set) (*prowconfig.JobConfig, error) {
+func Prune(jobConfig *prowconfig.JobConfig, generator Generator, pruneLabels labels.Set, opts ...PruneOption) (*prowconfig.JobConfig, error) {
+	pruned, _, err := PruneWithReport(jobConfig, generator, pruneLabels, opts...)
+	return pruned, err
+}
+
+// PruneWithReport prunes the job config like Prune does and additionally
+// returns the sorted names of the jobs that were removed.
+func PruneWithReport(jobConfig *prowconfig.JobConfig, generator Generator, pruneLabels labels.Set, opts ...PruneOption) (*prowconfig.JobConfig, []string, error) {
+	o := &PruneOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
 	var pruned prowconfig.JobConfig
+	var removed []string
 	staleSelector, err := staleSelectorFor(generator, pruneLabels)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	isStale := func(job prowconfig.JobBase) bool {
-		return staleSelector.Matches(labels.Set(job.Labels))
+		return staleSelector.Matches(labels.Set(job.Labels)) && !PruneExempt(job)
 	}
 	generatedSelector, err := generatedSelectorFor(generator)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	isGenerated := func(job prowconfig.JobBase) bool {
 		return generatedSelector.Matches(labels.Set(job.Labels))
 	}
+	// generated holds the names of the generated jobs that are kept, keyed by
+	// the scope in which names collide
+	generated := map[string]sets.String{}
+	if o.RemoveShadowed {
+		keep := func(scope string, job prowconfig.JobBase) {
+			if isGenerated(job) && !isStale(job) {
+				if generated[scope] == nil {
+					generated[scope] = sets.NewString()
+				}
+				generated[scope].Insert(job.Name)
+			}
+		}
+		for repo, jobs := range jobConfig.PresubmitsStatic {
+			for _, job := range jobs {
+				keep("presubmits/"+repo, job.JobBase)
+			}
+		}
+		for repo, jobs := range jobConfig.PostsubmitsStatic {
+			for _, job := range jobs {
+				keep("postsubmits/"+repo, job.JobBase)
+			}
+		}
+		for _, job := range jobConfig.Periodics {
+			keep("periodics", job.JobBase)
+		}
+	}
+	isShadowed := func(scope string, job prowconfig.JobBase) bool {
+		return !isGenerated(job) && generated[scope].Has(job.Name)
+	}
+
+	// repoInScope determines whether jobs configured for the org/repo are pruned
+	repoInScope := func(orgRepo string) bool {
+		org, repo, _ := strings.Cut(orgRepo, "/")
+		return o.inScope(org, repo)
+	}
 
 	for repo, jobs := range jobConfig.PresubmitsStatic {
+		inScope := repoInScope(repo)
 		for _, job := range jobs {
-			if isStale(job.JobBase) {
+			if inScope && (isStale(job.JobBase) || isShadowed("presubmits/"+repo, job.JobBase)) {
+				removed = append(removed, job.Name)
 				continue
 			}
-			if isGenerated(job.JobBase) {
+			if inScope && isGenerated(job.JobBase) {
 				delete(job.Labels, string(generator))
 			}
 
@@ -694,11 +2754,13 @@ func Prune(jobConfig *prowconfig.JobConfig, generator Generator, pruneLabels lab
 	}
 
 	for repo, jobs := range jobConfig.PostsubmitsStatic {
+		inScope := repoInScope(repo)
 		for _, job := range jobs {
-			if isStale(job.JobBase) {
+			if inScope && (isStale(job.JobBase) || isShadowed("postsubmits/"+repo, job.JobBase)) {
+				removed = append(removed, job.Name)
 				continue
 			}
-			if isGenerated(job.JobBase) {
+			if inScope && isGenerated(job.JobBase) {
 				delete(job.Labels, string(generator))
 			}
 			if pruned.PostsubmitsStatic == nil {
@@ -710,24 +2772,43 @@ func Prune(jobConfig *prowconfig.JobConfig, generator Generator, pruneLabels lab
 	}
 
 	for _, job := range jobConfig.Periodics {
-		if isStale(job.JobBase) {
+		inScope := o.periodicInScope(job)
+		if inScope && (isStale(job.JobBase) || isShadowed("periodics", job.JobBase)) {
+			removed = append(removed, job.Name)
 			continue
 		}
-		if isGenerated(job.JobBase) {
+		if inScope && isGenerated(job.JobBase) {
 			delete(job.Labels, string(generator))
 		}
 
 		pruned.Periodics = append(pruned.Periodics, job)
 	}
 
-	return &pruned, nil
+	sort.Strings(removed)
+	return &pruned, removed, nil
+}
+
+// ResetGeneratedMarkers removes the markers WriteToDir puts on newly generated
+// jobs until they are pruned, leaving the jobs labeled as generated like Prune
+// does for the jobs it keeps. Nothing is pruned. This recovers job config left
+// behind by an aborted generation run; the number of jobs reset is returned.
+func ResetGeneratedMarkers(jobConfig *prowconfig.JobConfig) int {
+	var reset int
+	forEachJob(jobConfig, func(_, _ string, job prowconfig.JobBase) {
+		generator, generated := job.Labels[LabelGenerator]
+		if generated && job.Labels[generator] == string(newlyGenerated) {
+			delete(job.Labels, generator)
+			reset++
+		}
+	})
+	return reset
 }
 
 // FeatureBranch returns a regex string that matches feature branch prefixes for the given branch name:
 // I.e. returns '^master-' for 'master'. If the given branch name already looks like a regex,
 // return it unchanged.
 func FeatureBranch(branch string) string {
-	if !SimpleBranchRegexp.MatchString(branch) {
+	if !IsSimpleBranch(branch) {
 		return branch
 	}
 	return fmt.Sprintf("^%s-", regexp.QuoteMeta(branch))
@@ -736,7 +2817,7 @@ func FeatureBranch(branch string) string {
 // ExactlyBranch returns a regex string that matches exactly the given branch name: I.e. returns
 // '^master$' for 'master'. If the given branch name already looks like a regex, return it unchanged.
 func ExactlyBranch(branch string) string {
-	if !SimpleBranchRegexp.MatchString(branch) {
+	if !IsSimpleBranch(branch) {
 		return branch
 	}
 	return fmt.Sprintf("^%s$", regexp.QuoteMeta(branch))
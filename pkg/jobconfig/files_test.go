@@ -1,15 +1,35 @@
 package jobconfig
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
 	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"testing/fstest"
+	"time"
 
+	"github.com/ghodss/yaml"
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
 
+	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/labels"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
 	"k8s.io/apimachinery/pkg/util/sets"
+	prowv1 "k8s.io/test-infra/prow/apis/prowjobs/v1"
 	prowconfig "k8s.io/test-infra/prow/config"
+
+	"github.com/openshift/ci-tools/pkg/testhelper"
 )
 
 var unexportedFields = []cmp.Option{
@@ -90,6 +110,130 @@ func TestAppend(t *testing.T) {
 	}
 }
 
+func TestAppendStrict(t *testing.T) {
+	dest := func() *prowconfig.JobConfig {
+		return &prowconfig.JobConfig{
+			PresubmitsStatic:  map[string][]prowconfig.Presubmit{"org/repo": {{JobBase: prowconfig.JobBase{Name: "presubmit"}}}},
+			PostsubmitsStatic: map[string][]prowconfig.Postsubmit{"org/repo": {{JobBase: prowconfig.JobBase{Name: "postsubmit"}}}},
+			Periodics:         []prowconfig.Periodic{{JobBase: prowconfig.JobBase{Name: "periodic"}}},
+		}
+	}
+	testCases := []struct {
+		name        string
+		part        *prowconfig.JobConfig
+		expected    *prowconfig.JobConfig
+		expectedErr error
+	}{
+		{
+			name: "distinct jobs and same names for other repos are appended",
+			part: &prowconfig.JobConfig{
+				PresubmitsStatic: map[string][]prowconfig.Presubmit{
+					"org/repo":  {{JobBase: prowconfig.JobBase{Name: "other"}}},
+					"org/other": {{JobBase: prowconfig.JobBase{Name: "presubmit"}}},
+				},
+				Periodics: []prowconfig.Periodic{{JobBase: prowconfig.JobBase{Name: "other"}}},
+			},
+			expected: &prowconfig.JobConfig{
+				PresubmitsStatic: map[string][]prowconfig.Presubmit{
+					"org/repo":  {{JobBase: prowconfig.JobBase{Name: "presubmit"}}, {JobBase: prowconfig.JobBase{Name: "other"}}},
+					"org/other": {{JobBase: prowconfig.JobBase{Name: "presubmit"}}},
+				},
+				PostsubmitsStatic: map[string][]prowconfig.Postsubmit{"org/repo": {{JobBase: prowconfig.JobBase{Name: "postsubmit"}}}},
+				Periodics:         []prowconfig.Periodic{{JobBase: prowconfig.JobBase{Name: "periodic"}}, {JobBase: prowconfig.JobBase{Name: "other"}}},
+			},
+		},
+		{
+			name: "duplicates are reported and nothing is appended",
+			part: &prowconfig.JobConfig{
+				PresubmitsStatic:  map[string][]prowconfig.Presubmit{"org/repo": {{JobBase: prowconfig.JobBase{Name: "presubmit"}}, {JobBase: prowconfig.JobBase{Name: "other"}}}},
+				PostsubmitsStatic: map[string][]prowconfig.Postsubmit{"org/repo": {{JobBase: prowconfig.JobBase{Name: "postsubmit"}}}},
+				Periodics:         []prowconfig.Periodic{{JobBase: prowconfig.JobBase{Name: "periodic"}}},
+			},
+			expected: dest(),
+			expectedErr: utilerrors.NewAggregate([]error{
+				errors.New("presubmit presubmit for org/repo is already defined"),
+				errors.New("postsubmit postsubmit for org/repo is already defined"),
+				errors.New("periodic periodic is already defined"),
+			}),
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			actual := dest()
+			err := AppendStrict(actual, tc.part)
+			if diff := cmp.Diff(tc.expectedErr, err, testhelper.EquateErrorMessage); diff != "" {
+				t.Errorf("error differs from expected:\n%s", diff)
+			}
+			if diff := cmp.Diff(tc.expected, actual, unexportedFields...); diff != "" {
+				t.Errorf("job config differs from expected:\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestAppendDeduplicated(t *testing.T) {
+	presubmit := func(name, command string) prowconfig.Presubmit {
+		return prowconfig.Presubmit{JobBase: prowconfig.JobBase{Name: name, Spec: &v1.PodSpec{Containers: []v1.Container{{Command: []string{command}}}}}}
+	}
+	periodic := func(name, command string) prowconfig.Periodic {
+		return prowconfig.Periodic{JobBase: prowconfig.JobBase{Name: name, Spec: &v1.PodSpec{Containers: []v1.Container{{Command: []string{command}}}}}}
+	}
+	dest := func() *prowconfig.JobConfig {
+		return &prowconfig.JobConfig{
+			PresubmitsStatic: map[string][]prowconfig.Presubmit{"org/repo": {presubmit("presubmit", "test")}},
+			Periodics:        []prowconfig.Periodic{periodic("periodic", "test")},
+		}
+	}
+	testCases := []struct {
+		name        string
+		part        *prowconfig.JobConfig
+		expected    *prowconfig.JobConfig
+		expectedErr error
+	}{
+		{
+			name: "exact duplicates are skipped and distinct jobs are appended",
+			part: &prowconfig.JobConfig{
+				PresubmitsStatic: map[string][]prowconfig.Presubmit{
+					"org/repo":  {presubmit("presubmit", "test"), presubmit("other", "test"), presubmit("other", "test")},
+					"org/other": {presubmit("presubmit", "lint")},
+				},
+				Periodics: []prowconfig.Periodic{periodic("periodic", "test"), periodic("other", "test")},
+			},
+			expected: &prowconfig.JobConfig{
+				PresubmitsStatic: map[string][]prowconfig.Presubmit{
+					"org/repo":  {presubmit("presubmit", "test"), presubmit("other", "test")},
+					"org/other": {presubmit("presubmit", "lint")},
+				},
+				Periodics: []prowconfig.Periodic{periodic("periodic", "test"), periodic("other", "test")},
+			},
+		},
+		{
+			name: "near-duplicates are reported and nothing is appended",
+			part: &prowconfig.JobConfig{
+				PresubmitsStatic: map[string][]prowconfig.Presubmit{"org/repo": {presubmit("presubmit", "lint"), presubmit("other", "test")}},
+				Periodics:        []prowconfig.Periodic{periodic("periodic", "test"), periodic("other", "test"), periodic("other", "lint")},
+			},
+			expected: dest(),
+			expectedErr: utilerrors.NewAggregate([]error{
+				errors.New("presubmit presubmit for org/repo is already defined differently"),
+				errors.New("periodic other is already defined differently"),
+			}),
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			actual := dest()
+			err := AppendDeduplicated(actual, tc.part)
+			if diff := cmp.Diff(tc.expectedErr, err, testhelper.EquateErrorMessage); diff != "" {
+				t.Errorf("error differs from expected:\n%s", diff)
+			}
+			if diff := cmp.Diff(tc.expected, actual, unexportedFields...); diff != "" {
+				t.Errorf("job config differs from expected:\n%s", diff)
+			}
+		})
+	}
+}
+
 func TestMergeJobConfig(t *testing.T) {
 	tests := []struct {
 		allJobs                       sets.String
@@ -122,8 +266,8 @@ func TestMergeJobConfig(t *testing.T) {
 			},
 			expected: &prowconfig.JobConfig{
 				PresubmitsStatic: map[string][]prowconfig.Presubmit{"organization/repository": {
-					{JobBase: prowconfig.JobBase{Name: "source-job"}, Reporter: prowconfig.Reporter{Context: "ci/prow/source"}},
 					{JobBase: prowconfig.JobBase{Name: "another-job"}, Reporter: prowconfig.Reporter{Context: "ci/prow/another"}},
+					{JobBase: prowconfig.JobBase{Name: "source-job"}, Reporter: prowconfig.Reporter{Context: "ci/prow/source"}},
 				}},
 			},
 		}, {
@@ -170,8 +314,8 @@ func TestMergeJobConfig(t *testing.T) {
 			},
 			expected: &prowconfig.JobConfig{
 				PostsubmitsStatic: map[string][]prowconfig.Postsubmit{"organization/repository": {
-					{JobBase: prowconfig.JobBase{Name: "source-job", Agent: "ci/prow/source"}},
 					{JobBase: prowconfig.JobBase{Name: "another-job", Agent: "ci/prow/another"}},
+					{JobBase: prowconfig.JobBase{Name: "source-job", Agent: "ci/prow/source"}},
 				}},
 			},
 		}, {
@@ -224,14 +368,53 @@ func TestMergeJobConfig(t *testing.T) {
 			},
 			expected: &prowconfig.JobConfig{
 				PostsubmitsStatic: map[string][]prowconfig.Postsubmit{"organization/repository": {
-					{JobBase: prowconfig.JobBase{Name: "same-job", Agent: "ci/prow/same"}},
 					{JobBase: prowconfig.JobBase{Name: "old-job", Agent: "ci/prow/same"}},
+					{JobBase: prowconfig.JobBase{Name: "same-job", Agent: "ci/prow/same"}},
+				}},
+			},
+		},
+		{
+			allJobs: sets.NewString("same-job", "same-job@master"),
+			destination: &prowconfig.JobConfig{
+				PresubmitsStatic: map[string][]prowconfig.Presubmit{"organization/repository": {
+					{JobBase: prowconfig.JobBase{Name: "same-job"}, Brancher: prowconfig.Brancher{Branches: []string{"master"}}, Reporter: prowconfig.Reporter{Context: "ci/prow/same"}},
+					{JobBase: prowconfig.JobBase{Name: "same-job"}, Brancher: prowconfig.Brancher{Branches: []string{"release-4.1"}}, Reporter: prowconfig.Reporter{Context: "ci/prow/same"}},
+				}},
+			},
+			source: &prowconfig.JobConfig{
+				PresubmitsStatic: map[string][]prowconfig.Presubmit{"organization/repository": {
+					{JobBase: prowconfig.JobBase{Name: "same-job"}, Brancher: prowconfig.Brancher{Branches: []string{"master"}}, Reporter: prowconfig.Reporter{Context: "ci/prow/different"}},
+				}},
+			},
+			expected: &prowconfig.JobConfig{
+				PresubmitsStatic: map[string][]prowconfig.Presubmit{"organization/repository": {
+					{JobBase: prowconfig.JobBase{Name: "same-job"}, Brancher: prowconfig.Brancher{Branches: []string{"master"}}, Reporter: prowconfig.Reporter{Context: "ci/prow/different"}},
+					{JobBase: prowconfig.JobBase{Name: "same-job"}, Brancher: prowconfig.Brancher{Branches: []string{"release-4.1"}}, Reporter: prowconfig.Reporter{Context: "ci/prow/same"}},
+				}},
+			},
+		},
+		{
+			// only the branches changed, so the job is merged and keeps its customizations
+			allJobs: sets.NewString("job", "job@^master$"),
+			destination: &prowconfig.JobConfig{
+				PresubmitsStatic: map[string][]prowconfig.Presubmit{"organization/repository": {
+					{JobBase: prowconfig.JobBase{Name: "job", Cluster: "build02", MaxConcurrency: 2}, AlwaysRun: false, Brancher: prowconfig.Brancher{Branches: []string{"master"}}, Reporter: prowconfig.Reporter{Context: "ci/prow/job"}, Trigger: "/test custom"},
+				}},
+			},
+			source: &prowconfig.JobConfig{
+				PresubmitsStatic: map[string][]prowconfig.Presubmit{"organization/repository": {
+					{JobBase: prowconfig.JobBase{Name: "job"}, AlwaysRun: true, Brancher: prowconfig.Brancher{Branches: []string{"^master$"}}, Reporter: prowconfig.Reporter{Context: "ci/prow/job"}},
+				}},
+			},
+			expected: &prowconfig.JobConfig{
+				PresubmitsStatic: map[string][]prowconfig.Presubmit{"organization/repository": {
+					{JobBase: prowconfig.JobBase{Name: "job", Cluster: "build02", MaxConcurrency: 2}, AlwaysRun: false, Brancher: prowconfig.Brancher{Branches: []string{"^master$"}}, Reporter: prowconfig.Reporter{Context: "ci/prow/job"}, Trigger: "/test custom"},
 				}},
 			},
 		},
 	}
 	for _, tc := range tests {
-		mergeJobConfig(tc.destination, tc.source, tc.allJobs)
+		mergeJobConfig(tc.destination, tc.source, tc.allJobs, MergeOptions{})
 
 		if diff := cmp.Diff(tc.expected, tc.destination, unexportedFields...); diff != "" {
 			t.Errorf("expected merged job config diff: %s", diff)
@@ -239,6 +422,180 @@ func TestMergeJobConfig(t *testing.T) {
 	}
 }
 
+func TestMergeJobConfigKeepsDestinationJobs(t *testing.T) {
+	destination := &prowconfig.JobConfig{
+		PresubmitsStatic: map[string][]prowconfig.Presubmit{"org/repo": {
+			{JobBase: prowconfig.JobBase{Name: "merged", MaxConcurrency: 1}, AlwaysRun: true},
+			{JobBase: prowconfig.JobBase{Name: "kept"}},
+		}},
+		Periodics: []prowconfig.Periodic{{JobBase: prowconfig.JobBase{Name: "periodic", Cluster: "build01"}}},
+	}
+	source := &prowconfig.JobConfig{
+		PresubmitsStatic: map[string][]prowconfig.Presubmit{"org/repo": {
+			{JobBase: prowconfig.JobBase{Name: "merged"}, Reporter: prowconfig.Reporter{Context: "ci/prow/merged"}},
+		}},
+		PostsubmitsStatic: map[string][]prowconfig.Postsubmit{"org/repo": {
+			{JobBase: prowconfig.JobBase{Name: "added"}},
+		}},
+		Periodics: []prowconfig.Periodic{{JobBase: prowconfig.JobBase{Name: "periodic", Cluster: "build02"}, Interval: "24h"}},
+	}
+	expected := &prowconfig.JobConfig{
+		PresubmitsStatic: map[string][]prowconfig.Presubmit{"org/repo": {
+			{JobBase: prowconfig.JobBase{Name: "kept"}},
+			{JobBase: prowconfig.JobBase{Name: "merged", MaxConcurrency: 1}, AlwaysRun: true, Reporter: prowconfig.Reporter{Context: "ci/prow/merged"}},
+		}},
+		PostsubmitsStatic: map[string][]prowconfig.Postsubmit{"org/repo": {
+			{JobBase: prowconfig.JobBase{Name: "added"}},
+		}},
+		Periodics: []prowconfig.Periodic{{JobBase: prowconfig.JobBase{Name: "periodic", Cluster: "build01"}, Interval: "24h"}},
+	}
+
+	MergeJobConfig(destination, source)
+	SortJobConfig(destination)
+	if diff := cmp.Diff(expected, destination, unexportedFields...); diff != "" {
+		t.Errorf("merged job config differs from expected:\n%s", diff)
+	}
+}
+
+func TestMergeJobConfigOrder(t *testing.T) {
+	names := []string{"e", "b", "g", "a", "f", "c", "d", "h"}
+	expected := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+	for i := 0; i < 20; i++ {
+		destination := &prowconfig.JobConfig{}
+		source := &prowconfig.JobConfig{}
+		for j, name := range names {
+			// half of the jobs exist already, half are added
+			target := source
+			if j%2 == 0 {
+				target = destination
+			}
+			if target.PresubmitsStatic == nil {
+				target.PresubmitsStatic = map[string][]prowconfig.Presubmit{}
+				target.PostsubmitsStatic = map[string][]prowconfig.Postsubmit{}
+			}
+			target.PresubmitsStatic["org/repo"] = append(target.PresubmitsStatic["org/repo"], prowconfig.Presubmit{JobBase: prowconfig.JobBase{Name: name}})
+			target.PostsubmitsStatic["org/repo"] = append(target.PostsubmitsStatic["org/repo"], prowconfig.Postsubmit{JobBase: prowconfig.JobBase{Name: name}})
+			target.Periodics = append(target.Periodics, prowconfig.Periodic{JobBase: prowconfig.JobBase{Name: name}})
+		}
+
+		MergeJobConfig(destination, source)
+		var presubmits, postsubmits, periodics []string
+		for _, job := range destination.PresubmitsStatic["org/repo"] {
+			presubmits = append(presubmits, job.Name)
+		}
+		for _, job := range destination.PostsubmitsStatic["org/repo"] {
+			postsubmits = append(postsubmits, job.Name)
+		}
+		for _, job := range destination.Periodics {
+			periodics = append(periodics, job.Name)
+		}
+		for jobType, actual := range map[string][]string{"presubmits": presubmits, "postsubmits": postsubmits, "periodics": periodics} {
+			if diff := cmp.Diff(expected, actual); diff != "" {
+				t.Fatalf("run %d: merged %s are not sorted:\n%s", i, jobType, diff)
+			}
+		}
+	}
+}
+
+func TestMergeJobConfigWithResolvers(t *testing.T) {
+	destination := &prowconfig.JobConfig{
+		PresubmitsStatic: map[string][]prowconfig.Presubmit{"org/repo": {
+			{JobBase: prowconfig.JobBase{Name: "merged", MaxConcurrency: 1}},
+			{JobBase: prowconfig.JobBase{Name: "kept"}},
+		}},
+		PostsubmitsStatic: map[string][]prowconfig.Postsubmit{"org/repo": {
+			{JobBase: prowconfig.JobBase{Name: "merged", Cluster: "build01"}},
+		}},
+		Periodics: []prowconfig.Periodic{{JobBase: prowconfig.JobBase{Name: "periodic", Cluster: "build01"}, Interval: "12h"}},
+	}
+	source := &prowconfig.JobConfig{
+		PresubmitsStatic: map[string][]prowconfig.Presubmit{"org/repo": {
+			{JobBase: prowconfig.JobBase{Name: "merged", MaxConcurrency: 2}},
+			{JobBase: prowconfig.JobBase{Name: "added"}},
+		}},
+		PostsubmitsStatic: map[string][]prowconfig.Postsubmit{"org/repo": {
+			{JobBase: prowconfig.JobBase{Name: "merged", Cluster: "build02"}},
+		}},
+		Periodics: []prowconfig.Periodic{{JobBase: prowconfig.JobBase{Name: "periodic", Cluster: "build02"}, Interval: "24h"}},
+	}
+	var resolved []string
+	o := MergeOptions{
+		PresubmitResolver: func(old, new *prowconfig.Presubmit) prowconfig.Presubmit {
+			resolved = append(resolved, old.Name)
+			merged := *new
+			if old.MaxConcurrency > merged.MaxConcurrency {
+				merged.MaxConcurrency = old.MaxConcurrency
+			}
+			merged.MaxConcurrency += 10
+			return merged
+		},
+		PeriodicResolver: func(old, new *prowconfig.Periodic) prowconfig.Periodic {
+			resolved = append(resolved, old.Name)
+			return *old
+		},
+	}
+	expected := &prowconfig.JobConfig{
+		PresubmitsStatic: map[string][]prowconfig.Presubmit{"org/repo": {
+			{JobBase: prowconfig.JobBase{Name: "added"}},
+			{JobBase: prowconfig.JobBase{Name: "kept"}},
+			{JobBase: prowconfig.JobBase{Name: "merged", MaxConcurrency: 12}},
+		}},
+		PostsubmitsStatic: map[string][]prowconfig.Postsubmit{"org/repo": {
+			{JobBase: prowconfig.JobBase{Name: "merged", Cluster: "build01"}},
+		}},
+		Periodics: []prowconfig.Periodic{{JobBase: prowconfig.JobBase{Name: "periodic", Cluster: "build01"}, Interval: "12h"}},
+	}
+
+	MergeJobConfigWithOptions(destination, source, o)
+	if diff := cmp.Diff(expected, destination, unexportedFields...); diff != "" {
+		t.Errorf("merged job config differs from expected:\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"merged", "periodic"}, resolved); diff != "" {
+		t.Errorf("resolved jobs differ from expected:\n%s", diff)
+	}
+}
+
+func TestMergeJobConfigGeneratorOwnedLabels(t *testing.T) {
+	destination := &prowconfig.JobConfig{
+		PresubmitsStatic: map[string][]prowconfig.Presubmit{"org/repo": {
+			{JobBase: prowconfig.JobBase{Name: "presubmit", Labels: map[string]string{CanBeRehearsedLabel: CanBeRehearsedValue, "team": "ci"}}},
+		}},
+		PostsubmitsStatic: map[string][]prowconfig.Postsubmit{"org/repo": {
+			{JobBase: prowconfig.JobBase{Name: "postsubmit", Labels: map[string]string{CanBeRehearsedLabel: CanBeRehearsedValue, ProwJobLabelVariant: "old"}}},
+		}},
+		Periodics: []prowconfig.Periodic{
+			{JobBase: prowconfig.JobBase{Name: "periodic", Labels: map[string]string{CanBeRehearsedLabel: CanBeRehearsedValue, "team": "ci"}}},
+		},
+	}
+	source := &prowconfig.JobConfig{
+		PresubmitsStatic: map[string][]prowconfig.Presubmit{"org/repo": {
+			{JobBase: prowconfig.JobBase{Name: "presubmit", Labels: map[string]string{LabelGenerator: "prowgen"}}},
+		}},
+		PostsubmitsStatic: map[string][]prowconfig.Postsubmit{"org/repo": {
+			{JobBase: prowconfig.JobBase{Name: "postsubmit"}},
+		}},
+		Periodics: []prowconfig.Periodic{
+			{JobBase: prowconfig.JobBase{Name: "periodic"}},
+		},
+	}
+	expected := &prowconfig.JobConfig{
+		PresubmitsStatic: map[string][]prowconfig.Presubmit{"org/repo": {
+			{JobBase: prowconfig.JobBase{Name: "presubmit", Labels: map[string]string{CanBeRehearsedLabel: CanBeRehearsedValue, LabelGenerator: "prowgen"}}},
+		}},
+		PostsubmitsStatic: map[string][]prowconfig.Postsubmit{"org/repo": {
+			{JobBase: prowconfig.JobBase{Name: "postsubmit", Labels: map[string]string{CanBeRehearsedLabel: CanBeRehearsedValue, ProwJobLabelVariant: "old"}}},
+		}},
+		Periodics: []prowconfig.Periodic{
+			{JobBase: prowconfig.JobBase{Name: "periodic", Labels: map[string]string{CanBeRehearsedLabel: CanBeRehearsedValue}}},
+		},
+	}
+
+	MergeJobConfigWithOptions(destination, source, MergeOptions{GeneratorOwnedLabels: sets.NewString("team")})
+	if diff := cmp.Diff(expected, destination, unexportedFields...); diff != "" {
+		t.Errorf("merged job config differs from expected:\n%s", diff)
+	}
+}
+
 func TestMergePresubmits(t *testing.T) {
 	var testCases = []struct {
 		name     string
@@ -428,10 +785,97 @@ func TestMergePresubmits(t *testing.T) {
 			new:      &prowconfig.Presubmit{RegexpChangeMatcher: prowconfig.RegexpChangeMatcher{SkipIfOnlyChanged: "new"}},
 			expected: prowconfig.Presubmit{RegexpChangeMatcher: prowconfig.RegexpChangeMatcher{SkipIfOnlyChanged: "new"}},
 		},
+		{
+			name:     "node selector from old is kept when new does not set one",
+			old:      &prowconfig.Presubmit{JobBase: prowconfig.JobBase{Spec: &v1.PodSpec{NodeSelector: map[string]string{"pool": "old"}}}},
+			new:      &prowconfig.Presubmit{JobBase: prowconfig.JobBase{Spec: &v1.PodSpec{ServiceAccountName: "new"}}},
+			expected: prowconfig.Presubmit{JobBase: prowconfig.JobBase{Spec: &v1.PodSpec{ServiceAccountName: "new", NodeSelector: map[string]string{"pool": "old"}}}},
+		},
+		{
+			name:     "node selector from new takes precedence",
+			old:      &prowconfig.Presubmit{JobBase: prowconfig.JobBase{Spec: &v1.PodSpec{NodeSelector: map[string]string{"pool": "old"}}}},
+			new:      &prowconfig.Presubmit{JobBase: prowconfig.JobBase{Spec: &v1.PodSpec{NodeSelector: map[string]string{"pool": "new"}}}},
+			expected: prowconfig.Presubmit{JobBase: prowconfig.JobBase{Spec: &v1.PodSpec{NodeSelector: map[string]string{"pool": "new"}}}},
+		},
+		{
+			name:     "annotations from old are kept unless new sets them",
+			old:      &prowconfig.Presubmit{JobBase: prowconfig.JobBase{Annotations: map[string]string{"team": "ci", "owner": "old"}}},
+			new:      &prowconfig.Presubmit{JobBase: prowconfig.JobBase{Annotations: map[string]string{"owner": "new", "generated": "true"}}},
+			expected: prowconfig.Presubmit{JobBase: prowconfig.JobBase{Annotations: map[string]string{"team": "ci", "owner": "new", "generated": "true"}}},
+		},
+		{
+			name: "customized trigger and rerun command from old are kept",
+			old: &prowconfig.Presubmit{
+				Reporter:     prowconfig.Reporter{Context: "ci/prow/unit"},
+				Trigger:      `(?m)^/test( | .* )(unit|all),?($|\s.*)`,
+				RerunCommand: "/test unit all",
+			},
+			new: &prowconfig.Presubmit{
+				Reporter:     prowconfig.Reporter{Context: "ci/prow/unit"},
+				Trigger:      prowconfig.DefaultTriggerFor("unit"),
+				RerunCommand: prowconfig.DefaultRerunCommandFor("unit"),
+			},
+			expected: prowconfig.Presubmit{
+				Reporter:     prowconfig.Reporter{Context: "ci/prow/unit"},
+				Trigger:      `(?m)^/test( | .* )(unit|all),?($|\s.*)`,
+				RerunCommand: "/test unit all",
+			},
+		},
+		{
+			name: "legacy default trigger from old is regenerated",
+			old: &prowconfig.Presubmit{
+				Reporter: prowconfig.Reporter{Context: "ci/prow/images"},
+				Trigger:  `(?m)^/test (?:.*? )?images(?: .*?)?$`,
+			},
+			new: &prowconfig.Presubmit{
+				Reporter: prowconfig.Reporter{Context: "ci/prow/images"},
+				Trigger:  prowconfig.DefaultTriggerFor("images"),
+			},
+			expected: prowconfig.Presubmit{
+				Reporter: prowconfig.Reporter{Context: "ci/prow/images"},
+				Trigger:  prowconfig.DefaultTriggerFor("images"),
+			},
+		},
+		{
+			name: "default trigger and rerun command from old are regenerated",
+			old: &prowconfig.Presubmit{
+				Reporter:     prowconfig.Reporter{Context: "ci/prow/unit"},
+				Trigger:      prowconfig.DefaultTriggerFor("unit"),
+				RerunCommand: prowconfig.DefaultRerunCommandFor("unit"),
+			},
+			new: &prowconfig.Presubmit{
+				Reporter:     prowconfig.Reporter{Context: "ci/prow/unit-tests"},
+				Trigger:      prowconfig.DefaultTriggerFor("unit-tests"),
+				RerunCommand: prowconfig.DefaultRerunCommandFor("unit-tests"),
+			},
+			expected: prowconfig.Presubmit{
+				Reporter:     prowconfig.Reporter{Context: "ci/prow/unit-tests"},
+				Trigger:      prowconfig.DefaultTriggerFor("unit-tests"),
+				RerunCommand: prowconfig.DefaultRerunCommandFor("unit-tests"),
+			},
+		},
+		{
+			name:     "annotations from old are kept when new has none",
+			old:      &prowconfig.Presubmit{JobBase: prowconfig.JobBase{Annotations: map[string]string{"team": "ci"}}},
+			new:      &prowconfig.Presubmit{},
+			expected: prowconfig.Presubmit{JobBase: prowconfig.JobBase{Annotations: map[string]string{"team": "ci"}}},
+		},
+		{
+			name:     "labels added to old by hand are kept",
+			old:      &prowconfig.Presubmit{JobBase: prowconfig.JobBase{Labels: map[string]string{CanBeRehearsedLabel: CanBeRehearsedValue, LabelGenerator: "prowgen"}}},
+			new:      &prowconfig.Presubmit{JobBase: prowconfig.JobBase{Labels: map[string]string{LabelGenerator: "prowgen"}}},
+			expected: prowconfig.Presubmit{JobBase: prowconfig.JobBase{Labels: map[string]string{CanBeRehearsedLabel: CanBeRehearsedValue, LabelGenerator: "prowgen"}}},
+		},
+		{
+			name:     "generator owned labels new does not set are dropped",
+			old:      &prowconfig.Presubmit{JobBase: prowconfig.JobBase{Labels: map[string]string{ProwJobLabelVariant: "old", JobReleaseKey: "4.12", "team": "ci"}}},
+			new:      &prowconfig.Presubmit{JobBase: prowconfig.JobBase{Labels: map[string]string{JobReleaseKey: "4.13"}}},
+			expected: prowconfig.Presubmit{JobBase: prowconfig.JobBase{Labels: map[string]string{JobReleaseKey: "4.13", "team": "ci"}}},
+		},
 	}
 	for _, testCase := range testCases {
 		t.Run(testCase.name, func(t *testing.T) {
-			result := mergePresubmits(testCase.old, testCase.new)
+			result := MergePresubmits(testCase.old, testCase.new)
 			if diff := cmp.Diff(testCase.expected, result, unexportedFields...); diff != "" {
 				t.Errorf("result differs from expected: %s", diff)
 			}
@@ -587,10 +1031,22 @@ func TestMergePostsubmits(t *testing.T) {
 				},
 			},
 		},
+		{
+			name:     "node selector from old is kept when new does not set one",
+			old:      &prowconfig.Postsubmit{JobBase: prowconfig.JobBase{Spec: &v1.PodSpec{NodeSelector: map[string]string{"pool": "old"}}}},
+			new:      &prowconfig.Postsubmit{JobBase: prowconfig.JobBase{Spec: &v1.PodSpec{ServiceAccountName: "new"}}},
+			expected: prowconfig.Postsubmit{JobBase: prowconfig.JobBase{Spec: &v1.PodSpec{ServiceAccountName: "new", NodeSelector: map[string]string{"pool": "old"}}}},
+		},
+		{
+			name:     "node selector from new takes precedence",
+			old:      &prowconfig.Postsubmit{JobBase: prowconfig.JobBase{Spec: &v1.PodSpec{NodeSelector: map[string]string{"pool": "old"}}}},
+			new:      &prowconfig.Postsubmit{JobBase: prowconfig.JobBase{Spec: &v1.PodSpec{NodeSelector: map[string]string{"pool": "new"}}}},
+			expected: prowconfig.Postsubmit{JobBase: prowconfig.JobBase{Spec: &v1.PodSpec{NodeSelector: map[string]string{"pool": "new"}}}},
+		},
 	}
 	for _, testCase := range testCases {
 		t.Run(testCase.name, func(t *testing.T) {
-			result := mergePostsubmits(testCase.old, testCase.new)
+			result := MergePostsubmits(testCase.old, testCase.new)
 			if diff := cmp.Diff(testCase.expected, result, unexportedFields...); diff != "" {
 				t.Errorf("%s: did not get expected merged postsubmit config: %s", testCase.name, diff)
 			}
@@ -598,6 +1054,41 @@ func TestMergePostsubmits(t *testing.T) {
 	}
 }
 
+func TestMergePeriodics(t *testing.T) {
+	var testCases = []struct {
+		name     string
+		old, new *prowconfig.Periodic
+		expected prowconfig.Periodic
+	}{
+		{
+			name:     "operator-set fields are kept from old",
+			old:      &prowconfig.Periodic{JobBase: prowconfig.JobBase{Name: "periodic", MaxConcurrency: 2, Cluster: "somewhere"}},
+			new:      &prowconfig.Periodic{JobBase: prowconfig.JobBase{Name: "periodic", Agent: "agent"}},
+			expected: prowconfig.Periodic{JobBase: prowconfig.JobBase{Name: "periodic", Agent: "agent", MaxConcurrency: 2, Cluster: "somewhere"}},
+		},
+		{
+			name:     "node selector from old is kept when new does not set one",
+			old:      &prowconfig.Periodic{JobBase: prowconfig.JobBase{Spec: &v1.PodSpec{NodeSelector: map[string]string{"pool": "old"}}}},
+			new:      &prowconfig.Periodic{JobBase: prowconfig.JobBase{Spec: &v1.PodSpec{ServiceAccountName: "new"}}},
+			expected: prowconfig.Periodic{JobBase: prowconfig.JobBase{Spec: &v1.PodSpec{ServiceAccountName: "new", NodeSelector: map[string]string{"pool": "old"}}}},
+		},
+		{
+			name:     "node selector from new takes precedence",
+			old:      &prowconfig.Periodic{JobBase: prowconfig.JobBase{Spec: &v1.PodSpec{NodeSelector: map[string]string{"pool": "old"}}}},
+			new:      &prowconfig.Periodic{JobBase: prowconfig.JobBase{Spec: &v1.PodSpec{NodeSelector: map[string]string{"pool": "new"}}}},
+			expected: prowconfig.Periodic{JobBase: prowconfig.JobBase{Spec: &v1.PodSpec{NodeSelector: map[string]string{"pool": "new"}}}},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			result := MergePeriodics(testCase.old, testCase.new)
+			if diff := cmp.Diff(testCase.expected, result, unexportedFields...); diff != "" {
+				t.Errorf("%s: did not get expected merged periodic config: %s", testCase.name, diff)
+			}
+		})
+	}
+}
+
 func TestExtractRepoElementsFromPath(t *testing.T) {
 	var testCases = []struct {
 		name          string
@@ -617,6 +1108,51 @@ func TestExtractRepoElementsFromPath(t *testing.T) {
 			},
 			expectedError: false,
 		},
+		{
+			name: "path with doubled slashes parses fine",
+			path: "jobs//org//repo/org-repo-master-presubmits.yaml",
+			expected: &Info{
+				Org:      "org",
+				Repo:     "repo",
+				Branch:   "master",
+				Type:     "presubmits",
+				Filename: "jobs//org//repo/org-repo-master-presubmits.yaml",
+			},
+		},
+		{
+			name: "path with a trailing slash parses fine",
+			path: "jobs/org/repo/org-repo-master-periodics.yaml/",
+			expected: &Info{
+				Org:      "org",
+				Repo:     "repo",
+				Branch:   "master",
+				Type:     "periodics",
+				Filename: "jobs/org/repo/org-repo-master-periodics.yaml/",
+			},
+		},
+		{
+			name: "path with dot segments parses fine",
+			path: "jobs/org/./repo/../repo/org-repo-master-postsubmits.yaml",
+			expected: &Info{
+				Org:      "org",
+				Repo:     "repo",
+				Branch:   "master",
+				Type:     "postsubmits",
+				Filename: "jobs/org/./repo/../repo/org-repo-master-postsubmits.yaml",
+			},
+		},
+		{
+			name: "path with the .yml extension parses fine",
+			path: "./org/repo/org-repo-branch-presubmits.yml",
+			expected: &Info{
+				Org:      "org",
+				Repo:     "repo",
+				Branch:   "branch",
+				Type:     "presubmits",
+				Filename: "./org/repo/org-repo-branch-presubmits.yml",
+			},
+			expectedError: false,
+		},
 		{
 			name: "simple periodic path parses fine",
 			path: "./org/repo/org-repo-branch-periodics.yaml",
@@ -629,6 +1165,48 @@ func TestExtractRepoElementsFromPath(t *testing.T) {
 			},
 			expectedError: false,
 		},
+		{
+			name: "branch named like a job type parses fine",
+			path: "./org/repo/org-repo-periodics-presubmits.yaml",
+			expected: &Info{
+				Org:      "org",
+				Repo:     "repo",
+				Branch:   "periodics",
+				Type:     "presubmits",
+				Filename: "./org/repo/org-repo-periodics-presubmits.yaml",
+			},
+		},
+		{
+			name: "branch containing a job type parses fine",
+			path: "./org/repo/org-repo-release-periodics-4.12-periodics.yaml",
+			expected: &Info{
+				Org:      "org",
+				Repo:     "repo",
+				Branch:   "release-periodics-4.12",
+				Type:     "periodics",
+				Filename: "./org/repo/org-repo-release-periodics-4.12-periodics.yaml",
+			},
+		},
+		{
+			name: "periodics without a branch parse fine",
+			path: "./org/repo/org-repo-periodics.yaml",
+			expected: &Info{
+				Org:      "org",
+				Repo:     "repo",
+				Type:     "periodics",
+				Filename: "./org/repo/org-repo-periodics.yaml",
+			},
+		},
+		{
+			name:          "presubmits without a branch fail to parse",
+			path:          "./org/repo/org-repo-presubmits.yaml",
+			expectedError: true,
+		},
+		{
+			name:          "unknown job type fails to parse",
+			path:          "./org/repo/org-repo-master-jobs.yaml",
+			expectedError: true,
+		},
 		{
 			name:          "empty path fails to parse",
 			path:          "",
@@ -670,18 +1248,75 @@ func TestExtractRepoElementsFromPath(t *testing.T) {
 	}
 }
 
-func TestInfo_Basename(t *testing.T) {
+func TestExtractInfoFromPathErrors(t *testing.T) {
 	testCases := []struct {
-		name     string
-		info     *Info
-		expected string
+		path     string
+		expected error
 	}{
-		{
-			name: "simple path creates simple basename",
-			info: &Info{
-				Org:    "org",
-				Repo:   "repo",
-				Branch: "branch",
+		{path: "org-repo-master-presubmits.yaml", expected: ErrNotConfigPath},
+		{path: "./repo/org-repo-master-presubmits.yaml", expected: ErrNotConfigPath},
+		{path: "org/repo/OWNERS.yaml", expected: ErrNotConfigPath},
+		{path: "org/repo/other-repo-notes.yaml", expected: ErrNotConfigPath},
+		{path: "org/repo/other-repo-master-presubmits.yaml", expected: ErrMisplacedFile},
+		{path: "org/repo/other-repo-periodics.yaml", expected: ErrMisplacedFile},
+		{path: "org/repo/org-repo-master-jobs.yaml", expected: ErrMalformedName},
+		{path: "org/repo/org-repo-master.yaml", expected: ErrMalformedName},
+		{path: "org/repo/org-repo-master-presubmit.yaml", expected: ErrMalformedName},
+		{path: "org/repo/org-repo-presubmits.yaml", expected: ErrMalformedName},
+		{path: "org/repo/org-repo-periodic.yaml", expected: ErrMalformedName},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.path, func(t *testing.T) {
+			_, err := extractInfoFromPath(tc.path)
+			if !errors.Is(err, tc.expected) {
+				t.Errorf("expected error to be %v, got %v", tc.expected, err)
+			}
+			for _, other := range []error{ErrNotConfigPath, ErrMalformedName, ErrMisplacedFile} {
+				if other != tc.expected && errors.Is(err, other) {
+					t.Errorf("expected error not to be %v, got %v", other, err)
+				}
+			}
+		})
+	}
+}
+
+func TestParseJobType(t *testing.T) {
+	testCases := []struct {
+		in          string
+		expected    JobType
+		expectedErr error
+	}{
+		{in: "presubmits", expected: Presubmits},
+		{in: "postsubmits", expected: Postsubmits},
+		{in: "periodics", expected: Periodics},
+		{in: "presubmit", expectedErr: errors.New(`unknown job type "presubmit", expected one of ["presubmits" "postsubmits" "periodics"]`)},
+		{in: "", expectedErr: errors.New(`unknown job type "", expected one of ["presubmits" "postsubmits" "periodics"]`)},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.in, func(t *testing.T) {
+			jobType, err := ParseJobType(tc.in)
+			if diff := cmp.Diff(tc.expectedErr, err, testhelper.EquateErrorMessage); diff != "" {
+				t.Errorf("error differs from expected:\n%s", diff)
+			}
+			if jobType != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, jobType)
+			}
+		})
+	}
+}
+
+func TestInfo_Basename(t *testing.T) {
+	testCases := []struct {
+		name     string
+		info     *Info
+		expected string
+	}{
+		{
+			name: "simple path creates simple basename",
+			info: &Info{
+				Org:    "org",
+				Repo:   "repo",
+				Branch: "branch",
 				Type:   "presubmits",
 			},
 			expected: "org-repo-branch-presubmits.yaml",
@@ -716,6 +1351,34 @@ func TestInfo_Basename(t *testing.T) {
 	}
 }
 
+func TestInfo_Paths(t *testing.T) {
+	dir := t.TempDir()
+	for _, info := range []*Info{
+		{Org: "org", Repo: "repo", Branch: "release-4.12", Type: "presubmits"},
+		{Org: "org", Repo: "repo", Type: "periodics"},
+		{Org: "org", Repo: "repo", Branch: "main", Type: "postsubmits", Separator: "_"},
+	} {
+		t.Run(info.Basename(), func(t *testing.T) {
+			expected := filepath.Join("org", "repo", info.Basename())
+			if diff := cmp.Diff(expected, info.RelativePath()); diff != "" {
+				t.Errorf("relative path differs from expected:\n%s", diff)
+			}
+			full := info.FullPath(dir)
+			if diff := cmp.Diff(filepath.Join(dir, expected), full); diff != "" {
+				t.Errorf("full path differs from expected:\n%s", diff)
+			}
+			parsed, err := extractInfoFromPathWithSeparator(full, info.separator())
+			if err != nil {
+				t.Fatalf("failed to parse full path: %v", err)
+			}
+			parsed.Filename = ""
+			if diff := cmp.Diff(info, parsed); diff != "" {
+				t.Errorf("full path is not parsed back into the info:\n%s", diff)
+			}
+		})
+	}
+}
+
 func TestInfo_ConfigMapName(t *testing.T) {
 	testCases := []struct {
 		name     string
@@ -838,6 +1501,10 @@ func TestInfo_ConfigMapName(t *testing.T) {
 			if diff := cmp.Diff(testCase.expected, info.ConfigMapName()); diff != "" {
 				t.Errorf("%s: didn't get correct basename: %v", testCase.name, diff)
 			}
+			uncorrelated := testCase.jobType == "periodics" && testCase.branch == ""
+			if diff := cmp.Diff(testCase.expected, ConfigMapNameForBranch(testCase.branch, testCase.jobType, uncorrelated)); diff != "" {
+				t.Errorf("%s: didn't get correct name for branch: %v", testCase.name, diff)
+			}
 		})
 	}
 }
@@ -870,6 +1537,42 @@ func TestPrune(t *testing.T) {
 			Generator:      "prowgen",
 			expectedConfig: &prowconfig.JobConfig{},
 		},
+		{
+			name: "stale generated presubmit exempt from pruning is kept",
+			jobconfig: &prowconfig.JobConfig{
+				PresubmitsStatic: map[string][]prowconfig.Presubmit{
+					"repo": {{JobBase: prowconfig.JobBase{Labels: map[string]string{LabelGenerator: "prowgen"}, Annotations: map[string]string{PruneExemptAnnotation: "true"}}}},
+				},
+			},
+			Generator: "prowgen",
+			expectedConfig: &prowconfig.JobConfig{
+				PresubmitsStatic: map[string][]prowconfig.Presubmit{
+					"repo": {{JobBase: prowconfig.JobBase{Labels: map[string]string{LabelGenerator: "prowgen"}, Annotations: map[string]string{PruneExemptAnnotation: "true"}}}},
+				},
+			},
+		},
+		{
+			name: "stale generated periodic with a non-true exemption is pruned",
+			jobconfig: &prowconfig.JobConfig{
+				Periodics: []prowconfig.Periodic{{JobBase: prowconfig.JobBase{Labels: map[string]string{LabelGenerator: "prowgen"}, Annotations: map[string]string{PruneExemptAnnotation: "false"}}}},
+			},
+			Generator:      "prowgen",
+			expectedConfig: &prowconfig.JobConfig{},
+		},
+		{
+			name: "newly generated postsubmit exempt from pruning is kept",
+			jobconfig: &prowconfig.JobConfig{
+				PostsubmitsStatic: map[string][]prowconfig.Postsubmit{
+					"repo": {{JobBase: prowconfig.JobBase{Labels: map[string]string{LabelGenerator: "prowgen", "prowgen": string(newlyGenerated)}, Annotations: map[string]string{PruneExemptAnnotation: "true"}}}},
+				},
+			},
+			Generator: "prowgen",
+			expectedConfig: &prowconfig.JobConfig{
+				PostsubmitsStatic: map[string][]prowconfig.Postsubmit{
+					"repo": {{JobBase: prowconfig.JobBase{Labels: map[string]string{LabelGenerator: "prowgen"}, Annotations: map[string]string{PruneExemptAnnotation: "true"}}}},
+				},
+			},
+		},
 		{
 			name: "not stale generated presubmit is kept",
 			jobconfig: &prowconfig.JobConfig{
@@ -995,6 +1698,206 @@ func TestPrune(t *testing.T) {
 	}
 }
 
+func TestPruneWithReport(t *testing.T) {
+	stale := map[string]string{LabelGenerator: "prowgen"}
+	fresh := map[string]string{LabelGenerator: "prowgen", "prowgen": string(newlyGenerated)}
+	jobConfig := &prowconfig.JobConfig{
+		PresubmitsStatic: map[string][]prowconfig.Presubmit{"org/repo": {
+			{JobBase: prowconfig.JobBase{Name: "stale-presubmit", Labels: stale}},
+			{JobBase: prowconfig.JobBase{Name: "fresh-presubmit", Labels: fresh}},
+		}},
+		PostsubmitsStatic: map[string][]prowconfig.Postsubmit{"org/repo": {
+			{JobBase: prowconfig.JobBase{Name: "stale-postsubmit", Labels: stale}},
+		}},
+		Periodics: []prowconfig.Periodic{
+			{JobBase: prowconfig.JobBase{Name: "handwritten"}},
+			{JobBase: prowconfig.JobBase{Name: "exempt", Labels: stale, Annotations: map[string]string{PruneExemptAnnotation: "true"}}},
+			{JobBase: prowconfig.JobBase{Name: "a-stale-periodic", Labels: stale}},
+		},
+	}
+	pruned, removed, err := PruneWithReport(jobConfig, "prowgen", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if diff := cmp.Diff([]string{"a-stale-periodic", "stale-postsubmit", "stale-presubmit"}, removed); diff != "" {
+		t.Errorf("removed jobs differ from expected:\n%s", diff)
+	}
+	var kept []string
+	for _, job := range pruned.AllStaticPresubmits(nil) {
+		kept = append(kept, job.Name)
+	}
+	for _, job := range pruned.Periodics {
+		kept = append(kept, job.Name)
+	}
+	if diff := cmp.Diff([]string{"fresh-presubmit", "handwritten", "exempt"}, kept); diff != "" {
+		t.Errorf("kept jobs differ from expected:\n%s", diff)
+	}
+	if len(pruned.PostsubmitsStatic) != 0 {
+		t.Errorf("expected no postsubmits to be kept, got %v", pruned.PostsubmitsStatic)
+	}
+}
+
+func TestPruneRepo(t *testing.T) {
+	stale := func() map[string]string { return map[string]string{LabelGenerator: "prowgen"} }
+	fresh := func() map[string]string {
+		return map[string]string{LabelGenerator: "prowgen", "prowgen": string(newlyGenerated)}
+	}
+	periodic := func(name, org, repo string, labels map[string]string) prowconfig.Periodic {
+		return prowconfig.Periodic{JobBase: prowconfig.JobBase{Name: name, Labels: labels, UtilityConfig: prowconfig.UtilityConfig{
+			ExtraRefs: []prowv1.Refs{{Org: org, Repo: repo, BaseRef: "master"}},
+		}}}
+	}
+	jobConfig := &prowconfig.JobConfig{
+		PresubmitsStatic: map[string][]prowconfig.Presubmit{
+			"org/repo": {
+				{JobBase: prowconfig.JobBase{Name: "stale", Labels: stale()}},
+				{JobBase: prowconfig.JobBase{Name: "fresh", Labels: fresh()}},
+			},
+			"org/other": {
+				{JobBase: prowconfig.JobBase{Name: "other-stale", Labels: stale()}},
+				{JobBase: prowconfig.JobBase{Name: "other-fresh", Labels: fresh()}},
+			},
+		},
+		PostsubmitsStatic: map[string][]prowconfig.Postsubmit{
+			"org/other": {{JobBase: prowconfig.JobBase{Name: "other-stale-postsubmit", Labels: stale()}}},
+		},
+		Periodics: []prowconfig.Periodic{
+			periodic("stale-periodic", "org", "repo", stale()),
+			periodic("other-stale-periodic", "org", "other", stale()),
+			{JobBase: prowconfig.JobBase{Name: "unrelated-stale-periodic", Labels: stale()}},
+		},
+	}
+
+	pruned, err := PruneRepo(jobConfig, "prowgen", nil, "org", "repo")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := &prowconfig.JobConfig{
+		PresubmitsStatic: map[string][]prowconfig.Presubmit{
+			"org/repo": {
+				{JobBase: prowconfig.JobBase{Name: "fresh", Labels: stale()}},
+			},
+			"org/other": {
+				{JobBase: prowconfig.JobBase{Name: "other-stale", Labels: stale()}},
+				{JobBase: prowconfig.JobBase{Name: "other-fresh", Labels: fresh()}},
+			},
+		},
+		PostsubmitsStatic: map[string][]prowconfig.Postsubmit{
+			"org/other": {{JobBase: prowconfig.JobBase{Name: "other-stale-postsubmit", Labels: stale()}}},
+		},
+		Periodics: []prowconfig.Periodic{
+			periodic("other-stale-periodic", "org", "other", stale()),
+			{JobBase: prowconfig.JobBase{Name: "unrelated-stale-periodic", Labels: stale()}},
+		},
+	}
+	if diff := cmp.Diff(expected, pruned, unexportedFields...); diff != "" {
+		t.Errorf("pruned job config differs from expected:\n%s", diff)
+	}
+}
+
+func TestPruneRemoveShadowed(t *testing.T) {
+	jobConfig := func() *prowconfig.JobConfig {
+		generated := func() map[string]string {
+			return map[string]string{LabelGenerator: "prowgen", "prowgen": string(newlyGenerated)}
+		}
+		return &prowconfig.JobConfig{
+			PresubmitsStatic: map[string][]prowconfig.Presubmit{
+				"org/repo": {
+					{JobBase: prowconfig.JobBase{Name: "job", Labels: generated()}},
+					{JobBase: prowconfig.JobBase{Name: "job"}},
+				},
+				"org/other": {{JobBase: prowconfig.JobBase{Name: "job"}}},
+			},
+			PostsubmitsStatic: map[string][]prowconfig.Postsubmit{
+				"org/repo": {{JobBase: prowconfig.JobBase{Name: "job"}}},
+			},
+			Periodics: []prowconfig.Periodic{
+				{JobBase: prowconfig.JobBase{Name: "periodic", Labels: generated()}},
+				{JobBase: prowconfig.JobBase{Name: "periodic"}},
+				{JobBase: prowconfig.JobBase{Name: "other"}},
+			},
+		}
+	}
+
+	for _, tc := range []struct {
+		name            string
+		opts            []PruneOption
+		expectedRemoved []string
+		expectedKept    int
+	}{
+		{
+			name:         "jobs colliding with generated ones are kept by default",
+			expectedKept: 7,
+		},
+		{
+			name:            "jobs colliding with generated ones are removed per repo for presubmits and globally for periodics",
+			opts:            []PruneOption{WithRemoveShadowed()},
+			expectedRemoved: []string{"job", "periodic"},
+			expectedKept:    5,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			pruned, removed, err := PruneWithReport(jobConfig(), "prowgen", nil, tc.opts...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(tc.expectedRemoved, removed); diff != "" {
+				t.Errorf("removed jobs differ from expected:\n%s", diff)
+			}
+			kept := len(pruned.Periodics)
+			for _, jobs := range pruned.PresubmitsStatic {
+				kept += len(jobs)
+			}
+			for _, jobs := range pruned.PostsubmitsStatic {
+				kept += len(jobs)
+			}
+			if kept != tc.expectedKept {
+				t.Errorf("expected %d jobs to be kept, got %d", tc.expectedKept, kept)
+			}
+			for _, job := range pruned.PresubmitsStatic["org/repo"] {
+				if tc.opts != nil && job.Labels[LabelGenerator] != "prowgen" {
+					t.Errorf("expected only the generated presubmit to be kept for org/repo, got %v", job)
+				}
+			}
+		})
+	}
+}
+
+func TestResetGeneratedMarkers(t *testing.T) {
+	jobConfig := &prowconfig.JobConfig{
+		PresubmitsStatic: map[string][]prowconfig.Presubmit{"org/repo": {
+			{JobBase: prowconfig.JobBase{Name: "newly-generated", Labels: map[string]string{LabelGenerator: "prowgen", "prowgen": string(newlyGenerated)}}},
+			{JobBase: prowconfig.JobBase{Name: "generated", Labels: map[string]string{LabelGenerator: "prowgen"}}},
+		}},
+		PostsubmitsStatic: map[string][]prowconfig.Postsubmit{"org/repo": {
+			{JobBase: prowconfig.JobBase{Name: "handwritten"}},
+		}},
+		Periodics: []prowconfig.Periodic{
+			{JobBase: prowconfig.JobBase{Name: "newly-generated", Labels: map[string]string{LabelGenerator: "cluster-init", "cluster-init": string(newlyGenerated), LabelBuildFarm: "build01"}}},
+			{JobBase: prowconfig.JobBase{Name: "stale", Labels: map[string]string{LabelGenerator: "prowgen"}}},
+		},
+	}
+	if reset := ResetGeneratedMarkers(jobConfig); reset != 2 {
+		t.Errorf("expected 2 jobs to be reset, got %d", reset)
+	}
+	expected := &prowconfig.JobConfig{
+		PresubmitsStatic: map[string][]prowconfig.Presubmit{"org/repo": {
+			{JobBase: prowconfig.JobBase{Name: "newly-generated", Labels: map[string]string{LabelGenerator: "prowgen"}}},
+			{JobBase: prowconfig.JobBase{Name: "generated", Labels: map[string]string{LabelGenerator: "prowgen"}}},
+		}},
+		PostsubmitsStatic: map[string][]prowconfig.Postsubmit{"org/repo": {
+			{JobBase: prowconfig.JobBase{Name: "handwritten"}},
+		}},
+		Periodics: []prowconfig.Periodic{
+			{JobBase: prowconfig.JobBase{Name: "newly-generated", Labels: map[string]string{LabelGenerator: "cluster-init", LabelBuildFarm: "build01"}}},
+			{JobBase: prowconfig.JobBase{Name: "stale", Labels: map[string]string{LabelGenerator: "prowgen"}}},
+		},
+	}
+	if diff := cmp.Diff(expected, jobConfig, unexportedFields...); diff != "" {
+		t.Errorf("job config differs from expected:\n%s", diff)
+	}
+}
+
 func TestIsGenerated(t *testing.T) {
 	testCases := []struct {
 		description string
@@ -1094,3 +1997,2142 @@ func TestStaleSelectorFor(t *testing.T) {
 		})
 	}
 }
+
+// writeJobConfigs writes a tree of job configuration files, keyed by their path
+// relative to dir.
+func writeJobConfigs(t *testing.T, dir string, files map[string]*prowconfig.JobConfig) {
+	t.Helper()
+	for path, jobConfig := range files {
+		path = filepath.Join(dir, path)
+		if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+			t.Fatalf("failed to create directory for %s: %v", path, err)
+		}
+		if err := WriteToFile(path, jobConfig); err != nil {
+			t.Fatalf("failed to write %s: %v", path, err)
+		}
+	}
+}
+
+// readJobConfigs reads all job configuration files in dir, keyed by their path
+// relative to dir.
+func readJobConfigs(t *testing.T, dir string) map[string]*prowconfig.JobConfig {
+	t.Helper()
+	files := map[string]*prowconfig.JobConfig{}
+	if err := OperateOnJobConfigSubdirPaths(dir, "", func(info *Info) error {
+		jobConfig, err := ReadJobConfigFromFile(info.Filename)
+		if err != nil {
+			return err
+		}
+		path, err := filepath.Rel(dir, info.Filename)
+		if err != nil {
+			return err
+		}
+		files[path] = jobConfig
+		return nil
+	}); err != nil {
+		t.Fatalf("failed to read job configs from %s: %v", dir, err)
+	}
+	return files
+}
+
+func TestMergeDirs(t *testing.T) {
+	dest := t.TempDir()
+	src := t.TempDir()
+	writeJobConfigs(t, dest, map[string]*prowconfig.JobConfig{
+		"org/shared/org-shared-master-presubmits.yaml": {
+			PresubmitsStatic: map[string][]prowconfig.Presubmit{"org/shared": {
+				{JobBase: prowconfig.JobBase{Name: "dest-only", Cluster: "build01"}, Reporter: prowconfig.Reporter{Context: "ci/prow/dest-only"}},
+				{JobBase: prowconfig.JobBase{Name: "both", Cluster: "build01"}, Reporter: prowconfig.Reporter{Context: "ci/prow/old"}},
+			}},
+		},
+		"org/dest/org-dest-master-postsubmits.yaml": {
+			PostsubmitsStatic: map[string][]prowconfig.Postsubmit{"org/dest": {
+				{JobBase: prowconfig.JobBase{Name: "untouched"}},
+			}},
+		},
+	})
+	writeJobConfigs(t, src, map[string]*prowconfig.JobConfig{
+		"org/shared/org-shared-master-presubmits.yaml": {
+			PresubmitsStatic: map[string][]prowconfig.Presubmit{"org/shared": {
+				{JobBase: prowconfig.JobBase{Name: "both"}, Reporter: prowconfig.Reporter{Context: "ci/prow/new"}},
+				{JobBase: prowconfig.JobBase{Name: "src-only"}, Reporter: prowconfig.Reporter{Context: "ci/prow/src-only"}},
+			}},
+		},
+		"other/src/other-src-periodics.yaml": {
+			Periodics: []prowconfig.Periodic{{JobBase: prowconfig.JobBase{Name: "periodic"}, Interval: "24h"}},
+		},
+	})
+
+	if err := MergeDirs(dest, src); err != nil {
+		t.Fatalf("failed to merge directories: %v", err)
+	}
+
+	expected := map[string]*prowconfig.JobConfig{
+		"org/shared/org-shared-master-presubmits.yaml": {
+			PresubmitsStatic: map[string][]prowconfig.Presubmit{"org/shared": {
+				{JobBase: prowconfig.JobBase{Name: "both", Cluster: "build01"}, Reporter: prowconfig.Reporter{Context: "ci/prow/new"}},
+				{JobBase: prowconfig.JobBase{Name: "dest-only", Cluster: "build01"}, Reporter: prowconfig.Reporter{Context: "ci/prow/dest-only"}},
+				{JobBase: prowconfig.JobBase{Name: "src-only"}, Reporter: prowconfig.Reporter{Context: "ci/prow/src-only"}},
+			}},
+		},
+		"org/dest/org-dest-master-postsubmits.yaml": {
+			PostsubmitsStatic: map[string][]prowconfig.Postsubmit{"org/dest": {
+				{JobBase: prowconfig.JobBase{Name: "untouched"}},
+			}},
+		},
+		"other/src/other-src-periodics.yaml": {
+			Periodics: []prowconfig.Periodic{{JobBase: prowconfig.JobBase{Name: "periodic"}, Interval: "24h"}},
+		},
+	}
+	if diff := cmp.Diff(expected, readJobConfigs(t, dest), unexportedFields...); diff != "" {
+		t.Errorf("merged directory differs from expected:\n%s", diff)
+	}
+}
+
+func TestCheckTreeUpToDate(t *testing.T) {
+	dir := t.TempDir()
+	writeJobConfigs(t, dir, map[string]*prowconfig.JobConfig{
+		"org/repo/org-repo-master-presubmits.yaml": {
+			PresubmitsStatic: map[string][]prowconfig.Presubmit{"org/repo": {
+				{JobBase: prowconfig.JobBase{Name: "a", Agent: "kubernetes"}, Reporter: prowconfig.Reporter{Context: "ci/prow/a"}},
+				{JobBase: prowconfig.JobBase{Name: "b", Agent: "kubernetes"}, Reporter: prowconfig.Reporter{Context: "ci/prow/b"}},
+			}},
+		},
+		"org/repo/org-repo-master-postsubmits.yaml": {
+			PostsubmitsStatic: map[string][]prowconfig.Postsubmit{"org/repo": {{JobBase: prowconfig.JobBase{Name: "postsubmit", Agent: "kubernetes"}}}},
+		},
+		"org/other/org-other-master-periodics.yaml": {
+			Periodics: []prowconfig.Periodic{{JobBase: prowconfig.JobBase{Name: "periodic", Agent: "kubernetes"}, Interval: "24h"}},
+		},
+	})
+
+	changed, err := CheckTreeUpToDate(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(changed) != 0 {
+		t.Errorf("expected a freshly written tree to be up to date, got changes in: %v", changed)
+	}
+
+	unsorted := &prowconfig.JobConfig{
+		PresubmitsStatic: map[string][]prowconfig.Presubmit{"org/repo": {
+			{JobBase: prowconfig.JobBase{Name: "b", Agent: "kubernetes"}, Reporter: prowconfig.Reporter{Context: "ci/prow/b"}},
+			{JobBase: prowconfig.JobBase{Name: "a", Agent: "kubernetes"}, Reporter: prowconfig.Reporter{Context: "ci/prow/a"}},
+		}},
+	}
+	// WriteToFile sorts jobs, so the unsorted file is written on its own
+	if data, err := yaml.Marshal(unsorted); err != nil {
+		t.Fatalf("failed to marshal: %v", err)
+	} else if err := os.WriteFile(filepath.Join(dir, "org/repo/org-repo-master-presubmits.yaml"), data, 0644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	handWritten := "periodics:\n- name: periodic\n  agent: kubernetes\n  interval: 24h\n"
+	if err := os.WriteFile(filepath.Join(dir, "org/other/org-other-master-periodics.yaml"), []byte(handWritten), 0644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "org/other/org-other-release-4.1-periodics.yaml"), []byte("periodics: []\n"), 0644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+
+	changed, err = CheckTreeUpToDate(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []string{
+		"org/other/org-other-master-periodics.yaml",
+		"org/other/org-other-release-4.1-periodics.yaml",
+		"org/repo/org-repo-master-presubmits.yaml",
+	}
+	if diff := cmp.Diff(expected, changed); diff != "" {
+		t.Errorf("changed files differ from expected:\n%s", diff)
+	}
+
+	malformed := filepath.Join(dir, "org/repo/org-repo-release-4.1-presubmits.yaml")
+	if err := os.WriteFile(malformed, []byte("presubmits: [\n"), 0644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	changed, err = CheckTreeUpToDate(dir)
+	if err == nil {
+		t.Fatalf("expected an error for the malformed file, got changes in: %v", changed)
+	}
+	if !strings.Contains(err.Error(), malformed) {
+		t.Errorf("expected the error to name %s, got: %v", malformed, err)
+	}
+}
+
+func TestVerifyDirMatches(t *testing.T) {
+	generated := func() *prowconfig.JobConfig {
+		return &prowconfig.JobConfig{
+			PresubmitsStatic: map[string][]prowconfig.Presubmit{"org/repo": {
+				{JobBase: prowconfig.JobBase{Name: "presubmit", Agent: "kubernetes", Labels: map[string]string{}}, Brancher: prowconfig.Brancher{Branches: []string{"^master$"}}, Reporter: prowconfig.Reporter{Context: "ci/prow/presubmit"}},
+			}},
+			Periodics: []prowconfig.Periodic{
+				{JobBase: prowconfig.JobBase{Name: "periodic", Agent: "kubernetes", Labels: map[string]string{}, UtilityConfig: prowconfig.UtilityConfig{
+					ExtraRefs: []prowv1.Refs{{Org: "org", Repo: "other", BaseRef: "master"}},
+				}}, Interval: "24h"},
+			},
+		}
+	}
+	dir := t.TempDir()
+	writeJobConfigs(t, dir, map[string]*prowconfig.JobConfig{
+		"unrelated/repo/unrelated-repo-master-presubmits.yaml": {
+			PresubmitsStatic: map[string][]prowconfig.Presubmit{"unrelated/repo": {{JobBase: prowconfig.JobBase{Name: "unrelated"}}}},
+		},
+	})
+
+	mismatched, err := VerifyDirMatches(dir, generated(), "prowgen", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []string{"org/other/org-other-master-periodics.yaml", "org/repo/org-repo-master-presubmits.yaml"}
+	if diff := cmp.Diff(expected, mismatched); diff != "" {
+		t.Errorf("mismatched files before writing differ from expected:\n%s", diff)
+	}
+
+	for _, orgRepo := range [][]string{{"org", "repo"}, {"org", "other"}} {
+		if err := WriteToDir(dir, orgRepo[0], orgRepo[1], generated(), "prowgen", nil); err != nil {
+			t.Fatalf("failed to write: %v", err)
+		}
+	}
+	mismatched, err = VerifyDirMatches(dir, generated(), "prowgen", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(mismatched) != 0 {
+		t.Errorf("expected the directory to be in sync after writing, got mismatches in: %v", mismatched)
+	}
+
+	updated := generated()
+	updated.PresubmitsStatic["org/repo"][0].Agent = "tekton-pipeline"
+	stale := filepath.Join(dir, "org/repo/org-repo-release-4.1-presubmits.yaml")
+	writeJobConfigs(t, dir, map[string]*prowconfig.JobConfig{
+		"org/repo/org-repo-release-4.1-presubmits.yaml": {
+			PresubmitsStatic: map[string][]prowconfig.Presubmit{"org/repo": {{JobBase: prowconfig.JobBase{Name: "stale", Labels: map[string]string{LabelGenerator: "prowgen"}}}}},
+		},
+	})
+	before, err := os.ReadFile(stale)
+	if err != nil {
+		t.Fatalf("failed to read file: %v", err)
+	}
+	mismatched, err = VerifyDirMatches(dir, updated, "prowgen", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected = []string{"org/repo/org-repo-master-presubmits.yaml", "org/repo/org-repo-release-4.1-presubmits.yaml"}
+	if diff := cmp.Diff(expected, mismatched); diff != "" {
+		t.Errorf("mismatched files differ from expected:\n%s", diff)
+	}
+	if after, err := os.ReadFile(stale); err != nil {
+		t.Fatalf("failed to read file: %v", err)
+	} else if diff := cmp.Diff(string(before), string(after)); diff != "" {
+		t.Errorf("verification modified the directory:\n%s", diff)
+	}
+}
+
+func TestReadFromDirReadTimeout(t *testing.T) {
+	dir := t.TempDir()
+	writeJobConfigs(t, dir, map[string]*prowconfig.JobConfig{
+		"org/repo/org-repo-master-presubmits.yaml": {
+			PresubmitsStatic: map[string][]prowconfig.Presubmit{"org/repo": {{JobBase: prowconfig.JobBase{Name: "fast"}}}},
+		},
+		"org/repo/org-repo-master-postsubmits.yaml": {
+			PostsubmitsStatic: map[string][]prowconfig.Postsubmit{"org/repo": {{JobBase: prowconfig.JobBase{Name: "hung"}}}},
+		},
+	})
+	release := make(chan struct{})
+	defer close(release)
+	hangingRead := func(o *WalkOptions) {
+		o.readFile = func(path string) ([]byte, error) {
+			if strings.HasSuffix(path, "postsubmits.yaml") {
+				<-release
+			}
+			return os.ReadFile(path)
+		}
+	}
+
+	jobConfig, err := ReadFromDir(dir, WithReadTimeout(10*time.Millisecond), hangingRead)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := &prowconfig.JobConfig{
+		PresubmitsStatic:  map[string][]prowconfig.Presubmit{"org/repo": {{JobBase: prowconfig.JobBase{Name: "fast"}}}},
+		PostsubmitsStatic: map[string][]prowconfig.Postsubmit{},
+		Periodics:         []prowconfig.Periodic{},
+	}
+	if diff := cmp.Diff(expected, jobConfig, unexportedFields...); diff != "" {
+		t.Errorf("read job config differs from expected:\n%s", diff)
+	}
+}
+
+func TestOperateOnJobConfigSubdirWithContext(t *testing.T) {
+	dir := t.TempDir()
+	writeJobConfigs(t, dir, map[string]*prowconfig.JobConfig{
+		"org/repo/org-repo-master-presubmits.yaml": {
+			PresubmitsStatic: map[string][]prowconfig.Presubmit{"org/repo": {{JobBase: prowconfig.JobBase{Name: "hung"}}}},
+		},
+		"org/repo/org-repo-master-postsubmits.yaml": {
+			PostsubmitsStatic: map[string][]prowconfig.Postsubmit{"org/repo": {{JobBase: prowconfig.JobBase{Name: "hung"}}}},
+		},
+	})
+	release := make(chan struct{})
+	defer close(release)
+	hangingRead := func(o *WalkOptions) {
+		o.readFile = func(path string) ([]byte, error) {
+			<-release
+			return os.ReadFile(path)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	called := false
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- OperateOnJobConfigSubdirWithContext(ctx, dir, "", func(*prowconfig.JobConfig, *Info) error {
+			called = true
+			return nil
+		}, hangingRead)
+	}()
+	select {
+	case err := <-errCh:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expected the walk to be interrupted by the deadline, got: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("walk was not interrupted while reads hung")
+	}
+	if called {
+		t.Error("expected the callback not to be called for files that were not read")
+	}
+}
+
+func TestForEachJob(t *testing.T) {
+	dir := t.TempDir()
+	writeJobConfigs(t, dir, map[string]*prowconfig.JobConfig{
+		"org/repo/org-repo-master-presubmits.yaml": {
+			PresubmitsStatic: map[string][]prowconfig.Presubmit{"org/repo": {{JobBase: prowconfig.JobBase{Name: "a"}}, {JobBase: prowconfig.JobBase{Name: "b"}}}},
+		},
+		"org/repo/org-repo-master-postsubmits.yaml": {
+			PostsubmitsStatic: map[string][]prowconfig.Postsubmit{"org/repo": {{JobBase: prowconfig.JobBase{Name: "c"}}}},
+		},
+		"org/other/org-other-master-periodics.yaml": {
+			Periodics: []prowconfig.Periodic{{JobBase: prowconfig.JobBase{Name: "d"}}},
+		},
+	})
+
+	var visited []string
+	err := ForEachJob(dir, func(info *Info, job prowconfig.JobBase) error {
+		visited = append(visited, fmt.Sprintf("%s/%s:%s", info.Repo, info.Type, job.Name))
+		if job.Name == "b" {
+			return errors.New("failed on b")
+		}
+		return nil
+	})
+	if diff := cmp.Diff(errors.New("failed on b"), err, testhelper.EquateErrorMessage); diff != "" {
+		t.Errorf("error differs from expected:\n%s", diff)
+	}
+	sort.Strings(visited)
+	if diff := cmp.Diff([]string{"other/periodics:d", "repo/postsubmits:c", "repo/presubmits:a", "repo/presubmits:b"}, visited); diff != "" {
+		t.Errorf("visited jobs differ from expected:\n%s", diff)
+	}
+
+	var count int
+	if err := ForEachJob(dir, func(*Info, prowconfig.JobBase) error {
+		count++
+		return ErrStopWalk
+	}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if count != 1 {
+		t.Errorf("expected the walk to stop after the first job, visited %d", count)
+	}
+}
+
+func TestLocateJob(t *testing.T) {
+	dir := t.TempDir()
+	writeJobConfigs(t, dir, map[string]*prowconfig.JobConfig{
+		"org/repo/org-repo-master-presubmits.yaml": {
+			PresubmitsStatic: map[string][]prowconfig.Presubmit{"org/repo": {
+				{JobBase: prowconfig.JobBase{Name: "presubmit"}, Brancher: prowconfig.Brancher{Branches: []string{"master"}}},
+				{JobBase: prowconfig.JobBase{Name: "presubmit"}, Brancher: prowconfig.Brancher{Branches: []string{"main"}}},
+			}},
+		},
+		"org/repo/org-repo-master-periodics.yaml": {
+			Periodics: []prowconfig.Periodic{{JobBase: prowconfig.JobBase{Name: "duplicated"}}},
+		},
+		"org/other/org-other-master-periodics.yaml": {
+			Periodics: []prowconfig.Periodic{{JobBase: prowconfig.JobBase{Name: "duplicated"}}, {JobBase: prowconfig.JobBase{Name: "periodic"}}},
+		},
+	})
+
+	testCases := []struct {
+		name          string
+		job           string
+		expected      *Info
+		expectedError error
+	}{
+		{
+			name:     "job configured in one file",
+			job:      "periodic",
+			expected: &Info{Org: "org", Repo: "other", Branch: "master", Type: "periodics", Filename: filepath.Join(dir, "org/other/org-other-master-periodics.yaml")},
+		},
+		{
+			name:     "job configured for several branches in one file",
+			job:      "presubmit",
+			expected: &Info{Org: "org", Repo: "repo", Branch: "master", Type: "presubmits", Filename: filepath.Join(dir, "org/repo/org-repo-master-presubmits.yaml")},
+		},
+		{
+			name:          "job configured nowhere",
+			job:           "missing",
+			expectedError: fmt.Errorf("no job named missing is configured in %s", dir),
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			info, err := LocateJob(dir, tc.job)
+			if diff := cmp.Diff(tc.expectedError, err, testhelper.EquateErrorMessage); diff != "" {
+				t.Errorf("error differs from expected:\n%s", diff)
+			}
+			if diff := cmp.Diff(tc.expected, info); diff != "" {
+				t.Errorf("info differs from expected:\n%s", diff)
+			}
+		})
+	}
+
+	if _, err := LocateJob(dir, "duplicated"); err == nil || !strings.Contains(err.Error(), "is configured in more than one file") {
+		t.Errorf("expected an error for a job configured in several files, got %v", err)
+	}
+}
+
+func TestOperateOnJobConfigDirStopWalk(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]*prowconfig.JobConfig{}
+	for i := 0; i < 50; i++ {
+		files[fmt.Sprintf("org/repo/org-repo-branch%d-periodics.yaml", i)] = &prowconfig.JobConfig{
+			Periodics: []prowconfig.Periodic{{JobBase: prowconfig.JobBase{Name: fmt.Sprintf("periodic-%d", i)}}},
+		}
+	}
+	writeJobConfigs(t, dir, files)
+
+	for _, workers := range []int{1, 4} {
+		t.Run(fmt.Sprintf("%d workers", workers), func(t *testing.T) {
+			var calls int
+			err := OperateOnJobConfigDir(dir, func(*prowconfig.JobConfig, *Info) error {
+				calls++
+				return ErrStopWalk
+			}, WithWorkers(workers))
+			if err != nil {
+				t.Errorf("expected stopping the walk not to be an error, got: %v", err)
+			}
+			if calls != 1 {
+				t.Errorf("expected the callback to be called once, got %d calls", calls)
+			}
+		})
+	}
+
+	t.Run("paths", func(t *testing.T) {
+		var calls int
+		err := OperateOnJobConfigSubdirPaths(dir, "", func(*Info) error {
+			calls++
+			return ErrStopWalk
+		})
+		if err != nil {
+			t.Errorf("expected stopping the walk not to be an error, got: %v", err)
+		}
+		if calls != 1 {
+			t.Errorf("expected the callback to be called once, got %d calls", calls)
+		}
+	})
+}
+
+func TestOperateOnJobConfigSubdirWithConcurrency(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]*prowconfig.JobConfig{}
+	for i := 0; i < 12; i++ {
+		files[fmt.Sprintf("org/repo/org-repo-branch%d-periodics.yaml", i)] = &prowconfig.JobConfig{
+			Periodics: []prowconfig.Periodic{{JobBase: prowconfig.JobBase{Name: fmt.Sprintf("periodic-%d", i)}}},
+		}
+	}
+	writeJobConfigs(t, dir, files)
+
+	const workers = 3
+	var lock sync.Mutex
+	var current, max int
+	countingRead := func(o *WalkOptions) {
+		o.readFile = func(path string) ([]byte, error) {
+			lock.Lock()
+			current++
+			if current > max {
+				max = current
+			}
+			lock.Unlock()
+			time.Sleep(5 * time.Millisecond)
+			lock.Lock()
+			current--
+			lock.Unlock()
+			return os.ReadFile(path)
+		}
+	}
+	var read int
+	if err := OperateOnJobConfigSubdirWithConcurrency(dir, "", workers, func(*prowconfig.JobConfig, *Info) error {
+		read++
+		return nil
+	}, countingRead); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if read != len(files) {
+		t.Errorf("expected %d files to be read, got %d", len(files), read)
+	}
+	if max > workers {
+		t.Errorf("expected at most %d concurrent reads, got %d", workers, max)
+	}
+}
+
+func TestReadFromDirWithStats(t *testing.T) {
+	dir := t.TempDir()
+	writeJobConfigs(t, dir, map[string]*prowconfig.JobConfig{
+		"org/repo/org-repo-master-presubmits.yaml": {
+			PresubmitsStatic: map[string][]prowconfig.Presubmit{"org/repo": {{JobBase: prowconfig.JobBase{Name: "presubmit"}}}},
+		},
+		"org/repo/org-repo-master-periodics.yaml": {
+			Periodics: []prowconfig.Periodic{{JobBase: prowconfig.JobBase{Name: "periodic"}}},
+		},
+	})
+	for path, content := range map[string]string{
+		// misnamed: the org-repo prefix has a typo
+		"org/repo/org-rpeo-master-postsubmits.yaml":     "postsubmits: {}\n",
+		"org/repo/org-repo-release-4.1-presubmits.yaml": "presubmits: [\n",
+		"org/repo/README.md":                            "not job configuration\n",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, path), []byte(content), 0644); err != nil {
+			t.Fatalf("failed to write %s: %v", path, err)
+		}
+	}
+
+	jobConfig, stats, err := ReadFromDirWithStats(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if diff := cmp.Diff(ReadStats{Visited: 4, Parsed: 2, Skipped: 2}, stats); diff != "" {
+		t.Errorf("stats differ from expected:\n%s", diff)
+	}
+	if len(jobConfig.PresubmitsStatic["org/repo"]) != 1 || len(jobConfig.Periodics) != 1 {
+		t.Errorf("expected the valid files to be read, got %v", jobConfig)
+	}
+}
+
+func TestReadFromDirHiddenFiles(t *testing.T) {
+	dir := t.TempDir()
+	writeJobConfigs(t, dir, map[string]*prowconfig.JobConfig{
+		"org/repo/org-repo-master-presubmits.yaml": {
+			PresubmitsStatic: map[string][]prowconfig.Presubmit{"org/repo": {{JobBase: prowconfig.JobBase{Name: "presubmit"}}}},
+		},
+		".hidden/repo/.hidden-repo-master-presubmits.yaml": {
+			PresubmitsStatic: map[string][]prowconfig.Presubmit{".hidden/repo": {{JobBase: prowconfig.JobBase{Name: "hidden"}}}},
+		},
+	})
+	// an editor lock file
+	if err := os.WriteFile(filepath.Join(dir, "org/repo/.#foo.yaml"), []byte("presubmits: [\n"), 0644); err != nil {
+		t.Fatalf("failed to write lock file: %v", err)
+	}
+
+	testCases := []struct {
+		name          string
+		opts          []WalkOption
+		expectedStats ReadStats
+		expectedRepos []string
+	}{
+		{
+			name:          "hidden files and directories are skipped by default",
+			expectedStats: ReadStats{Visited: 1, Parsed: 1},
+			expectedRepos: []string{"org/repo"},
+		},
+		{
+			name:          "hidden files and directories are read when asked to",
+			opts:          []WalkOption{WithHiddenFiles()},
+			expectedStats: ReadStats{Visited: 3, Parsed: 2, Skipped: 1},
+			expectedRepos: []string{".hidden/repo", "org/repo"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			jobConfig, stats, err := ReadFromDirWithStats(dir, tc.opts...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(tc.expectedStats, stats); diff != "" {
+				t.Errorf("stats differ from expected:\n%s", diff)
+			}
+			if diff := cmp.Diff(tc.expectedRepos, sets.StringKeySet(jobConfig.PresubmitsStatic).List()); diff != "" {
+				t.Errorf("repos differ from expected:\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestReadFromDirFileReadHook(t *testing.T) {
+	dir := t.TempDir()
+	writeJobConfigs(t, dir, map[string]*prowconfig.JobConfig{
+		"org/repo/org-repo-master-presubmits.yaml": {
+			PresubmitsStatic: map[string][]prowconfig.Presubmit{"org/repo": {{JobBase: prowconfig.JobBase{Name: "presubmit"}}}},
+		},
+		"org/repo/org-repo-master-postsubmits.yaml": {
+			PostsubmitsStatic: map[string][]prowconfig.Postsubmit{"org/repo": {{JobBase: prowconfig.JobBase{Name: "postsubmit"}}}},
+		},
+		"org/other/org-other-master-periodics.yaml": {
+			Periodics: []prowconfig.Periodic{{JobBase: prowconfig.JobBase{Name: "periodic"}}},
+		},
+	})
+	var lock sync.Mutex
+	calls := map[string]int{}
+	hook := func(info *Info, d time.Duration) {
+		lock.Lock()
+		defer lock.Unlock()
+		rel, err := filepath.Rel(dir, info.Filename)
+		if err != nil {
+			t.Errorf("unexpected file outside of %s: %s", dir, info.Filename)
+			return
+		}
+		calls[rel]++
+	}
+	if _, err := ReadFromDir(dir, WithFileReadHook(hook)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := map[string]int{
+		"org/repo/org-repo-master-presubmits.yaml":  1,
+		"org/repo/org-repo-master-postsubmits.yaml": 1,
+		"org/other/org-other-master-periodics.yaml": 1,
+	}
+	if diff := cmp.Diff(expected, calls); diff != "" {
+		t.Errorf("hook calls differ from expected:\n%s", diff)
+	}
+}
+
+func TestOperateOnJobConfigDirProgress(t *testing.T) {
+	dir := t.TempDir()
+	jobConfigs := map[string]*prowconfig.JobConfig{}
+	for i := 0; i < 20; i++ {
+		jobConfigs[fmt.Sprintf("org/repo%d/org-repo%d-master-presubmits.yaml", i, i)] = &prowconfig.JobConfig{
+			PresubmitsStatic: map[string][]prowconfig.Presubmit{fmt.Sprintf("org/repo%d", i): {{JobBase: prowconfig.JobBase{Name: "presubmit"}}}},
+		}
+	}
+	writeJobConfigs(t, dir, jobConfigs)
+	if err := os.WriteFile(filepath.Join(dir, "org", "repo0", "OWNERS"), []byte("approvers: []\n"), 0644); err != nil {
+		t.Fatalf("failed to write OWNERS: %v", err)
+	}
+
+	// calls are made from a single goroutine, so no locking is needed
+	var calls []WalkProgress
+	if err := OperateOnJobConfigDir(dir, func(*prowconfig.JobConfig, *Info) error {
+		time.Sleep(time.Millisecond)
+		return nil
+	}, WithProgress(time.Millisecond, func(progress WalkProgress) {
+		calls = append(calls, progress)
+	})); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(calls) == 0 {
+		t.Fatal("expected progress to be reported")
+	}
+	for i, call := range calls {
+		if call.Processed > call.Discovered {
+			t.Errorf("call %d: processed %d files out of %d discovered", i, call.Processed, call.Discovered)
+		}
+		if i > 0 && (call.Discovered < calls[i-1].Discovered || call.Processed < calls[i-1].Processed) {
+			t.Errorf("call %d: progress went backwards from %+v to %+v", i, calls[i-1], call)
+		}
+	}
+	if diff := cmp.Diff(WalkProgress{Discovered: 20, Processed: 20}, calls[len(calls)-1]); diff != "" {
+		t.Errorf("final progress differs from expected:\n%s", diff)
+	}
+}
+
+// writeManyJobConfigs writes n presubmit files for distinct repos into dir
+func writeManyJobConfigs(t testing.TB, dir string, n int) {
+	for i := 0; i < n; i++ {
+		path := filepath.Join(dir, "org", fmt.Sprintf("repo%d", i), fmt.Sprintf("org-repo%d-master-presubmits.yaml", i))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("failed to create directory: %v", err)
+		}
+		data := fmt.Sprintf("presubmits:\n  org/repo%d:\n  - name: presubmit\n", i)
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatalf("failed to write %s: %v", path, err)
+		}
+	}
+}
+
+func TestOperateOnJobConfigDirOutputBuffer(t *testing.T) {
+	dir := t.TempDir()
+	writeManyJobConfigs(t, dir, 10)
+	const buffer = 3
+	var read atomic.Int32
+	first := true
+	if err := OperateOnJobConfigDir(dir, func(*prowconfig.JobConfig, *Info) error {
+		if !first {
+			return nil
+		}
+		first = false
+		// with a single reader, one file is handed to this callback, the
+		// buffer fills up and one more file is read before the reader blocks
+		deadline := time.Now().Add(10 * time.Second)
+		for time.Now().Before(deadline) {
+			if read.Load() >= buffer+2 {
+				return nil
+			}
+			time.Sleep(time.Millisecond)
+		}
+		t.Errorf("expected %d files to be read while the callback was blocked, got %d", buffer+2, read.Load())
+		return nil
+	}, WithWorkers(1), WithOutputBuffer(buffer), WithFileReadHook(func(*Info, time.Duration) {
+		read.Add(1)
+	})); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n := read.Load(); n != 10 {
+		t.Errorf("expected all 10 files to be read, got %d", n)
+	}
+}
+
+func BenchmarkOperateOnJobConfigDirSlowCallback(b *testing.B) {
+	dir := b.TempDir()
+	writeManyJobConfigs(b, dir, 50)
+	// one file in five is slow to read, so without a buffer the callback
+	// waits on slow reads and the reader waits on the callback in turn
+	var reads atomic.Int64
+	unevenRead := func(path string) ([]byte, error) {
+		if reads.Add(1)%5 == 0 {
+			time.Sleep(5 * time.Millisecond)
+		}
+		return os.ReadFile(path)
+	}
+	for _, buffer := range []int{0, 8, 64} {
+		b.Run(fmt.Sprintf("buffer-%d", buffer), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if err := OperateOnJobConfigDir(dir, func(*prowconfig.JobConfig, *Info) error {
+					time.Sleep(time.Millisecond)
+					return nil
+				}, WithWorkers(1), WithOutputBuffer(buffer), func(o *WalkOptions) { o.readFile = unevenRead }); err != nil {
+					b.Fatalf("unexpected error: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestWriteToFileKeyOrder(t *testing.T) {
+	jobConfig := &prowconfig.JobConfig{
+		PresubmitsStatic:  map[string][]prowconfig.Presubmit{"org/repo": {{JobBase: prowconfig.JobBase{Name: "presubmit", Agent: "kubernetes"}, Reporter: prowconfig.Reporter{Context: "ci/prow/presubmit"}}}},
+		PostsubmitsStatic: map[string][]prowconfig.Postsubmit{"org/repo": {{JobBase: prowconfig.JobBase{Name: "postsubmit", Agent: "kubernetes"}}}},
+		Periodics:         []prowconfig.Periodic{{JobBase: prowconfig.JobBase{Name: "periodic", Agent: "kubernetes"}, Interval: "24h"}},
+	}
+	path := filepath.Join(t.TempDir(), "org-repo-master-jobs.yaml")
+	if err := WriteToFile(path, jobConfig, WithKeyOrder(ProwKeyOrder...)); err != nil {
+		t.Fatalf("failed to write job config: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read job config: %v", err)
+	}
+	testhelper.CompareWithFixture(t, data)
+
+	read, err := ReadJobConfigFromFile(path)
+	if err != nil {
+		t.Fatalf("failed to read back job config: %v", err)
+	}
+	if diff := cmp.Diff(jobConfig, read, unexportedFields...); diff != "" {
+		t.Errorf("job config did not round-trip:\n%s", diff)
+	}
+}
+
+func TestWriteToFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "org-repo-master-presubmits.yaml")
+	original := []byte("presubmits:\n  org/repo:\n  - name: original\n")
+	if err := os.WriteFile(path, original, 0664); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	jobConfig := &prowconfig.JobConfig{PresubmitsStatic: map[string][]prowconfig.Presubmit{"org/repo": {{JobBase: prowconfig.JobBase{Name: "updated"}}}}}
+
+	orig := writeTempFile
+	t.Cleanup(func() { writeTempFile = orig })
+	writeTempFile = func(f *os.File, data []byte) error {
+		if _, err := f.Write(data[:len(data)/2]); err != nil {
+			return err
+		}
+		return errors.New("killed")
+	}
+	err := WriteToFile(path, jobConfig)
+	writeTempFile = orig
+	if diff := cmp.Diff(errors.New("killed"), err, testhelper.EquateErrorMessage); diff != "" {
+		t.Errorf("error differs from expected:\n%s", diff)
+	}
+	assertContent := func(expected []byte) {
+		t.Helper()
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("failed to read file: %v", err)
+		}
+		if diff := cmp.Diff(string(expected), string(data)); diff != "" {
+			t.Errorf("file content differs from expected:\n%s", diff)
+		}
+		if entries, err := os.ReadDir(dir); err != nil {
+			t.Fatalf("failed to list directory: %v", err)
+		} else if len(entries) != 1 {
+			t.Errorf("expected no temporary files to be left behind, got %d entries", len(entries))
+		}
+	}
+	assertContent(original)
+
+	if err := WriteToFile(path, jobConfig); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	assertContent([]byte("presubmits:\n  org/repo:\n  - always_run: false\n    name: updated\n"))
+}
+
+func TestWriteToFilePermissions(t *testing.T) {
+	dir := t.TempDir()
+	jobConfig := &prowconfig.JobConfig{Periodics: []prowconfig.Periodic{{JobBase: prowconfig.JobBase{Name: "periodic"}}}}
+	existing := filepath.Join(dir, "org-repo-master-periodics.yaml")
+	if err := os.WriteFile(existing, []byte("periodics: []\n"), 0600); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	if err := os.Chmod(existing, 0640); err != nil {
+		t.Fatalf("failed to change mode: %v", err)
+	}
+	created := filepath.Join(dir, "org-other-master-periodics.yaml")
+	// new files are subject to the umask, like files written by os.WriteFile
+	reference := filepath.Join(t.TempDir(), "reference")
+	if err := os.WriteFile(reference, nil, 0664); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	info, err := os.Stat(reference)
+	if err != nil {
+		t.Fatalf("failed to stat file: %v", err)
+	}
+
+	for path, expected := range map[string]os.FileMode{existing: 0640, created: info.Mode().Perm()} {
+		if err := WriteToFile(path, jobConfig); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if info, err := os.Stat(path); err != nil {
+			t.Fatalf("failed to stat file: %v", err)
+		} else if info.Mode().Perm() != expected {
+			t.Errorf("%s: expected mode %v, got %v", filepath.Base(path), expected, info.Mode().Perm())
+		}
+	}
+}
+
+func TestWriteToFileSymlink(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "target.yaml")
+	if err := os.WriteFile(target, []byte("periodics: []\n"), 0644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	link := filepath.Join(dir, "org-repo-master-periodics.yaml")
+	if err := os.Symlink(target, link); err != nil {
+		t.Fatalf("failed to create symlink: %v", err)
+	}
+	jobConfig := &prowconfig.JobConfig{Periodics: []prowconfig.Periodic{{JobBase: prowconfig.JobBase{Name: "periodic"}}}}
+	if err := WriteToFile(link, jobConfig); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if info, err := os.Lstat(link); err != nil {
+		t.Fatalf("failed to stat link: %v", err)
+	} else if info.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("expected the symlink to be kept, got mode %v", info.Mode())
+	}
+	data, err := os.ReadFile(target)
+	if err != nil {
+		t.Fatalf("failed to read file: %v", err)
+	}
+	if diff := cmp.Diff("periodics:\n- name: periodic\n", string(data)); diff != "" {
+		t.Errorf("content of the link target differs from expected:\n%s", diff)
+	}
+}
+
+func TestSortPodSpecDuplicateNames(t *testing.T) {
+	env := []v1.EnvVar{
+		{Name: "NAMESPACE", ValueFrom: &v1.EnvVarSource{FieldRef: &v1.ObjectFieldSelector{FieldPath: "metadata.namespace"}}},
+		{Name: "NAMESPACE", Value: "ci"},
+		{Name: "NAMESPACE", ValueFrom: &v1.EnvVarSource{FieldRef: &v1.ObjectFieldSelector{FieldPath: "metadata.labels['namespace']"}}},
+		{Name: "ARTIFACTS", Value: "/logs/artifacts"},
+	}
+	mounts := []v1.VolumeMount{
+		{Name: "secrets", MountPath: "/secrets/b"},
+		{Name: "boskos", MountPath: "/etc/boskos"},
+		{Name: "secrets", MountPath: "/secrets/a", SubPath: "b"},
+		{Name: "secrets", MountPath: "/secrets/a", SubPath: "a"},
+	}
+	permute := func(i int) *v1.PodSpec {
+		container := v1.Container{Name: "test", Env: make([]v1.EnvVar, len(env)), VolumeMounts: make([]v1.VolumeMount, len(mounts))}
+		for j := range env {
+			container.Env[j] = env[(i+j)%len(env)]
+		}
+		for j := range mounts {
+			container.VolumeMounts[j] = mounts[(i+len(mounts)-j)%len(mounts)]
+		}
+		return &v1.PodSpec{Containers: []v1.Container{container}}
+	}
+
+	expected := permute(0)
+	sortPodSpec(expected)
+	for i := 1; i < 20; i++ {
+		spec := permute(i)
+		sortPodSpec(spec)
+		if diff := cmp.Diff(expected, spec); diff != "" {
+			t.Fatalf("sorting permutation %d differs:\n%s", i, diff)
+		}
+	}
+	var names []string
+	for _, mount := range expected.Containers[0].VolumeMounts {
+		names = append(names, mount.Name+":"+mount.MountPath+":"+mount.SubPath)
+	}
+	if diff := cmp.Diff([]string{"boskos:/etc/boskos:", "secrets:/secrets/a:a", "secrets:/secrets/a:b", "secrets:/secrets/b:"}, names); diff != "" {
+		t.Errorf("volume mounts differ from expected:\n%s", diff)
+	}
+}
+
+func TestSortPodSpecArgs(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		container v1.Container
+		expected  []string
+	}{
+		{
+			name:      "ci-operator args are sorted",
+			container: v1.Container{Command: []string{"ci-operator"}, Args: []string{"--target=unit", "--report-credentials-file=/etc/report", "--give-pr-author-access-to-namespace=true"}},
+			expected:  []string{"--give-pr-author-access-to-namespace=true", "--report-credentials-file=/etc/report", "--target=unit"},
+		},
+		{
+			name:      "args of ci-operator run by a wrapper command are sorted",
+			container: v1.Container{Command: []string{"/usr/bin/entrypoint", "/usr/bin/ci-operator"}, Args: []string{"--target=unit", "--lease-server=boskos"}},
+			expected:  []string{"--lease-server=boskos", "--target=unit"},
+		},
+		{
+			name:      "args following ci-operator passed to a wrapper are sorted",
+			container: v1.Container{Command: []string{"entrypoint"}, Args: []string{"--wrapper-flag=true", "ci-operator", "--target=unit", "--lease-server=boskos"}},
+			expected:  []string{"--wrapper-flag=true", "ci-operator", "--lease-server=boskos", "--target=unit"},
+		},
+		{
+			name:      "wrapped args with separate flag values are not sorted",
+			container: v1.Container{Command: []string{"entrypoint"}, Args: []string{"ci-operator", "--target", "unit", "--lease-server=boskos"}},
+			expected:  []string{"ci-operator", "--target", "unit", "--lease-server=boskos"},
+		},
+		{
+			name:      "args of other commands are not sorted",
+			container: v1.Container{Command: []string{"/bin/bash", "-c"}, Args: []string{"--b=1", "--a=2"}},
+			expected:  []string{"--b=1", "--a=2"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			spec := &v1.PodSpec{Containers: []v1.Container{tc.container}}
+			sortPodSpec(spec)
+			if diff := cmp.Diff(tc.expected, spec.Containers[0].Args); diff != "" {
+				t.Errorf("args differ from expected:\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestMarshalCanonical(t *testing.T) {
+	jobConfig := func(names ...string) *prowconfig.JobConfig {
+		jobConfig := &prowconfig.JobConfig{}
+		for _, name := range names {
+			jobConfig.Periodics = append(jobConfig.Periodics, prowconfig.Periodic{JobBase: prowconfig.JobBase{Name: name, Labels: map[string]string{}}})
+		}
+		return jobConfig
+	}
+	unsorted := jobConfig("b", "a")
+	first, err := MarshalCanonical(unsorted)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	second, err := MarshalCanonical(jobConfig("a", "b"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if diff := cmp.Diff(string(first), string(second)); diff != "" {
+		t.Errorf("serialized job configs differ:\n%s", diff)
+	}
+	if diff := cmp.Diff(jobConfig("b", "a"), unsorted, unexportedFields...); diff != "" {
+		t.Errorf("job config was modified:\n%s", diff)
+	}
+
+	path := filepath.Join(t.TempDir(), "org-repo-master-periodics.yaml")
+	if err := WriteToFile(path, unsorted); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	written, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	if diff := cmp.Diff(string(first), string(written)); diff != "" {
+		t.Errorf("written file differs from serialized job config:\n%s", diff)
+	}
+}
+
+func TestWriteUnchangedFilesKeepModificationTime(t *testing.T) {
+	dir := t.TempDir()
+	jobConfig := func() *prowconfig.JobConfig {
+		return &prowconfig.JobConfig{
+			PresubmitsStatic: map[string][]prowconfig.Presubmit{"org/repo": {{JobBase: prowconfig.JobBase{Name: "presubmit", Labels: map[string]string{}}}}},
+			Periodics: []prowconfig.Periodic{{JobBase: prowconfig.JobBase{Name: "periodic", Labels: map[string]string{}, UtilityConfig: prowconfig.UtilityConfig{
+				ExtraRefs: []prowv1.Refs{{Org: "org", Repo: "repo", BaseRef: "master"}},
+			}}}},
+		}
+	}
+	if err := WriteToDir(dir, "org", "repo", jobConfig(), "prowgen", nil); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	presubmits := filepath.Join(dir, "org/repo/org-repo-master-presubmits.yaml")
+	periodics := filepath.Join(dir, "org/repo/org-repo-master-periodics.yaml")
+	past := time.Now().Add(-time.Hour).Truncate(time.Second)
+	for _, path := range []string{presubmits, periodics} {
+		if err := os.Chtimes(path, past, past); err != nil {
+			t.Fatalf("failed to set modification time: %v", err)
+		}
+	}
+	assertUnchanged := func(path string) {
+		t.Helper()
+		if info, err := os.Stat(path); err != nil {
+			t.Fatalf("failed to stat: %v", err)
+		} else if !info.ModTime().Equal(past) {
+			t.Errorf("%s: expected modification time %v to be kept, got %v", filepath.Base(path), past, info.ModTime())
+		}
+	}
+
+	if err := WriteToDir(dir, "org", "repo", jobConfig(), "prowgen", nil); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	assertUnchanged(presubmits)
+	assertUnchanged(periodics)
+
+	written, err := ReadFromDir(dir)
+	if err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	if err := WriteToFile(presubmits, &prowconfig.JobConfig{PresubmitsStatic: written.PresubmitsStatic}); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	assertUnchanged(presubmits)
+
+	if err := WriteToFile(periodics, &prowconfig.JobConfig{}); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	if _, err := os.Stat(periodics); !os.IsNotExist(err) {
+		t.Errorf("expected file without jobs to be removed, got %v", err)
+	}
+}
+
+func TestWriteToFileGZIP(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "org-repo-master-presubmits.yaml.gz")
+	jobConfig := &prowconfig.JobConfig{PresubmitsStatic: map[string][]prowconfig.Presubmit{"org/repo": {{JobBase: prowconfig.JobBase{Name: "presubmit"}}}}}
+	if err := WriteToFile(path, jobConfig); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	if !bytes.HasPrefix(raw, []byte("\x1F\x8B")) {
+		t.Errorf("expected the file to be gzipped, got %q", raw)
+	}
+	read, err := ReadJobConfigFromFile(path)
+	if err != nil {
+		t.Fatalf("failed to read job config: %v", err)
+	}
+	if diff := cmp.Diff(jobConfig, read, unexportedFields...); diff != "" {
+		t.Errorf("read job config differs from written:\n%s", diff)
+	}
+
+	past := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := os.Chtimes(path, past, past); err != nil {
+		t.Fatalf("failed to set modification time: %v", err)
+	}
+	if err := WriteToFile(path, jobConfig); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	if info, err := os.Stat(path); err != nil {
+		t.Fatalf("failed to stat: %v", err)
+	} else if !info.ModTime().Equal(past) {
+		t.Errorf("expected unchanged gzipped file not to be rewritten")
+	}
+}
+
+func TestConfigMapsForPaths(t *testing.T) {
+	paths := []string{
+		"ci-operator/jobs/org/repo/org-repo-master-presubmits.yaml",
+		"ci-operator/jobs/org/repo/org-repo-master-postsubmits.yaml",
+		"ci-operator/jobs/org/repo/org-repo-release-4.12-presubmits.yaml",
+		"ci-operator/jobs/org/other/org-other-release-4.12-postsubmits.yaml",
+		"ci-operator/jobs/org/repo/org-repo-periodics.yaml",
+		"ci-operator/jobs/org/repo/OWNERS",
+		"README.md",
+	}
+	expected := []string{
+		"job-config-4.12",
+		"job-config-master-postsubmits",
+		"job-config-master-presubmits",
+		"job-config-misc",
+	}
+	configMaps, err := ConfigMapsForPaths(paths)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if diff := cmp.Diff(expected, configMaps.List()); diff != "" {
+		t.Errorf("configmaps differ from expected:\n%s", diff)
+	}
+
+	unmatched := []string{
+		"ci-operator/jobs/org/repo/org-repo-master-presubmits.yaml",
+		"ci-operator/config/org/repo/org-repo-master.yaml",
+		"core-services/prow/02_config/_config.yaml",
+		"ci-operator/jobs/org/repo/other-repo-master-presubmits.yaml",
+		"ci-operator/jobs/org/repo/org-repo-master-build.yaml",
+		"org-repo-master-presubmits.yaml",
+	}
+	expectedErr := utilerrors.NewAggregate([]error{
+		errors.New(`ci-operator/jobs/org/repo/other-repo-master-presubmits.yaml does not match any configmap: job configuration file in the wrong directory: file name was not prefixed with "org-repo-": "other-repo-master-presubmits"`),
+		errors.New(`ci-operator/jobs/org/repo/org-repo-master-build.yaml does not match any configmap: malformed job configuration file name: file name does not contain job type: "org-repo-master-build": unknown job type "build", expected one of ["presubmits" "postsubmits" "periodics"]`),
+	})
+	configMaps, err = ConfigMapsForPaths(unmatched)
+	if diff := cmp.Diff(expectedErr, err, testhelper.EquateErrorMessage); diff != "" {
+		t.Errorf("error differs from expected:\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"job-config-master-presubmits"}, configMaps.List()); diff != "" {
+		t.Errorf("configmaps differ from expected:\n%s", diff)
+	}
+}
+
+func TestReadFromDirByRepo(t *testing.T) {
+	dir := t.TempDir()
+	writeJobConfigs(t, dir, map[string]*prowconfig.JobConfig{
+		"org/repo/org-repo-master-presubmits.yaml": {
+			PresubmitsStatic: map[string][]prowconfig.Presubmit{"org/repo": {{JobBase: prowconfig.JobBase{Name: "master-presubmit"}}}},
+		},
+		"org/repo/org-repo-release-4.1-presubmits.yaml": {
+			PresubmitsStatic: map[string][]prowconfig.Presubmit{"org/repo": {{JobBase: prowconfig.JobBase{Name: "release-presubmit"}}}},
+		},
+		"org/repo/org-repo-master-periodics.yaml": {
+			Periodics: []prowconfig.Periodic{{JobBase: prowconfig.JobBase{Name: "periodic"}}},
+		},
+		"other/thing/other-thing-master-postsubmits.yaml": {
+			PostsubmitsStatic: map[string][]prowconfig.Postsubmit{"other/thing": {{JobBase: prowconfig.JobBase{Name: "postsubmit"}}}},
+		},
+	})
+
+	byRepo, err := ReadFromDirByRepo(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := map[string]*prowconfig.JobConfig{
+		"org/repo": {
+			PresubmitsStatic: map[string][]prowconfig.Presubmit{"org/repo": {
+				{JobBase: prowconfig.JobBase{Name: "master-presubmit"}},
+				{JobBase: prowconfig.JobBase{Name: "release-presubmit"}},
+			}},
+			PostsubmitsStatic: map[string][]prowconfig.Postsubmit{},
+			Periodics:         []prowconfig.Periodic{{JobBase: prowconfig.JobBase{Name: "periodic"}}},
+		},
+		"other/thing": {
+			PresubmitsStatic:  map[string][]prowconfig.Presubmit{},
+			PostsubmitsStatic: map[string][]prowconfig.Postsubmit{"other/thing": {{JobBase: prowconfig.JobBase{Name: "postsubmit"}}}},
+			Periodics:         []prowconfig.Periodic{},
+		},
+	}
+	sortPresubmits := cmpopts.SortSlices(func(a, b prowconfig.Presubmit) bool { return a.Name < b.Name })
+	if diff := cmp.Diff(expected, byRepo, append(unexportedFields, sortPresubmits)...); diff != "" {
+		t.Errorf("read job configs differ from expected:\n%s", diff)
+	}
+}
+
+func TestReadFromRepoDir(t *testing.T) {
+	dir := t.TempDir()
+	writeJobConfigs(t, dir, map[string]*prowconfig.JobConfig{
+		"org/repo/org-repo-master-presubmits.yaml": {
+			PresubmitsStatic: map[string][]prowconfig.Presubmit{"org/repo": {{JobBase: prowconfig.JobBase{Name: "presubmit"}}}},
+		},
+		"org/repo/org-repo-master-periodics.yaml": {
+			Periodics: []prowconfig.Periodic{{JobBase: prowconfig.JobBase{Name: "periodic"}}},
+		},
+		"org/repo-extra/org-repo-extra-master-presubmits.yaml": {
+			PresubmitsStatic: map[string][]prowconfig.Presubmit{"org/repo-extra": {{JobBase: prowconfig.JobBase{Name: "extra"}}}},
+		},
+		"other/repo/other-repo-master-postsubmits.yaml": {
+			PostsubmitsStatic: map[string][]prowconfig.Postsubmit{"other/repo": {{JobBase: prowconfig.JobBase{Name: "other"}}}},
+		},
+		"nested/repo/sub/repo-sub-master-presubmits.yaml": {
+			PresubmitsStatic: map[string][]prowconfig.Presubmit{"repo/sub": {{JobBase: prowconfig.JobBase{Name: "nested"}}}},
+		},
+	})
+
+	jobConfig, err := ReadFromRepoDir(dir, "org", "repo")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := &prowconfig.JobConfig{
+		PresubmitsStatic:  map[string][]prowconfig.Presubmit{"org/repo": {{JobBase: prowconfig.JobBase{Name: "presubmit"}}}},
+		PostsubmitsStatic: map[string][]prowconfig.Postsubmit{},
+		Periodics:         []prowconfig.Periodic{{JobBase: prowconfig.JobBase{Name: "periodic"}}},
+	}
+	if diff := cmp.Diff(expected, jobConfig, unexportedFields...); diff != "" {
+		t.Errorf("read job config differs from expected:\n%s", diff)
+	}
+
+	misnamed := filepath.Join(dir, "org/repo/other-repo-master-presubmits.yaml")
+	if err := os.WriteFile(misnamed, []byte("presubmits:\n  other/repo:\n  - name: misnamed\n"), 0644); err != nil {
+		t.Fatalf("failed to write %s: %v", misnamed, err)
+	}
+	_, err = ReadFromRepoDir(dir, "org", "repo")
+	if !errors.Is(err, ErrMisplacedFile) {
+		t.Errorf("expected an error for the misnamed file, got: %v", err)
+	}
+	if err != nil && !strings.Contains(err.Error(), misnamed) {
+		t.Errorf("expected the error to name %s, got: %v", misnamed, err)
+	}
+
+	nested := filepath.Join(dir, "nested/repo/sub/repo-sub-master-presubmits.yaml")
+	expectedErr := fmt.Errorf("failed to load Prow jobs for nested/repo: %w", errors.New(nested+": configures repo/sub instead of nested/repo"))
+	if _, err := ReadFromRepoDir(dir, "nested", "repo"); err == nil {
+		t.Error("expected an error reading a repo with nested files")
+	} else if diff := cmp.Diff(expectedErr, err, testhelper.EquateErrorMessage); diff != "" {
+		t.Errorf("error differs from expected:\n%s", diff)
+	}
+}
+
+func TestReadReposFromDir(t *testing.T) {
+	dir := t.TempDir()
+	writeJobConfigs(t, dir, map[string]*prowconfig.JobConfig{
+		"org/repo/org-repo-master-presubmits.yaml": {
+			PresubmitsStatic: map[string][]prowconfig.Presubmit{"org/repo": {{JobBase: prowconfig.JobBase{Name: "repo-presubmit"}}}},
+		},
+		"org/repo/org-repo-master-periodics.yaml": {
+			Periodics: []prowconfig.Periodic{{JobBase: prowconfig.JobBase{Name: "repo-periodic"}}},
+		},
+		"org/repo-extra/org-repo-extra-master-presubmits.yaml": {
+			PresubmitsStatic: map[string][]prowconfig.Presubmit{"org/repo-extra": {{JobBase: prowconfig.JobBase{Name: "extra-presubmit"}}}},
+		},
+		"other/thing/other-thing-master-postsubmits.yaml": {
+			PostsubmitsStatic: map[string][]prowconfig.Postsubmit{"other/thing": {{JobBase: prowconfig.JobBase{Name: "thing-postsubmit"}}}},
+		},
+		"unrelated/repo/unrelated-repo-master-presubmits.yaml": {
+			PresubmitsStatic: map[string][]prowconfig.Presubmit{"unrelated/repo": {{JobBase: prowconfig.JobBase{Name: "unrelated-presubmit"}}}},
+		},
+	})
+
+	jobConfig, err := ReadReposFromDir(dir, []string{"org/repo", "other/thing", "missing/repo"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := &prowconfig.JobConfig{
+		PresubmitsStatic:  map[string][]prowconfig.Presubmit{"org/repo": {{JobBase: prowconfig.JobBase{Name: "repo-presubmit"}}}},
+		PostsubmitsStatic: map[string][]prowconfig.Postsubmit{"other/thing": {{JobBase: prowconfig.JobBase{Name: "thing-postsubmit"}}}},
+		Periodics:         []prowconfig.Periodic{{JobBase: prowconfig.JobBase{Name: "repo-periodic"}}},
+	}
+	if diff := cmp.Diff(expected, jobConfig, unexportedFields...); diff != "" {
+		t.Errorf("read job config differs from expected:\n%s", diff)
+	}
+
+	if _, err := ReadReposFromDir(dir, []string{"org"}); err == nil {
+		t.Error("expected an error for a repo that is not org/repo, got none")
+	}
+}
+
+func TestReadFromFS(t *testing.T) {
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	if _, err := writer.Write([]byte("periodics:\n- name: periodic\n")); err != nil {
+		t.Fatalf("failed to compress: %v", err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("failed to compress: %v", err)
+	}
+	fsys := fstest.MapFS{
+		"jobs/org/repo/org-repo-master-presubmits.yaml":   {Data: []byte("presubmits:\n  org/repo:\n  - name: presubmit\n")},
+		"jobs/org/repo/org-repo-master-periodics.yaml":    {Data: compressed.Bytes()},
+		"jobs/org/repo/misnamed.yaml":                     {Data: []byte("presubmits:\n  org/repo:\n  - name: misnamed\n")},
+		"other/org/repo/org-repo-master-postsubmits.yaml": {Data: []byte("postsubmits:\n  org/repo:\n  - name: postsubmit\n")},
+	}
+
+	jobConfig, err := ReadFromFS(fsys, "jobs")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := &prowconfig.JobConfig{
+		PresubmitsStatic:  map[string][]prowconfig.Presubmit{"org/repo": {{JobBase: prowconfig.JobBase{Name: "presubmit"}}}},
+		PostsubmitsStatic: map[string][]prowconfig.Postsubmit{},
+		Periodics:         []prowconfig.Periodic{{JobBase: prowconfig.JobBase{Name: "periodic"}}},
+	}
+	if diff := cmp.Diff(expected, jobConfig, unexportedFields...); diff != "" {
+		t.Errorf("read job config differs from expected:\n%s", diff)
+	}
+
+	var files []string
+	if err := OperateOnJobConfigFS(fsys, "jobs", func(_ *prowconfig.JobConfig, info *Info) error {
+		files = append(files, info.Filename)
+		return nil
+	}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	sort.Strings(files)
+	if diff := cmp.Diff([]string{"jobs/org/repo/org-repo-master-periodics.yaml", "jobs/org/repo/org-repo-master-presubmits.yaml"}, files); diff != "" {
+		t.Errorf("files differ from expected:\n%s", diff)
+	}
+}
+
+func TestReadFromTarGz(t *testing.T) {
+	var archive bytes.Buffer
+	gzipWriter := gzip.NewWriter(&archive)
+	tarWriter := tar.NewWriter(gzipWriter)
+	for _, entry := range []struct {
+		name     string
+		typeflag byte
+		data     string
+	}{
+		{name: "./org/", typeflag: tar.TypeDir},
+		{name: "./org/repo/", typeflag: tar.TypeDir},
+		{name: "./org/repo/org-repo-master-presubmits.yaml", typeflag: tar.TypeReg, data: "presubmits:\n  org/repo:\n  - name: presubmit\n"},
+		{name: "./org/repo/org-repo-master-periodics.yml", typeflag: tar.TypeReg, data: "periodics:\n- name: periodic\n"},
+		{name: "./org/repo/OWNERS", typeflag: tar.TypeReg, data: "approvers:\n- someone\n"},
+		{name: "./org/repo/misnamed.yaml", typeflag: tar.TypeReg, data: "presubmits:\n  org/repo:\n  - name: misnamed\n"},
+	} {
+		if err := tarWriter.WriteHeader(&tar.Header{Name: entry.name, Typeflag: entry.typeflag, Mode: 0644, Size: int64(len(entry.data))}); err != nil {
+			t.Fatalf("failed to write header for %s: %v", entry.name, err)
+		}
+		if _, err := tarWriter.Write([]byte(entry.data)); err != nil {
+			t.Fatalf("failed to write %s: %v", entry.name, err)
+		}
+	}
+	if err := tarWriter.Close(); err != nil {
+		t.Fatalf("failed to close archive: %v", err)
+	}
+	if err := gzipWriter.Close(); err != nil {
+		t.Fatalf("failed to compress archive: %v", err)
+	}
+
+	jobConfig, err := ReadFromTarGz(&archive)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := &prowconfig.JobConfig{
+		PresubmitsStatic:  map[string][]prowconfig.Presubmit{"org/repo": {{JobBase: prowconfig.JobBase{Name: "presubmit"}}}},
+		PostsubmitsStatic: map[string][]prowconfig.Postsubmit{},
+		Periodics:         []prowconfig.Periodic{{JobBase: prowconfig.JobBase{Name: "periodic"}}},
+	}
+	if diff := cmp.Diff(expected, jobConfig, unexportedFields...); diff != "" {
+		t.Errorf("read job config differs from expected:\n%s", diff)
+	}
+
+	if _, err := ReadFromTarGz(strings.NewReader("not an archive")); err == nil {
+		t.Error("expected an error reading an invalid archive")
+	}
+}
+
+func TestArchiveFS(t *testing.T) {
+	fsys := archiveFS{
+		"org/repo/org-repo-master-presubmits.yaml": {name: "org-repo-master-presubmits.yaml", data: []byte("presubmits: {}\n"), mode: 0644},
+		"org/repo/OWNERS":                          {name: "OWNERS", data: []byte("approvers: []\n"), mode: 0644},
+		"org/other/org-other-periodics.yaml":       {name: "org-other-periodics.yaml", mode: 0600},
+		"README.md":                                {name: "README.md", data: []byte("# jobs\n"), mode: 0644},
+	}
+	if err := fstest.TestFS(fsys, "org/repo/org-repo-master-presubmits.yaml", "org/repo/OWNERS", "org/other/org-other-periodics.yaml", "README.md"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestReadFromDirExtensions(t *testing.T) {
+	dir := t.TempDir()
+	writeJobConfigs(t, dir, map[string]*prowconfig.JobConfig{
+		"org/repo/org-repo-master-presubmits.yaml": {
+			PresubmitsStatic: map[string][]prowconfig.Presubmit{"org/repo": {{JobBase: prowconfig.JobBase{Name: "yaml"}}}},
+		},
+	})
+	files := map[string]string{
+		"org/repo/org-repo-master-postsubmits.json": `{"postsubmits": {"org/repo": [{"name": "json"}]}}`,
+		"org/repo/org-repo-master-periodics.yml":    "periodics:\n- name: yml\n",
+	}
+	for path, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, path), []byte(content), 0644); err != nil {
+			t.Fatalf("failed to write %s: %v", path, err)
+		}
+	}
+
+	testCases := []struct {
+		name       string
+		extensions []string
+		expected   *prowconfig.JobConfig
+	}{
+		{
+			name: "only .yaml and .yml files are read by default",
+			expected: &prowconfig.JobConfig{
+				PresubmitsStatic:  map[string][]prowconfig.Presubmit{"org/repo": {{JobBase: prowconfig.JobBase{Name: "yaml"}}}},
+				PostsubmitsStatic: map[string][]prowconfig.Postsubmit{},
+				Periodics:         []prowconfig.Periodic{{JobBase: prowconfig.JobBase{Name: "yml"}}},
+			},
+		},
+		{
+			name:       "only the configured extensions are read",
+			extensions: []string{".yaml"},
+			expected: &prowconfig.JobConfig{
+				PresubmitsStatic:  map[string][]prowconfig.Presubmit{"org/repo": {{JobBase: prowconfig.JobBase{Name: "yaml"}}}},
+				PostsubmitsStatic: map[string][]prowconfig.Postsubmit{},
+				Periodics:         []prowconfig.Periodic{},
+			},
+		},
+		{
+			name:       "all allowed extensions are read",
+			extensions: []string{".yaml", ".yml", ".json"},
+			expected: &prowconfig.JobConfig{
+				PresubmitsStatic:  map[string][]prowconfig.Presubmit{"org/repo": {{JobBase: prowconfig.JobBase{Name: "yaml"}}}},
+				PostsubmitsStatic: map[string][]prowconfig.Postsubmit{"org/repo": {{JobBase: prowconfig.JobBase{Name: "json"}}}},
+				Periodics:         []prowconfig.Periodic{{JobBase: prowconfig.JobBase{Name: "yml"}}},
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var opts []WalkOption
+			if tc.extensions != nil {
+				opts = append(opts, WithExtensions(tc.extensions...))
+			}
+			jobConfig, err := ReadFromDir(dir, opts...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(tc.expected, jobConfig, unexportedFields...); diff != "" {
+				t.Errorf("read job config differs from expected:\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestFindJobFiles(t *testing.T) {
+	dir := t.TempDir()
+	writeJobConfigs(t, dir, map[string]*prowconfig.JobConfig{
+		"org/repo/org-repo-master-presubmits.yaml": {
+			PresubmitsStatic: map[string][]prowconfig.Presubmit{"org/repo": {{JobBase: prowconfig.JobBase{Name: "duplicated"}}}},
+		},
+		"org/repo/org-repo-release-4.12-presubmits.yaml": {
+			PresubmitsStatic: map[string][]prowconfig.Presubmit{"org/repo": {{JobBase: prowconfig.JobBase{Name: "duplicated"}}}},
+		},
+		"org/repo/org-repo-master-periodics.yaml": {
+			Periodics: []prowconfig.Periodic{{JobBase: prowconfig.JobBase{Name: "periodic"}}},
+		},
+	})
+	testCases := []struct {
+		name     string
+		jobName  string
+		expected []string
+	}{
+		{
+			name:    "job defined in two files is found in both",
+			jobName: "duplicated",
+			expected: []string{
+				filepath.Join(dir, "org/repo/org-repo-master-presubmits.yaml"),
+				filepath.Join(dir, "org/repo/org-repo-release-4.12-presubmits.yaml"),
+			},
+		},
+		{
+			name:     "periodic is found",
+			jobName:  "periodic",
+			expected: []string{filepath.Join(dir, "org/repo/org-repo-master-periodics.yaml")},
+		},
+		{
+			name:    "unknown job is not found",
+			jobName: "unknown",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			files, err := FindJobFiles(dir, tc.jobName)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(tc.expected, files); diff != "" {
+				t.Errorf("files differ from expected:\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestOperateOnJobConfigDirStrict(t *testing.T) {
+	dir := t.TempDir()
+	writeJobConfigs(t, dir, map[string]*prowconfig.JobConfig{
+		"org/repo/org-repo-master-presubmits.yaml": {
+			PresubmitsStatic: map[string][]prowconfig.Presubmit{"org/repo": {{JobBase: prowconfig.JobBase{Name: "presubmit"}}}},
+		},
+	})
+	for path, content := range map[string]string{
+		"org/repo/org-repo-master-postsubmits.yaml": "",
+		"org/repo/org-repo-master-periodics.yaml":   "periodics: [\n",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, path), []byte(content), 0644); err != nil {
+			t.Fatalf("failed to write %s: %v", path, err)
+		}
+	}
+
+	if err := OperateOnJobConfigDir(dir, func(*prowconfig.JobConfig, *Info) error { return nil }); err != nil {
+		t.Errorf("expected problems to only be logged by default, got: %v", err)
+	}
+
+	var read int
+	err := OperateOnJobConfigDir(dir, func(*prowconfig.JobConfig, *Info) error {
+		read++
+		return nil
+	}, WithStrict())
+	if read != 1 {
+		t.Errorf("expected the valid file to be processed, got %d files", read)
+	}
+	if err == nil {
+		t.Fatal("expected an error in strict mode, got none")
+	}
+	for _, expected := range []string{
+		filepath.Join(dir, "org/repo/org-repo-master-postsubmits.yaml") + ": failed to load Prow job config (file is empty)",
+		filepath.Join(dir, "org/repo/org-repo-master-periodics.yaml") + ": failed to load Prow job config",
+	} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected error to contain %q, got: %v", expected, err)
+		}
+	}
+}
+
+func TestOperateOnJobConfigDirStrictGlobs(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"new/repo/new-repo-master-presubmits.yaml":        "presubmits:\n  new/repo:\n  - name: good\n",
+		"legacy/repo/legacy-repo-master-presubmits.yaml":  "presubmits:\n  legacy/repo:\n  - name: good\n",
+		"new/repo/misnamed.yaml":                          "presubmits:\n  new/repo:\n  - name: misnamed\n",
+		"legacy/repo/misnamed.yaml":                       "presubmits:\n  legacy/repo:\n  - name: misnamed\n",
+		"new/repo/new-repo-master-postsubmits.yaml":       "",
+		"legacy/repo/legacy-repo-master-postsubmits.yaml": "",
+	}
+	for path, content := range files {
+		path = filepath.Join(dir, path)
+		if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+			t.Fatalf("failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("failed to write %s: %v", path, err)
+		}
+	}
+
+	testCases := []struct {
+		name           string
+		globs          []string
+		expectedErrors int
+	}{
+		{
+			name: "problems are not errors by default",
+		},
+		{
+			name:           "problems in strict paths are errors",
+			globs:          []string{"new/*/*"},
+			expectedErrors: 2,
+		},
+		{
+			name:           "problems in all paths are errors when everything is strict",
+			globs:          []string{"*/*/*"},
+			expectedErrors: 4,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var jobs int
+			err := OperateOnJobConfigDir(dir, func(jobConfig *prowconfig.JobConfig, info *Info) error {
+				jobs++
+				return nil
+			}, WithStrictGlobs(tc.globs...))
+			if jobs != 2 {
+				t.Errorf("expected the two valid files to be processed, got %d", jobs)
+			}
+			var errs []error
+			if err != nil {
+				var agg utilerrors.Aggregate
+				if !errors.As(err, &agg) {
+					t.Fatalf("expected an aggregate error, got %v", err)
+				}
+				errs = utilerrors.Flatten(agg).Errors()
+			}
+			if len(errs) != tc.expectedErrors {
+				t.Errorf("expected %d errors, got %d: %v", tc.expectedErrors, len(errs), err)
+			}
+		})
+	}
+
+	// globs are relative to the job configuration directory when walking a subdirectory
+	err := OperateOnJobConfigSubdir(dir, "new", func(*prowconfig.JobConfig, *Info) error { return nil }, WithStrictGlobs("new/*/*"))
+	if err == nil {
+		t.Errorf("expected problems in the strict subdirectory to be errors")
+	}
+
+	var jobs int
+	err = OperateOnJobConfigDir(dir, func(*prowconfig.JobConfig, *Info) error {
+		jobs++
+		return nil
+	}, WithStrictGlobs("new/*/*", "legacy/[repo"))
+	expected := utilerrors.NewAggregate([]error{fmt.Errorf("invalid strict glob %q: %w", "legacy/[repo", filepath.ErrBadPattern)})
+	if diff := cmp.Diff(expected, err, testhelper.EquateErrorMessage); diff != "" {
+		t.Errorf("error for a malformed glob differs from expected:\n%s", diff)
+	}
+	if jobs != 0 {
+		t.Errorf("expected no files to be processed with a malformed glob, got %d", jobs)
+	}
+}
+
+func TestWriteToDirExcludedBranches(t *testing.T) {
+	dir := t.TempDir()
+	generated := func() map[string]string { return map[string]string{LabelGenerator: "prowgen"} }
+	writeJobConfigs(t, dir, map[string]*prowconfig.JobConfig{
+		"org/repo/org-repo-master-presubmits.yaml": {
+			PresubmitsStatic: map[string][]prowconfig.Presubmit{"org/repo": {
+				{JobBase: prowconfig.JobBase{Name: "stale", Labels: generated()}, Brancher: prowconfig.Brancher{Branches: []string{"^master$"}}},
+			}},
+		},
+		"org/repo/org-repo-release-4.12-presubmits.yaml": {
+			PresubmitsStatic: map[string][]prowconfig.Presubmit{"org/repo": {
+				{JobBase: prowconfig.JobBase{Name: "frozen", Labels: generated()}, Brancher: prowconfig.Brancher{Branches: []string{"^release-4\\.12$"}}},
+			}},
+		},
+	})
+	frozenPath := filepath.Join(dir, "org/repo/org-repo-release-4.12-presubmits.yaml")
+	frozen, err := os.ReadFile(frozenPath)
+	if err != nil {
+		t.Fatalf("failed to read frozen file: %v", err)
+	}
+
+	jobConfig := &prowconfig.JobConfig{PresubmitsStatic: map[string][]prowconfig.Presubmit{"org/repo": {
+		{JobBase: prowconfig.JobBase{Name: "new", Labels: map[string]string{}}, Brancher: prowconfig.Brancher{Branches: []string{"^master$"}}},
+		{JobBase: prowconfig.JobBase{Name: "new-frozen", Labels: map[string]string{}}, Brancher: prowconfig.Brancher{Branches: []string{"^release-4\\.12$"}}},
+	}}}
+	if err := WriteToDir(dir, "org", "repo", jobConfig, "prowgen", nil, WithExcludedBranches("release-4.12")); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+
+	after, err := os.ReadFile(frozenPath)
+	if err != nil {
+		t.Fatalf("failed to read frozen file: %v", err)
+	}
+	if diff := cmp.Diff(string(frozen), string(after)); diff != "" {
+		t.Errorf("excluded branch file was modified:\n%s", diff)
+	}
+	expected := &prowconfig.JobConfig{PresubmitsStatic: map[string][]prowconfig.Presubmit{"org/repo": {
+		{JobBase: prowconfig.JobBase{Name: "new", Labels: generated()}, Brancher: prowconfig.Brancher{Branches: []string{"^master$"}}},
+	}}}
+	if diff := cmp.Diff(expected, readJobConfigs(t, dir)["org/repo/org-repo-master-presubmits.yaml"], unexportedFields...); diff != "" {
+		t.Errorf("regenerated branch differs from expected:\n%s", diff)
+	}
+}
+
+func TestWriteToDirDryRun(t *testing.T) {
+	dir := t.TempDir()
+	generatedLabels := func() map[string]string { return map[string]string{LabelGenerator: "prowgen"} }
+	writeJobConfigs(t, dir, map[string]*prowconfig.JobConfig{
+		"org/repo/org-repo-master-presubmits.yaml": {
+			PresubmitsStatic: map[string][]prowconfig.Presubmit{"org/repo": {
+				{JobBase: prowconfig.JobBase{Name: "manual"}, Brancher: prowconfig.Brancher{Branches: []string{"^master$"}}},
+			}},
+		},
+		"org/repo/org-repo-master-postsubmits.yaml": {
+			PostsubmitsStatic: map[string][]prowconfig.Postsubmit{"org/repo": {
+				{JobBase: prowconfig.JobBase{Name: "unchanged", Labels: generatedLabels()}, Brancher: prowconfig.Brancher{Branches: []string{"^master$"}}},
+			}},
+		},
+		"org/repo/org-repo-release-4.1-presubmits.yaml": {
+			PresubmitsStatic: map[string][]prowconfig.Presubmit{"org/repo": {
+				{JobBase: prowconfig.JobBase{Name: "stale", Labels: generatedLabels()}, Brancher: prowconfig.Brancher{Branches: []string{"^release-4\\.1$"}}},
+			}},
+		},
+	})
+	before := readJobConfigs(t, dir)
+
+	jobConfig := &prowconfig.JobConfig{
+		PresubmitsStatic: map[string][]prowconfig.Presubmit{"org/repo": {
+			{JobBase: prowconfig.JobBase{Name: "new", Labels: map[string]string{}}, Brancher: prowconfig.Brancher{Branches: []string{"^master$"}}},
+		}},
+		PostsubmitsStatic: map[string][]prowconfig.Postsubmit{"org/repo": {
+			{JobBase: prowconfig.JobBase{Name: "unchanged", Labels: map[string]string{}}, Brancher: prowconfig.Brancher{Branches: []string{"^master$"}}},
+			{JobBase: prowconfig.JobBase{Name: "created", Labels: map[string]string{}}, Brancher: prowconfig.Brancher{Branches: []string{"^release-4\\.2$"}}},
+		}},
+	}
+	plan, err := WriteToDirDryRun(dir, "org", "repo", jobConfig, "prowgen", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	component := filepath.Join(dir, "org", "repo")
+	if diff := cmp.Diff([]string{
+		filepath.Join(component, "org-repo-master-presubmits.yaml"),
+		filepath.Join(component, "org-repo-release-4.2-postsubmits.yaml"),
+	}, sets.StringKeySet(plan.Written).List()); diff != "" {
+		t.Errorf("written files differ from expected:\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{filepath.Join(component, "org-repo-release-4.1-presubmits.yaml")}, plan.Removed); diff != "" {
+		t.Errorf("removed files differ from expected:\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{filepath.Join(component, "org-repo-master-postsubmits.yaml")}, plan.Untouched); diff != "" {
+		t.Errorf("untouched files differ from expected:\n%s", diff)
+	}
+	if diff := cmp.Diff(before, readJobConfigs(t, dir), unexportedFields...); diff != "" {
+		t.Errorf("dry run modified the directory:\n%s", diff)
+	}
+	if labels := jobConfig.PresubmitsStatic["org/repo"][0].Labels; len(labels) != 0 {
+		t.Errorf("dry run modified the job config: %v", labels)
+	}
+
+	if err := WriteToDir(dir, "org", "repo", jobConfig, "prowgen", nil); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	for path, content := range plan.Written {
+		written, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("failed to read %s: %v", path, err)
+		}
+		if diff := cmp.Diff(string(content), string(written)); diff != "" {
+			t.Errorf("planned content of %s differs from what was written:\n%s", path, diff)
+		}
+	}
+	for _, path := range plan.Removed {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be removed, got: %v", path, err)
+		}
+	}
+}
+
+func TestWriteToDirKeepPostsubmitBranches(t *testing.T) {
+	postsubmit := func(branch string) prowconfig.Postsubmit {
+		return prowconfig.Postsubmit{JobBase: prowconfig.JobBase{Name: "postsubmit", Labels: map[string]string{}}, Brancher: prowconfig.Brancher{Branches: []string{branch}}}
+	}
+	for _, tc := range []struct {
+		name     string
+		opts     []WriteOption
+		expected []prowconfig.Brancher
+	}{
+		{
+			name:     "generated branches are used by default",
+			expected: []prowconfig.Brancher{{Branches: []string{"master"}}},
+		},
+		{
+			name:     "existing branches are kept when configured",
+			opts:     []WriteOption{WithMergeOptions(MergeOptions{KeepPostsubmitBranches: true})},
+			expected: []prowconfig.Brancher{{Branches: []string{"^master$"}}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			existing := &prowconfig.JobConfig{PostsubmitsStatic: map[string][]prowconfig.Postsubmit{"org/repo": {postsubmit("^master$")}}}
+			if err := WriteToDir(dir, "org", "repo", existing, "prowgen", nil); err != nil {
+				t.Fatalf("failed to write: %v", err)
+			}
+			generated := &prowconfig.JobConfig{PostsubmitsStatic: map[string][]prowconfig.Postsubmit{"org/repo": {postsubmit("master")}}}
+			if err := WriteToDir(dir, "org", "repo", generated, "prowgen", nil, tc.opts...); err != nil {
+				t.Fatalf("failed to write: %v", err)
+			}
+
+			var branches []prowconfig.Brancher
+			for _, job := range readJobConfigs(t, dir)["org/repo/org-repo-master-postsubmits.yaml"].PostsubmitsStatic["org/repo"] {
+				branches = append(branches, job.Brancher)
+			}
+			if diff := cmp.Diff(tc.expected, branches, unexportedFields...); diff != "" {
+				t.Errorf("postsubmit branches differ from expected:\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestWriteAllToDir(t *testing.T) {
+	dir := t.TempDir()
+	job := func(name string) prowconfig.JobBase {
+		return prowconfig.JobBase{Name: name, Labels: map[string]string{}}
+	}
+	jobConfig := &prowconfig.JobConfig{
+		PresubmitsStatic: map[string][]prowconfig.Presubmit{
+			"org/repo":  {{JobBase: job("presubmit")}},
+			"org/other": {{JobBase: job("other-presubmit"), Brancher: prowconfig.Brancher{Branches: []string{"release-4.12"}}}},
+		},
+		PostsubmitsStatic: map[string][]prowconfig.Postsubmit{
+			"org/repo": {{JobBase: job("postsubmit")}},
+		},
+		Periodics: []prowconfig.Periodic{
+			{JobBase: prowconfig.JobBase{Name: "periodic", Labels: map[string]string{}, UtilityConfig: prowconfig.UtilityConfig{
+				ExtraRefs: []prowv1.Refs{{Org: "another", Repo: "repo", BaseRef: "main"}},
+			}}},
+			{JobBase: job("unrelated")},
+		},
+	}
+	if err := WriteAllToDir(dir, jobConfig, "prowgen", nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var paths []string
+	for path := range readJobConfigs(t, dir) {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	expected := []string{
+		"another/repo/another-repo-main-periodics.yaml",
+		"org/other/org-other-release-4.12-presubmits.yaml",
+		"org/repo/org-repo-master-postsubmits.yaml",
+		"org/repo/org-repo-master-presubmits.yaml",
+	}
+	if diff := cmp.Diff(expected, paths); diff != "" {
+		t.Errorf("written files differ from expected:\n%s", diff)
+	}
+
+	invalid := &prowconfig.JobConfig{PresubmitsStatic: map[string][]prowconfig.Presubmit{"repo": {{JobBase: job("presubmit")}}}}
+	err := WriteAllToDir(t.TempDir(), invalid, "prowgen", nil)
+	if diff := cmp.Diff(errors.New(`jobs are configured for "repo", which is not an org/repo`), err, testhelper.EquateErrorMessage); diff != "" {
+		t.Errorf("error differs from expected:\n%s", diff)
+	}
+}
+
+func TestWriteToDirPeriodicPrimaryRef(t *testing.T) {
+	dir := t.TempDir()
+	periodic := func(name string, refs ...prowv1.Refs) prowconfig.Periodic {
+		return prowconfig.Periodic{JobBase: prowconfig.JobBase{Name: name, Labels: map[string]string{}, UtilityConfig: prowconfig.UtilityConfig{ExtraRefs: refs}}}
+	}
+	unrelated := prowv1.Refs{Org: "unrelated", Repo: "lib", BaseRef: "main"}
+	target := prowv1.Refs{Org: "org", Repo: "repo", BaseRef: "release-4.12"}
+	workDir := target
+	workDir.WorkDir = true
+	unrelatedWorkDir := unrelated
+	unrelatedWorkDir.WorkDir = true
+	jobConfig := &prowconfig.JobConfig{Periodics: []prowconfig.Periodic{
+		periodic("target-in-workdir", unrelated, workDir),
+		periodic("target-second", unrelated, target),
+		periodic("target-first", target, unrelated),
+		periodic("unrelated-in-workdir", target, unrelatedWorkDir),
+	}}
+	if err := WriteToDir(dir, "org", "repo", jobConfig, "prowgen", nil); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+
+	names := map[string][]string{}
+	for path, jobConfig := range readJobConfigs(t, dir) {
+		for _, job := range jobConfig.Periodics {
+			names[path] = append(names[path], job.Name)
+		}
+		sort.Strings(names[path])
+	}
+	expected := map[string][]string{
+		"org/repo/org-repo-release-4.12-periodics.yaml": {"target-first", "target-in-workdir", "target-second"},
+	}
+	if diff := cmp.Diff(expected, names); diff != "" {
+		t.Errorf("periodics per file differ from expected:\n%s", diff)
+	}
+
+	// writing all repos files every periodic once, under its primary ref
+	dir = t.TempDir()
+	if err := WriteAllToDir(dir, jobConfig, "prowgen", nil); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	names = map[string][]string{}
+	for path, jobConfig := range readJobConfigs(t, dir) {
+		for _, job := range jobConfig.Periodics {
+			names[path] = append(names[path], job.Name)
+		}
+		sort.Strings(names[path])
+	}
+	expected = map[string][]string{
+		"org/repo/org-repo-release-4.12-periodics.yaml":   {"target-first", "target-in-workdir"},
+		"unrelated/lib/unrelated-lib-main-periodics.yaml": {"target-second", "unrelated-in-workdir"},
+	}
+	if diff := cmp.Diff(expected, names); diff != "" {
+		t.Errorf("periodics per file differ from expected when writing all repos:\n%s", diff)
+	}
+}
+
+func TestWriteToDirCollidingJobs(t *testing.T) {
+	periodic := func(name, branch string) prowconfig.Periodic {
+		return prowconfig.Periodic{JobBase: prowconfig.JobBase{Name: name, Labels: map[string]string{}, UtilityConfig: prowconfig.UtilityConfig{
+			ExtraRefs: []prowv1.Refs{{Org: "org", Repo: "repo", BaseRef: branch}},
+		}}}
+	}
+	presubmit := func(name, branch string) prowconfig.Presubmit {
+		return prowconfig.Presubmit{JobBase: prowconfig.JobBase{Name: name, Labels: map[string]string{}}, Brancher: prowconfig.Brancher{Branches: []string{branch}}}
+	}
+	groupFeatures := func(branch string) string {
+		if strings.HasPrefix(branch, "feature/") {
+			return "feature"
+		}
+		return MakeRegexFilenameLabel(branch)
+	}
+	testCases := []struct {
+		name      string
+		jobConfig *prowconfig.JobConfig
+		opts      []WriteOption
+		expected  error
+	}{
+		{
+			name: "branches sharded into the same file collide",
+			jobConfig: &prowconfig.JobConfig{
+				PresubmitsStatic: map[string][]prowconfig.Presubmit{"org/repo": {
+					presubmit("presubmit", "feature/ab"),
+					presubmit("other", "feature/(a|b)"),
+					presubmit("master", "master"),
+					presubmit("master-anchored", "^master$"),
+				}},
+				Periodics: []prowconfig.Periodic{periodic("nightly", "feature/ab"), periodic("nightly", "feature/(a|b)"), periodic("weekly", "feature/ab")},
+			},
+			expected: utilerrors.NewAggregate([]error{
+				errors.New("jobs for different branches would be written to org-repo-featureab-periodics.yaml and overwrite each other (branches: feature/(a|b); feature/ab)"),
+				errors.New("jobs for different branches would be written to org-repo-featureab-presubmits.yaml and overwrite each other (branches: feature/(a|b); feature/ab)"),
+			}),
+		},
+		{
+			name: "same jobs for branches grouped by the branch label collide",
+			jobConfig: &prowconfig.JobConfig{
+				PresubmitsStatic: map[string][]prowconfig.Presubmit{"org/repo": {
+					presubmit("presubmit", "feature/a"),
+					presubmit("presubmit", "feature/b"),
+				}},
+				Periodics: []prowconfig.Periodic{periodic("nightly", "feature/a"), periodic("nightly", "feature/b"), periodic("weekly", "feature/a")},
+			},
+			opts:     []WriteOption{WithBranchLabel(groupFeatures)},
+			expected: errors.New("periodic nightly is configured 2 times for org-repo-feature-periodics.yaml (branches: feature/a; feature/b), only one would be kept"),
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			err := WriteToDir(dir, "org", "repo", tc.jobConfig, "prowgen", nil, tc.opts...)
+			if diff := cmp.Diff(tc.expected, err, testhelper.EquateErrorMessage); diff != "" {
+				t.Errorf("error differs from expected:\n%s", diff)
+			}
+			if entries, err := os.ReadDir(dir); err != nil {
+				t.Fatalf("failed to list directory: %v", err)
+			} else if len(entries) != 0 {
+				t.Errorf("expected nothing to be written, got %d entries", len(entries))
+			}
+		})
+	}
+}
+
+func TestWriteToDirBranchLabel(t *testing.T) {
+	dir := t.TempDir()
+	groupReleases := func(branch string) string {
+		label := MakeRegexFilenameLabel(branch)
+		if strings.HasPrefix(label, "release-") {
+			return "release"
+		}
+		return label
+	}
+	presubmit := func(name, branch string) prowconfig.Presubmit {
+		return prowconfig.Presubmit{JobBase: prowconfig.JobBase{Name: name, Labels: map[string]string{}}, Brancher: prowconfig.Brancher{Branches: []string{branch}}}
+	}
+	jobConfig := &prowconfig.JobConfig{
+		PresubmitsStatic: map[string][]prowconfig.Presubmit{"org/repo": {
+			presubmit("master", "^master$"),
+			presubmit("release-41", "^release-4\\.1$"),
+			presubmit("release-42", "^release-4\\.2$"),
+		}},
+		Periodics: []prowconfig.Periodic{{JobBase: prowconfig.JobBase{Name: "periodic", Labels: map[string]string{}, UtilityConfig: prowconfig.UtilityConfig{
+			ExtraRefs: []prowv1.Refs{{Org: "org", Repo: "repo", BaseRef: "release-4.3"}},
+		}}}},
+	}
+	if err := WriteToDir(dir, "org", "repo", jobConfig, "prowgen", nil, WithBranchLabel(groupReleases)); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+
+	names := map[string][]string{}
+	for path, jobConfig := range readJobConfigs(t, dir) {
+		for _, job := range jobConfig.PresubmitsStatic["org/repo"] {
+			names[path] = append(names[path], job.Name)
+		}
+		for _, job := range jobConfig.Periodics {
+			names[path] = append(names[path], job.Name)
+		}
+		sort.Strings(names[path])
+	}
+	expected := map[string][]string{
+		"org/repo/org-repo-master-presubmits.yaml":  {"master"},
+		"org/repo/org-repo-release-presubmits.yaml": {"release-41", "release-42"},
+		"org/repo/org-repo-release-periodics.yaml":  {"periodic"},
+	}
+	if diff := cmp.Diff(expected, names); diff != "" {
+		t.Errorf("jobs per file differ from expected:\n%s", diff)
+	}
+}
+
+func TestMakeRegexFilenameLabelWithDefault(t *testing.T) {
+	testCases := []struct {
+		name     string
+		regex    string
+		fallback string
+		expected string
+	}{
+		{name: "plain branch is kept", regex: "release-4.12", fallback: "main", expected: "release-4.12"},
+		{name: "regex characters are stripped", regex: "^release-4\\.12$", fallback: "main", expected: "release-4.12"},
+		{name: "regex stripped to nothing uses the fallback", regex: ".*", fallback: "main", expected: "main"},
+		{name: "empty branch uses the fallback", regex: "", fallback: "main", expected: "main"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if actual := MakeRegexFilenameLabelWithDefault(tc.regex, tc.fallback); actual != tc.expected {
+				t.Errorf("expected label %q, got %q", tc.expected, actual)
+			}
+		})
+	}
+	if actual := MakeRegexFilenameLabel(".*"); actual != "master" {
+		t.Errorf("expected MakeRegexFilenameLabel to fall back to master, got %q", actual)
+	}
+}
+
+func TestIsSimpleBranch(t *testing.T) {
+	testCases := []struct {
+		branch   string
+		expected bool
+	}{
+		{branch: "master", expected: true},
+		{branch: "release-4.12", expected: true},
+		{branch: "feature_branch", expected: true},
+		{branch: "release-4\\.12", expected: false},
+		{branch: "master|main", expected: false},
+		{branch: "^master$", expected: false},
+		{branch: "release-.*", expected: false},
+		{branch: "feature/branch", expected: false},
+		{branch: "", expected: false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.branch, func(t *testing.T) {
+			if actual := IsSimpleBranch(tc.branch); actual != tc.expected {
+				t.Errorf("expected %t for %q, got %t", tc.expected, tc.branch, actual)
+			}
+		})
+	}
+}
+
+func TestWriteToDirDefaultBranch(t *testing.T) {
+	dir := t.TempDir()
+	jobConfig := &prowconfig.JobConfig{
+		PresubmitsStatic: map[string][]prowconfig.Presubmit{"org/repo": {
+			{JobBase: prowconfig.JobBase{Name: "unbranched", Labels: map[string]string{}}},
+			{JobBase: prowconfig.JobBase{Name: "regex", Labels: map[string]string{}}, Brancher: prowconfig.Brancher{Branches: []string{"^$"}}},
+			{JobBase: prowconfig.JobBase{Name: "release", Labels: map[string]string{}}, Brancher: prowconfig.Brancher{Branches: []string{"release-4.12"}}},
+		}},
+		PostsubmitsStatic: map[string][]prowconfig.Postsubmit{"org/repo": {
+			{JobBase: prowconfig.JobBase{Name: "unbranched", Labels: map[string]string{}}},
+		}},
+	}
+	if err := WriteToDir(dir, "org", "repo", jobConfig, "prowgen", nil, WithDefaultBranch("main")); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+
+	names := map[string][]string{}
+	for path, jobConfig := range readJobConfigs(t, dir) {
+		for _, job := range jobConfig.PresubmitsStatic["org/repo"] {
+			names[path] = append(names[path], job.Name)
+		}
+		for _, job := range jobConfig.PostsubmitsStatic["org/repo"] {
+			names[path] = append(names[path], job.Name)
+		}
+		sort.Strings(names[path])
+	}
+	expected := map[string][]string{
+		"org/repo/org-repo-main-presubmits.yaml":         {"regex", "unbranched"},
+		"org/repo/org-repo-main-postsubmits.yaml":        {"unbranched"},
+		"org/repo/org-repo-release-4.12-presubmits.yaml": {"release"},
+	}
+	if diff := cmp.Diff(expected, names); diff != "" {
+		t.Errorf("jobs per file differ from expected:\n%s", diff)
+	}
+}
+
+func TestWriteToDirKeepEmptyFiles(t *testing.T) {
+	testCases := []struct {
+		name     string
+		opts     []WriteOption
+		expected []string
+	}{
+		{
+			name: "files left without jobs are removed by default",
+		},
+		{
+			name:     "files left without jobs are kept when configured",
+			opts:     []WriteOption{WithKeepEmptyFiles()},
+			expected: []string{"org/repo/org-repo-master-presubmits.yaml"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			jobConfig := &prowconfig.JobConfig{PresubmitsStatic: map[string][]prowconfig.Presubmit{"org/repo": {
+				{JobBase: prowconfig.JobBase{Name: "stale", Labels: map[string]string{}}},
+			}}}
+			if err := WriteToDir(dir, "org", "repo", jobConfig, "prowgen", nil); err != nil {
+				t.Fatalf("failed to write: %v", err)
+			}
+			if err := WriteToDir(dir, "org", "repo", &prowconfig.JobConfig{}, "prowgen", nil, tc.opts...); err != nil {
+				t.Fatalf("failed to write: %v", err)
+			}
+			var paths []string
+			for path := range readJobConfigs(t, dir) {
+				paths = append(paths, path)
+			}
+			if diff := cmp.Diff(tc.expected, paths); diff != "" {
+				t.Errorf("files differ from expected:\n%s", diff)
+			}
+
+			path := filepath.Join(dir, "org", "repo", "org-repo-master-postsubmits.yaml")
+			if err := os.WriteFile(path, []byte("postsubmits: {}\n"), 0644); err != nil {
+				t.Fatalf("failed to write file: %v", err)
+			}
+			if err := WriteToFile(path, &prowconfig.JobConfig{}, tc.opts...); err != nil {
+				t.Fatalf("failed to write: %v", err)
+			}
+			if _, err := os.Stat(path); os.IsNotExist(err) == (tc.expected != nil) {
+				t.Errorf("expected file to be kept: %t, got: %v", tc.expected != nil, err)
+			}
+		})
+	}
+}
+
+func TestFilenameSeparatorRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	jobConfig := &prowconfig.JobConfig{
+		PresubmitsStatic: map[string][]prowconfig.Presubmit{"org/my-repo": {
+			{JobBase: prowconfig.JobBase{Name: "presubmit", Labels: map[string]string{}}, Brancher: prowconfig.Brancher{Branches: []string{"^release-4\\.12$"}}},
+		}},
+		Periodics: []prowconfig.Periodic{
+			{JobBase: prowconfig.JobBase{Name: "periodic", Labels: map[string]string{}, UtilityConfig: prowconfig.UtilityConfig{
+				ExtraRefs: []prowv1.Refs{{Org: "org", Repo: "my-repo", BaseRef: "feature-x"}},
+			}}},
+		},
+	}
+	if err := WriteToDir(dir, "org", "my-repo", jobConfig, "prowgen", nil, WithWriteSeparator("__")); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+
+	var infos []Info
+	if err := OperateOnJobConfigSubdirPaths(dir, "", func(info *Info) error {
+		if actual, expected := info.Basename(), filepath.Base(info.Filename); actual != expected {
+			t.Errorf("basename %q does not match the file name %q", actual, expected)
+		}
+		info.Filename = ""
+		infos = append(infos, *info)
+		return nil
+	}, WithWalkSeparator("__")); err != nil {
+		t.Fatalf("failed to walk: %v", err)
+	}
+	expected := []Info{
+		{Org: "org", Repo: "my-repo", Branch: "feature-x", Type: "periodics", Separator: "__"},
+		{Org: "org", Repo: "my-repo", Branch: "release-4.12", Type: "presubmits", Separator: "__"},
+	}
+	if diff := cmp.Diff(expected, infos); diff != "" {
+		t.Errorf("file infos differ from expected:\n%s", diff)
+	}
+
+	jobConfig.PresubmitsStatic["org/my-repo"][0].Name = "renamed"
+	if err := WriteToDir(dir, "org", "my-repo", jobConfig, "prowgen", nil, WithWriteSeparator("__")); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	read, err := ReadFromDir(dir, WithWalkSeparator("__"))
+	if err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	var names []string
+	for _, job := range read.PresubmitsStatic["org/my-repo"] {
+		names = append(names, job.Name)
+	}
+	if diff := cmp.Diff([]string{"renamed"}, names); diff != "" {
+		t.Errorf("existing file was not merged into:\n%s", diff)
+	}
+}
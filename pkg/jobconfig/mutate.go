@@ -0,0 +1,339 @@
+package jobconfig
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	prowconfig "k8s.io/test-infra/prow/config"
+)
+
+// Canonicalize brings the job config into the form it is written in: jobs and
+// their pod specs are sorted, repos without jobs are removed and empty slices
+// and maps that are omitted when serialized are set to nil, so that job
+// configs which serialize identically also compare equal.
+func Canonicalize(jobConfig *prowconfig.JobConfig) {
+	SortJobConfig(jobConfig)
+	for repo, jobs := range jobConfig.PresubmitsStatic {
+		if len(jobs) == 0 {
+			delete(jobConfig.PresubmitsStatic, repo)
+		}
+	}
+	for repo, jobs := range jobConfig.PostsubmitsStatic {
+		if len(jobs) == 0 {
+			delete(jobConfig.PostsubmitsStatic, repo)
+		}
+	}
+	normalizeEmpty(reflect.ValueOf(jobConfig).Elem())
+}
+
+// normalizeEmpty sets empty slices and maps in fields tagged with omitempty
+// to nil, recursively. Fields without omitempty are serialized differently
+// when empty and when nil, so they are left alone.
+func normalizeEmpty(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if !v.IsNil() {
+			normalizeEmpty(v.Elem())
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			normalizeEmpty(v.Index(i))
+		}
+	case reflect.Map:
+		// map values are not addressable, but slices share their elements
+		if v.Type().Elem().Kind() == reflect.Slice {
+			for _, key := range v.MapKeys() {
+				normalizeEmpty(v.MapIndex(key))
+			}
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Field(i)
+			if !field.CanSet() {
+				continue
+			}
+			if kind := field.Kind(); (kind == reflect.Slice || kind == reflect.Map) && !field.IsNil() && field.Len() == 0 && hasOmitEmpty(v.Type().Field(i)) {
+				field.Set(reflect.Zero(field.Type()))
+				continue
+			}
+			normalizeEmpty(field)
+		}
+	}
+}
+
+func hasOmitEmpty(field reflect.StructField) bool {
+	for _, option := range strings.Split(field.Tag.Get("json"), ",")[1:] {
+		if option == "omitempty" {
+			return true
+		}
+	}
+	return false
+}
+
+// MutateJobConfigDir calls fn for every job configuration file in dir and
+// writes the job config back to the file when fn reports it changed. Files are
+// written sorted and serialized according to opts, replacing the previous
+// content atomically; files left without jobs are removed. Files for excluded
+// branches are not passed to fn. Unlike WriteToDir, no jobs are pruned: the
+// files are written back with exactly the jobs fn leaves in them.
+func MutateJobConfigDir(dir string, fn func(*prowconfig.JobConfig, *Info) (changed bool, err error), opts ...WriteOption) error {
+	o := newWriteOptions(opts)
+	return OperateOnJobConfigDir(dir, func(jobConfig *prowconfig.JobConfig, info *Info) error {
+		if o.isExcluded(info) {
+			return nil
+		}
+		changed, err := fn(jobConfig, info)
+		if err != nil {
+			return fmt.Errorf("%s: %w", info.Filename, err)
+		}
+		if !changed {
+			return nil
+		}
+		Canonicalize(jobConfig)
+		if err := o.writeToFile(info.Filename, jobConfig); err != nil {
+			return fmt.Errorf("failed to write %s: %w", info.Filename, err)
+		}
+		return nil
+	}, WithWalkSeparator(o.Separator))
+}
+
+// CloneJobConfig returns a deep copy of the job config: the copy shares no
+// maps, slices or pod specs with the original and can be mutated freely.
+func CloneJobConfig(jobConfig *prowconfig.JobConfig) *prowconfig.JobConfig {
+	if jobConfig == nil {
+		return nil
+	}
+	clone := *jobConfig
+	if jobConfig.Presets != nil {
+		clone.Presets = make([]prowconfig.Preset, len(jobConfig.Presets))
+		for i := range jobConfig.Presets {
+			jobConfig.Presets[i].DeepCopyInto(&clone.Presets[i])
+		}
+	}
+	if jobConfig.PresubmitsStatic != nil {
+		clone.PresubmitsStatic = make(map[string][]prowconfig.Presubmit, len(jobConfig.PresubmitsStatic))
+		for repo, jobs := range jobConfig.PresubmitsStatic {
+			var cloned []prowconfig.Presubmit
+			if jobs != nil {
+				cloned = make([]prowconfig.Presubmit, len(jobs))
+				for i := range jobs {
+					jobs[i].DeepCopyInto(&cloned[i])
+				}
+			}
+			clone.PresubmitsStatic[repo] = cloned
+		}
+	}
+	if jobConfig.PostsubmitsStatic != nil {
+		clone.PostsubmitsStatic = make(map[string][]prowconfig.Postsubmit, len(jobConfig.PostsubmitsStatic))
+		for repo, jobs := range jobConfig.PostsubmitsStatic {
+			var cloned []prowconfig.Postsubmit
+			if jobs != nil {
+				cloned = make([]prowconfig.Postsubmit, len(jobs))
+				for i := range jobs {
+					jobs[i].DeepCopyInto(&cloned[i])
+				}
+			}
+			clone.PostsubmitsStatic[repo] = cloned
+		}
+	}
+	if jobConfig.Periodics != nil {
+		clone.Periodics = make([]prowconfig.Periodic, len(jobConfig.Periodics))
+		for i := range jobConfig.Periodics {
+			clone.Periodics[i] = clonePeriodic(jobConfig.Periodics[i])
+		}
+	}
+	if jobConfig.AllRepos != nil {
+		clone.AllRepos = jobConfig.AllRepos.Union(nil)
+	}
+	if jobConfig.ProwIgnored != nil {
+		raw := append(json.RawMessage(nil), *jobConfig.ProwIgnored...)
+		clone.ProwIgnored = &raw
+	}
+	return &clone
+}
+
+// FilterJobConfig returns a deep copy of the job config holding only the jobs
+// for which predicate returns true. Repos left without presubmits or
+// postsubmits are omitted.
+func FilterJobConfig(jobConfig *prowconfig.JobConfig, predicate func(prowconfig.JobBase) bool) *prowconfig.JobConfig {
+	filtered := CloneJobConfig(jobConfig)
+	if filtered == nil {
+		return nil
+	}
+	for repo, jobs := range filtered.PresubmitsStatic {
+		var kept []prowconfig.Presubmit
+		for _, job := range jobs {
+			if predicate(job.JobBase) {
+				kept = append(kept, job)
+			}
+		}
+		if len(kept) == 0 {
+			delete(filtered.PresubmitsStatic, repo)
+			continue
+		}
+		filtered.PresubmitsStatic[repo] = kept
+	}
+	for repo, jobs := range filtered.PostsubmitsStatic {
+		var kept []prowconfig.Postsubmit
+		for _, job := range jobs {
+			if predicate(job.JobBase) {
+				kept = append(kept, job)
+			}
+		}
+		if len(kept) == 0 {
+			delete(filtered.PostsubmitsStatic, repo)
+			continue
+		}
+		filtered.PostsubmitsStatic[repo] = kept
+	}
+	if filtered.Periodics != nil {
+		kept := []prowconfig.Periodic{}
+		for _, job := range filtered.Periodics {
+			if predicate(job.JobBase) {
+				kept = append(kept, job)
+			}
+		}
+		filtered.Periodics = kept
+	}
+	return filtered
+}
+
+// RenameOptions control how RenameRepo rewrites jobs
+type RenameOptions struct {
+	// RenameJobs rewrites the names of the jobs for the repo that embed the
+	// old org and repo, like generated names do, to embed the new ones
+	RenameJobs bool
+}
+
+type RenameOption func(*RenameOptions)
+
+// WithRenamedJobs makes RenameRepo rewrite the names of the jobs as well
+func WithRenamedJobs() RenameOption {
+	return func(o *RenameOptions) {
+		o.RenameJobs = true
+	}
+}
+
+// RenameRepo moves the jobs configured for oldOrg/oldRepo to newOrg/newRepo:
+// presubmits and postsubmits are moved to the new repo and references to the
+// old repo in the refs of any job are rewritten. It fails without modifying
+// the job config when presubmits or postsubmits are already configured for
+// the new repo.
+func RenameRepo(jobConfig *prowconfig.JobConfig, oldOrg, oldRepo, newOrg, newRepo string, opts ...RenameOption) error {
+	o := &RenameOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	oldKey, newKey := fmt.Sprintf("%s/%s", oldOrg, oldRepo), fmt.Sprintf("%s/%s", newOrg, newRepo)
+	if oldKey == newKey {
+		return nil
+	}
+	if _, ok := jobConfig.PresubmitsStatic[newKey]; ok {
+		return fmt.Errorf("presubmits are already configured for %s", newKey)
+	}
+	if _, ok := jobConfig.PostsubmitsStatic[newKey]; ok {
+		return fmt.Errorf("postsubmits are already configured for %s", newKey)
+	}
+
+	oldPrefix, newPrefix := fmt.Sprintf("%s-%s-", oldOrg, oldRepo), fmt.Sprintf("%s-%s-", newOrg, newRepo)
+	rename := func(job *prowconfig.JobBase) {
+		if o.RenameJobs {
+			job.Name = strings.Replace(job.Name, oldPrefix, newPrefix, 1)
+		}
+	}
+	// renameRefs rewrites the refs to the old repo and determines whether
+	// there were any
+	renameRefs := func(job *prowconfig.JobBase) bool {
+		renamed := false
+		for i := range job.ExtraRefs {
+			if job.ExtraRefs[i].Org == oldOrg && job.ExtraRefs[i].Repo == oldRepo {
+				job.ExtraRefs[i].Org, job.ExtraRefs[i].Repo = newOrg, newRepo
+				renamed = true
+			}
+		}
+		return renamed
+	}
+
+	if jobs, ok := jobConfig.PresubmitsStatic[oldKey]; ok {
+		for i := range jobs {
+			rename(&jobs[i].JobBase)
+		}
+		jobConfig.PresubmitsStatic[newKey] = jobs
+		delete(jobConfig.PresubmitsStatic, oldKey)
+	}
+	if jobs, ok := jobConfig.PostsubmitsStatic[oldKey]; ok {
+		for i := range jobs {
+			rename(&jobs[i].JobBase)
+		}
+		jobConfig.PostsubmitsStatic[newKey] = jobs
+		delete(jobConfig.PostsubmitsStatic, oldKey)
+	}
+	for _, jobs := range jobConfig.PresubmitsStatic {
+		for i := range jobs {
+			renameRefs(&jobs[i].JobBase)
+		}
+	}
+	for _, jobs := range jobConfig.PostsubmitsStatic {
+		for i := range jobs {
+			renameRefs(&jobs[i].JobBase)
+		}
+	}
+	for i := range jobConfig.Periodics {
+		if renameRefs(&jobConfig.Periodics[i].JobBase) {
+			rename(&jobConfig.Periodics[i].JobBase)
+		}
+	}
+	return nil
+}
+
+// ClearClusters unsets the cluster of every job for which predicate returns
+// true, so that jobs are assigned to build clusters anew, and returns the
+// number of jobs whose cluster was cleared. Merging only keeps the cluster of
+// an existing job when it is set, so generated jobs merged into cleared ones
+// get the cluster they are generated with instead of the cleared one.
+func ClearClusters(jobConfig *prowconfig.JobConfig, predicate func(prowconfig.JobBase) bool) int {
+	return AssignCluster(jobConfig, "", predicate)
+}
+
+// AssignCluster schedules every job for which predicate returns true on the
+// cluster and returns the number of jobs whose cluster changed
+func AssignCluster(jobConfig *prowconfig.JobConfig, cluster string, predicate func(prowconfig.JobBase) bool) int {
+	var changed int
+	mutateJobs(jobConfig, func(job *prowconfig.JobBase) {
+		if job.Cluster != cluster && predicate(*job) {
+			job.Cluster = cluster
+			changed++
+		}
+	})
+	return changed
+}
+
+// mutateJobs calls fn with every job in the job config, which it may modify
+func mutateJobs(jobConfig *prowconfig.JobConfig, fn func(job *prowconfig.JobBase)) {
+	for _, jobs := range jobConfig.PresubmitsStatic {
+		for i := range jobs {
+			fn(&jobs[i].JobBase)
+		}
+	}
+	for _, jobs := range jobConfig.PostsubmitsStatic {
+		for i := range jobs {
+			fn(&jobs[i].JobBase)
+		}
+	}
+	for i := range jobConfig.Periodics {
+		fn(&jobConfig.Periodics[i].JobBase)
+	}
+}
+
+// clonePeriodic deep-copies a periodic, which unlike other job types does not
+// have a generated DeepCopy
+func clonePeriodic(job prowconfig.Periodic) prowconfig.Periodic {
+	clone := job
+	job.JobBase.DeepCopyInto(&clone.JobBase)
+	if job.Tags != nil {
+		clone.Tags = append([]string(nil), job.Tags...)
+	}
+	return clone
+}
@@ -0,0 +1,492 @@
+package jobconfig
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	v1 "k8s.io/api/core/v1"
+	prowapi "k8s.io/test-infra/prow/apis/prowjobs/v1"
+	prowconfig "k8s.io/test-infra/prow/config"
+)
+
+func TestCloneJobConfig(t *testing.T) {
+	newJobConfig := func() *prowconfig.JobConfig {
+		jobBase := func(name string) prowconfig.JobBase {
+			return prowconfig.JobBase{
+				Name:        name,
+				Labels:      map[string]string{"label": "value"},
+				Annotations: map[string]string{"annotation": "value"},
+				Spec: &v1.PodSpec{Containers: []v1.Container{{
+					Name: "test",
+					Args: []string{"--target=unit"},
+					Env:  []v1.EnvVar{{Name: "ENV", Value: "value"}},
+				}}},
+				UtilityConfig: prowconfig.UtilityConfig{ExtraRefs: []prowapi.Refs{{Org: "org", Repo: "repo"}}},
+			}
+		}
+		return &prowconfig.JobConfig{
+			PresubmitsStatic: map[string][]prowconfig.Presubmit{"org/repo": {{
+				JobBase:  jobBase("presubmit"),
+				Brancher: prowconfig.Brancher{Branches: []string{"master"}},
+			}}},
+			PostsubmitsStatic: map[string][]prowconfig.Postsubmit{"org/repo": {{
+				JobBase:  jobBase("postsubmit"),
+				Brancher: prowconfig.Brancher{Branches: []string{"master"}},
+			}}},
+			Periodics: []prowconfig.Periodic{{JobBase: jobBase("periodic"), Tags: []string{"tag"}}},
+		}
+	}
+	original := newJobConfig()
+	clone := CloneJobConfig(original)
+	if diff := cmp.Diff(original, clone, unexportedFields...); diff != "" {
+		t.Fatalf("clone differs from original:\n%s", diff)
+	}
+
+	mutate := func(job *prowconfig.JobBase) {
+		job.Name = "mutated"
+		job.Labels["label"] = "mutated"
+		job.Annotations["annotation"] = "mutated"
+		job.Spec.Containers[0].Args[0] = "mutated"
+		job.Spec.Containers[0].Env[0].Value = "mutated"
+		job.ExtraRefs[0].Org = "mutated"
+	}
+	mutate(&clone.PresubmitsStatic["org/repo"][0].JobBase)
+	clone.PresubmitsStatic["org/repo"][0].Branches[0] = "mutated"
+	mutate(&clone.PostsubmitsStatic["org/repo"][0].JobBase)
+	clone.PostsubmitsStatic["org/repo"][0].Branches[0] = "mutated"
+	mutate(&clone.Periodics[0].JobBase)
+	clone.Periodics[0].Tags[0] = "mutated"
+	clone.PresubmitsStatic["org/other"] = nil
+
+	if diff := cmp.Diff(newJobConfig(), original, unexportedFields...); diff != "" {
+		t.Errorf("mutating the clone changed the original:\n%s", diff)
+	}
+}
+
+func TestCanonicalizeEmptyFields(t *testing.T) {
+	empty := &prowconfig.JobConfig{PresubmitsStatic: map[string][]prowconfig.Presubmit{"org/repo": {{
+		JobBase: prowconfig.JobBase{
+			Name:        "job",
+			Labels:      map[string]string{},
+			Annotations: map[string]string{},
+			Spec: &v1.PodSpec{
+				Containers: []v1.Container{{Name: "test", Args: []string{}, Env: []v1.EnvVar{}}},
+				Volumes:    []v1.Volume{},
+			},
+			UtilityConfig: prowconfig.UtilityConfig{ExtraRefs: []prowapi.Refs{}},
+		},
+		Brancher:            prowconfig.Brancher{Branches: []string{}, SkipBranches: []string{}},
+		RegexpChangeMatcher: prowconfig.RegexpChangeMatcher{},
+	}}}}
+	unset := &prowconfig.JobConfig{PresubmitsStatic: map[string][]prowconfig.Presubmit{"org/repo": {{
+		JobBase: prowconfig.JobBase{
+			Name: "job",
+			Spec: &v1.PodSpec{Containers: []v1.Container{{Name: "test"}}},
+		},
+	}}}}
+	Canonicalize(empty)
+	Canonicalize(unset)
+	if diff := cmp.Diff(unset, empty, unexportedFields...); diff != "" {
+		t.Errorf("canonicalized job configs differ:\n%s", diff)
+	}
+
+	var serialized []string
+	for _, jobConfig := range []*prowconfig.JobConfig{empty, unset} {
+		path := filepath.Join(t.TempDir(), "org-repo-master-presubmits.yaml")
+		if err := WriteToFile(path, jobConfig); err != nil {
+			t.Fatalf("failed to write job config: %v", err)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("failed to read job config: %v", err)
+		}
+		serialized = append(serialized, string(data))
+	}
+	if diff := cmp.Diff(serialized[0], serialized[1]); diff != "" {
+		t.Errorf("serialized job configs differ:\n%s", diff)
+	}
+
+	containers := &v1.PodSpec{Containers: []v1.Container{}}
+	jobConfig := &prowconfig.JobConfig{Periodics: []prowconfig.Periodic{{JobBase: prowconfig.JobBase{Name: "periodic", Spec: containers}}}}
+	Canonicalize(jobConfig)
+	if containers.Containers == nil {
+		t.Error("empty field serialized without omitempty was set to nil")
+	}
+}
+
+func TestWriteToFileOmitsEmptySections(t *testing.T) {
+	presubmits := map[string][]prowconfig.Presubmit{"org/repo": {{JobBase: prowconfig.JobBase{Name: "job"}}}}
+	testCases := []struct {
+		name      string
+		jobConfig *prowconfig.JobConfig
+		expected  *prowconfig.JobConfig
+	}{
+		{
+			name: "empty maps and slices are omitted",
+			jobConfig: &prowconfig.JobConfig{
+				PresubmitsStatic:  presubmits,
+				PostsubmitsStatic: map[string][]prowconfig.Postsubmit{},
+				Periodics:         []prowconfig.Periodic{},
+			},
+			expected: &prowconfig.JobConfig{PresubmitsStatic: presubmits},
+		},
+		{
+			name: "repos without jobs are omitted",
+			jobConfig: &prowconfig.JobConfig{
+				PresubmitsStatic:  presubmits,
+				PostsubmitsStatic: map[string][]prowconfig.Postsubmit{"org/repo": {}},
+			},
+			expected: &prowconfig.JobConfig{PresubmitsStatic: presubmits},
+		},
+		{
+			name: "job configs with only repos without jobs are removed",
+			jobConfig: &prowconfig.JobConfig{
+				PresubmitsStatic:  map[string][]prowconfig.Presubmit{"org/repo": nil},
+				PostsubmitsStatic: map[string][]prowconfig.Postsubmit{"org/repo": {}},
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, opts := range [][]WriteOption{nil, {WithKeyOrder(ProwKeyOrder...)}} {
+				dir := t.TempDir()
+				path := filepath.Join(dir, "org", "repo", "org-repo-master-presubmits.yaml")
+				if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+					t.Fatalf("failed to create dir: %v", err)
+				}
+				if err := WriteToFile(path, tc.jobConfig, opts...); err != nil {
+					t.Fatalf("failed to write job config: %v", err)
+				}
+				data, err := os.ReadFile(path)
+				if tc.expected == nil {
+					if !os.IsNotExist(err) {
+						t.Fatalf("expected no file to be written, got: %v", err)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("failed to read job config: %v", err)
+				}
+				for _, section := range []string{"postsubmits", "periodics", "{}", "[]"} {
+					if strings.Contains(string(data), section) {
+						t.Errorf("expected %q not to be serialized:\n%s", section, data)
+					}
+				}
+				roundTripped, err := ReadFromDir(dir)
+				if err != nil {
+					t.Fatalf("failed to read job config back: %v", err)
+				}
+				// reading initializes every section, so compare in canonical form
+				Canonicalize(roundTripped)
+				if diff := cmp.Diff(tc.expected, roundTripped, unexportedFields...); diff != "" {
+					t.Errorf("round-tripped job config differs from expected:\n%s", diff)
+				}
+			}
+		})
+	}
+}
+
+func TestFilterJobConfig(t *testing.T) {
+	releaseController := map[string]string{ReleaseControllerLabel: ReleaseControllerValue}
+	jobConfig := &prowconfig.JobConfig{
+		PresubmitsStatic: map[string][]prowconfig.Presubmit{
+			"org/repo":  {{JobBase: prowconfig.JobBase{Name: "kept", Labels: releaseController}}, {JobBase: prowconfig.JobBase{Name: "dropped"}}},
+			"org/other": {{JobBase: prowconfig.JobBase{Name: "dropped"}}},
+		},
+		PostsubmitsStatic: map[string][]prowconfig.Postsubmit{
+			"org/repo": {{JobBase: prowconfig.JobBase{Name: "dropped"}}},
+		},
+		Periodics: []prowconfig.Periodic{{JobBase: prowconfig.JobBase{Name: "kept", Labels: releaseController}}, {JobBase: prowconfig.JobBase{Name: "dropped"}}},
+	}
+	original := CloneJobConfig(jobConfig)
+
+	filtered := FilterJobConfig(jobConfig, func(job prowconfig.JobBase) bool {
+		return job.Labels[ReleaseControllerLabel] == ReleaseControllerValue
+	})
+	expected := &prowconfig.JobConfig{
+		PresubmitsStatic: map[string][]prowconfig.Presubmit{
+			"org/repo": {{JobBase: prowconfig.JobBase{Name: "kept", Labels: releaseController}}},
+		},
+		PostsubmitsStatic: map[string][]prowconfig.Postsubmit{},
+		Periodics:         []prowconfig.Periodic{{JobBase: prowconfig.JobBase{Name: "kept", Labels: releaseController}}},
+	}
+	if diff := cmp.Diff(expected, filtered, unexportedFields...); diff != "" {
+		t.Errorf("filtered job config differs from expected:\n%s", diff)
+	}
+	filtered.Periodics[0].Labels["mutated"] = "true"
+	if diff := cmp.Diff(original, jobConfig, unexportedFields...); diff != "" {
+		t.Errorf("filtering modified the job config:\n%s", diff)
+	}
+}
+
+func TestRenameRepo(t *testing.T) {
+	refs := func(org, repo string) prowconfig.UtilityConfig {
+		return prowconfig.UtilityConfig{ExtraRefs: []prowapi.Refs{{Org: org, Repo: repo, BaseRef: "master"}}}
+	}
+	jobConfig := func() *prowconfig.JobConfig {
+		return &prowconfig.JobConfig{
+			PresubmitsStatic: map[string][]prowconfig.Presubmit{
+				"org/repo":  {{JobBase: prowconfig.JobBase{Name: "pull-ci-org-repo-master-unit"}}},
+				"org/other": {{JobBase: prowconfig.JobBase{Name: "pull-ci-org-other-master-e2e", UtilityConfig: refs("org", "repo")}}},
+			},
+			PostsubmitsStatic: map[string][]prowconfig.Postsubmit{
+				"org/repo": {{JobBase: prowconfig.JobBase{Name: "branch-ci-org-repo-master-images"}}},
+			},
+			Periodics: []prowconfig.Periodic{
+				{JobBase: prowconfig.JobBase{Name: "periodic-ci-org-repo-master-nightly", UtilityConfig: refs("org", "repo")}},
+				{JobBase: prowconfig.JobBase{Name: "periodic-ci-org-other-master-nightly", UtilityConfig: refs("org", "other")}},
+			},
+		}
+	}
+	testCases := []struct {
+		name        string
+		jobConfig   *prowconfig.JobConfig
+		opts        []RenameOption
+		expected    *prowconfig.JobConfig
+		expectedErr bool
+	}{
+		{
+			name:      "repo is moved and refs are rewritten",
+			jobConfig: jobConfig(),
+			expected: &prowconfig.JobConfig{
+				PresubmitsStatic: map[string][]prowconfig.Presubmit{
+					"new/name":  {{JobBase: prowconfig.JobBase{Name: "pull-ci-org-repo-master-unit"}}},
+					"org/other": {{JobBase: prowconfig.JobBase{Name: "pull-ci-org-other-master-e2e", UtilityConfig: refs("new", "name")}}},
+				},
+				PostsubmitsStatic: map[string][]prowconfig.Postsubmit{
+					"new/name": {{JobBase: prowconfig.JobBase{Name: "branch-ci-org-repo-master-images"}}},
+				},
+				Periodics: []prowconfig.Periodic{
+					{JobBase: prowconfig.JobBase{Name: "periodic-ci-org-repo-master-nightly", UtilityConfig: refs("new", "name")}},
+					{JobBase: prowconfig.JobBase{Name: "periodic-ci-org-other-master-nightly", UtilityConfig: refs("org", "other")}},
+				},
+			},
+		},
+		{
+			name:      "job names are rewritten when asked to",
+			jobConfig: jobConfig(),
+			opts:      []RenameOption{WithRenamedJobs()},
+			expected: &prowconfig.JobConfig{
+				PresubmitsStatic: map[string][]prowconfig.Presubmit{
+					"new/name":  {{JobBase: prowconfig.JobBase{Name: "pull-ci-new-name-master-unit"}}},
+					"org/other": {{JobBase: prowconfig.JobBase{Name: "pull-ci-org-other-master-e2e", UtilityConfig: refs("new", "name")}}},
+				},
+				PostsubmitsStatic: map[string][]prowconfig.Postsubmit{
+					"new/name": {{JobBase: prowconfig.JobBase{Name: "branch-ci-new-name-master-images"}}},
+				},
+				Periodics: []prowconfig.Periodic{
+					{JobBase: prowconfig.JobBase{Name: "periodic-ci-new-name-master-nightly", UtilityConfig: refs("new", "name")}},
+					{JobBase: prowconfig.JobBase{Name: "periodic-ci-org-other-master-nightly", UtilityConfig: refs("org", "other")}},
+				},
+			},
+		},
+		{
+			name: "existing jobs for the new repo are an error",
+			jobConfig: func() *prowconfig.JobConfig {
+				c := jobConfig()
+				c.PostsubmitsStatic["new/name"] = []prowconfig.Postsubmit{{JobBase: prowconfig.JobBase{Name: "existing"}}}
+				return c
+			}(),
+			expected: func() *prowconfig.JobConfig {
+				c := jobConfig()
+				c.PostsubmitsStatic["new/name"] = []prowconfig.Postsubmit{{JobBase: prowconfig.JobBase{Name: "existing"}}}
+				return c
+			}(),
+			expectedErr: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := RenameRepo(tc.jobConfig, "org", "repo", "new", "name", tc.opts...)
+			if (err != nil) != tc.expectedErr {
+				t.Errorf("expected error: %t, got: %v", tc.expectedErr, err)
+			}
+			if diff := cmp.Diff(tc.expected, tc.jobConfig, unexportedFields...); diff != "" {
+				t.Errorf("job config differs from expected:\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestClearClusters(t *testing.T) {
+	generated := map[string]string{LabelGenerator: "prowgen"}
+	jobConfig := &prowconfig.JobConfig{
+		PresubmitsStatic: map[string][]prowconfig.Presubmit{"org/repo": {
+			{JobBase: prowconfig.JobBase{Name: "generated", Labels: generated, Cluster: "build01"}},
+			{JobBase: prowconfig.JobBase{Name: "manual", Cluster: "build01"}},
+		}},
+		PostsubmitsStatic: map[string][]prowconfig.Postsubmit{"org/repo": {
+			{JobBase: prowconfig.JobBase{Name: "generated", Labels: generated, Cluster: "build02"}},
+		}},
+		Periodics: []prowconfig.Periodic{
+			{JobBase: prowconfig.JobBase{Name: "generated", Labels: generated, Cluster: "build03"}},
+			{JobBase: prowconfig.JobBase{Name: "unassigned", Labels: generated}},
+		},
+	}
+	isGenerated := func(job prowconfig.JobBase) bool {
+		_, ok := job.Labels[LabelGenerator]
+		return ok
+	}
+
+	if cleared := ClearClusters(jobConfig, isGenerated); cleared != 3 {
+		t.Errorf("expected 3 clusters to be cleared, got %d", cleared)
+	}
+	expected := &prowconfig.JobConfig{
+		PresubmitsStatic: map[string][]prowconfig.Presubmit{"org/repo": {
+			{JobBase: prowconfig.JobBase{Name: "generated", Labels: generated}},
+			{JobBase: prowconfig.JobBase{Name: "manual", Cluster: "build01"}},
+		}},
+		PostsubmitsStatic: map[string][]prowconfig.Postsubmit{"org/repo": {
+			{JobBase: prowconfig.JobBase{Name: "generated", Labels: generated}},
+		}},
+		Periodics: []prowconfig.Periodic{
+			{JobBase: prowconfig.JobBase{Name: "generated", Labels: generated}},
+			{JobBase: prowconfig.JobBase{Name: "unassigned", Labels: generated}},
+		},
+	}
+	if diff := cmp.Diff(expected, jobConfig, unexportedFields...); diff != "" {
+		t.Errorf("job config differs from expected:\n%s", diff)
+	}
+
+	// merging generated jobs into cleared ones does not bring back the old cluster
+	MergeJobConfig(jobConfig, &prowconfig.JobConfig{
+		PresubmitsStatic: map[string][]prowconfig.Presubmit{"org/repo": {
+			{JobBase: prowconfig.JobBase{Name: "generated", Labels: generated, Cluster: "build04"}},
+		}},
+	})
+	for _, job := range jobConfig.PresubmitsStatic["org/repo"] {
+		if job.Name == "generated" && job.Cluster != "build04" {
+			t.Errorf("expected the merged presubmit to be on the generated cluster, got %q", job.Cluster)
+		}
+	}
+}
+
+func TestAssignCluster(t *testing.T) {
+	releaseController := map[string]string{ReleaseControllerLabel: ReleaseControllerValue}
+	jobConfig := &prowconfig.JobConfig{
+		PresubmitsStatic: map[string][]prowconfig.Presubmit{"org/repo": {
+			{JobBase: prowconfig.JobBase{Name: "release", Labels: releaseController, Cluster: "build01"}},
+			{JobBase: prowconfig.JobBase{Name: "other", Cluster: "build01"}},
+		}},
+		PostsubmitsStatic: map[string][]prowconfig.Postsubmit{"org/repo": {
+			{JobBase: prowconfig.JobBase{Name: "release", Labels: releaseController}},
+		}},
+		Periodics: []prowconfig.Periodic{
+			{JobBase: prowconfig.JobBase{Name: "release", Labels: releaseController, Cluster: "build02"}},
+			{JobBase: prowconfig.JobBase{Name: "pinned", Labels: releaseController, Cluster: "dedicated"}},
+		},
+	}
+	isRelease := func(job prowconfig.JobBase) bool {
+		return job.Labels[ReleaseControllerLabel] == ReleaseControllerValue
+	}
+
+	if changed := AssignCluster(jobConfig, "dedicated", isRelease); changed != 3 {
+		t.Errorf("expected 3 jobs to change cluster, got %d", changed)
+	}
+	expected := &prowconfig.JobConfig{
+		PresubmitsStatic: map[string][]prowconfig.Presubmit{"org/repo": {
+			{JobBase: prowconfig.JobBase{Name: "release", Labels: releaseController, Cluster: "dedicated"}},
+			{JobBase: prowconfig.JobBase{Name: "other", Cluster: "build01"}},
+		}},
+		PostsubmitsStatic: map[string][]prowconfig.Postsubmit{"org/repo": {
+			{JobBase: prowconfig.JobBase{Name: "release", Labels: releaseController, Cluster: "dedicated"}},
+		}},
+		Periodics: []prowconfig.Periodic{
+			{JobBase: prowconfig.JobBase{Name: "release", Labels: releaseController, Cluster: "dedicated"}},
+			{JobBase: prowconfig.JobBase{Name: "pinned", Labels: releaseController, Cluster: "dedicated"}},
+		},
+	}
+	if diff := cmp.Diff(expected, jobConfig, unexportedFields...); diff != "" {
+		t.Errorf("job config differs from expected:\n%s", diff)
+	}
+}
+
+func TestMutateJobConfigDir(t *testing.T) {
+	dir := t.TempDir()
+	writeJobConfigs(t, dir, map[string]*prowconfig.JobConfig{
+		"org/repo/org-repo-master-presubmits.yaml": {
+			PresubmitsStatic: map[string][]prowconfig.Presubmit{"org/repo": {
+				{JobBase: prowconfig.JobBase{Name: "presubmit", Labels: map[string]string{"team": "ci"}}, Reporter: prowconfig.Reporter{Context: "ci/prow/presubmit"}},
+			}},
+		},
+		"org/repo/org-repo-master-postsubmits.yaml": {
+			PostsubmitsStatic: map[string][]prowconfig.Postsubmit{"org/repo": {
+				{JobBase: prowconfig.JobBase{Name: "postsubmit", Labels: map[string]string{"team": "CI"}}},
+			}},
+		},
+		"org/other/org-other-master-periodics.yaml": {
+			Periodics: []prowconfig.Periodic{{JobBase: prowconfig.JobBase{Name: "periodic", Labels: map[string]string{"team": "art"}}, Interval: "24h"}},
+		},
+	})
+	unchangedPath := filepath.Join(dir, "org/repo/org-repo-master-postsubmits.yaml")
+	// make the file that should not be rewritten differ from what would be written
+	if err := os.WriteFile(unchangedPath, []byte("postsubmits:\n  org/repo:\n  - name: postsubmit\n    labels:\n      team: CI\n"), 0644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	unchanged, err := os.ReadFile(unchangedPath)
+	if err != nil {
+		t.Fatalf("failed to read file: %v", err)
+	}
+
+	upper := func(labels map[string]string) bool {
+		if team, ok := labels["team"]; ok && team != strings.ToUpper(team) {
+			labels["team"] = strings.ToUpper(team)
+			return true
+		}
+		return false
+	}
+	if err := MutateJobConfigDir(dir, func(jobConfig *prowconfig.JobConfig, _ *Info) (bool, error) {
+		var changed bool
+		for _, jobs := range jobConfig.PresubmitsStatic {
+			for _, job := range jobs {
+				changed = upper(job.Labels) || changed
+			}
+		}
+		for _, jobs := range jobConfig.PostsubmitsStatic {
+			for _, job := range jobs {
+				changed = upper(job.Labels) || changed
+			}
+		}
+		for _, job := range jobConfig.Periodics {
+			changed = upper(job.Labels) || changed
+		}
+		return changed, nil
+	}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	after, err := os.ReadFile(unchangedPath)
+	if err != nil {
+		t.Fatalf("failed to read file: %v", err)
+	}
+	if diff := cmp.Diff(string(unchanged), string(after)); diff != "" {
+		t.Errorf("unchanged file was rewritten:\n%s", diff)
+	}
+	expected := map[string]*prowconfig.JobConfig{
+		"org/repo/org-repo-master-presubmits.yaml": {
+			PresubmitsStatic: map[string][]prowconfig.Presubmit{"org/repo": {
+				{JobBase: prowconfig.JobBase{Name: "presubmit", Labels: map[string]string{"team": "CI"}}, Reporter: prowconfig.Reporter{Context: "ci/prow/presubmit"}},
+			}},
+		},
+		"org/repo/org-repo-master-postsubmits.yaml": {
+			PostsubmitsStatic: map[string][]prowconfig.Postsubmit{"org/repo": {
+				{JobBase: prowconfig.JobBase{Name: "postsubmit", Labels: map[string]string{"team": "CI"}}},
+			}},
+		},
+		"org/other/org-other-master-periodics.yaml": {
+			Periodics: []prowconfig.Periodic{{JobBase: prowconfig.JobBase{Name: "periodic", Labels: map[string]string{"team": "ART"}}, Interval: "24h"}},
+		},
+	}
+	if diff := cmp.Diff(expected, readJobConfigs(t, dir), unexportedFields...); diff != "" {
+		t.Errorf("job configs differ from expected:\n%s", diff)
+	}
+	if entries, err := os.ReadDir(filepath.Join(dir, "org/repo")); err != nil {
+		t.Fatalf("failed to list directory: %v", err)
+	} else if len(entries) != 2 {
+		t.Errorf("expected no temporary files to be left behind, got %d entries", len(entries))
+	}
+}
@@ -0,0 +1,459 @@
+package jobconfig
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+	prowapi "k8s.io/test-infra/prow/apis/prowjobs/v1"
+	prowconfig "k8s.io/test-infra/prow/config"
+)
+
+// SpecDuplicates is a group of jobs of the same type that are identical
+// except for their names
+type SpecDuplicates struct {
+	// Type is the type of the jobs in the group
+	Type string
+	// Repo is the org/repo the jobs are configured for, empty for periodics
+	Repo string
+	// Names are the sorted names of the jobs in the group
+	Names []string
+}
+
+// FindSpecDuplicates finds groups of jobs that have different names but are
+// otherwise identical. Fields that are derived from the job name, like the
+// presubmit context, trigger and rerun command, are ignored when comparing.
+func FindSpecDuplicates(jobConfig *prowconfig.JobConfig) ([]SpecDuplicates, error) {
+	type groupKey struct{ jobType, repo string }
+	groups := map[groupKey]map[string]sets.String{}
+	add := func(group groupKey, name string, job interface{}) error {
+		hash, err := hashJob(job)
+		if err != nil {
+			return fmt.Errorf("failed to hash job %s: %w", name, err)
+		}
+		if groups[group] == nil {
+			groups[group] = map[string]sets.String{}
+		}
+		if groups[group][hash] == nil {
+			groups[group][hash] = sets.NewString()
+		}
+		groups[group][hash].Insert(name)
+		return nil
+	}
+	for repo, jobs := range jobConfig.PresubmitsStatic {
+		for _, job := range jobs {
+			name := job.Name
+			job.Name, job.Context, job.Trigger, job.RerunCommand = "", "", "", ""
+			if err := add(groupKey{jobType: "presubmits", repo: repo}, name, job); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for repo, jobs := range jobConfig.PostsubmitsStatic {
+		for _, job := range jobs {
+			name := job.Name
+			job.Name, job.Context = "", ""
+			if err := add(groupKey{jobType: "postsubmits", repo: repo}, name, job); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, job := range jobConfig.Periodics {
+		name := job.Name
+		job.Name = ""
+		if err := add(groupKey{jobType: "periodics"}, name, job); err != nil {
+			return nil, err
+		}
+	}
+
+	var duplicates []SpecDuplicates
+	for group, byHash := range groups {
+		for _, names := range byHash {
+			// the same job listed more than once is not a renamed duplicate
+			if names.Len() < 2 {
+				continue
+			}
+			duplicates = append(duplicates, SpecDuplicates{Type: group.jobType, Repo: group.repo, Names: names.List()})
+		}
+	}
+	sort.Slice(duplicates, func(i, j int) bool {
+		if duplicates[i].Type != duplicates[j].Type {
+			return duplicates[i].Type < duplicates[j].Type
+		}
+		if duplicates[i].Repo != duplicates[j].Repo {
+			return duplicates[i].Repo < duplicates[j].Repo
+		}
+		return duplicates[i].Names[0] < duplicates[j].Names[0]
+	})
+	return duplicates, nil
+}
+
+// HashJobConfig returns a hash of the canonical serialized form of the job
+// config: jobs and their pod specs are sorted like when writing to disk and
+// maps, like labels and annotations, are serialized with their keys sorted, so
+// that equal configurations hash the same however they were assembled. The job
+// config is not modified.
+func HashJobConfig(jobConfig *prowconfig.JobConfig) (string, error) {
+	clone := CloneJobConfig(jobConfig)
+	SortJobConfig(clone)
+	return hashCanonical(clone)
+}
+
+// hashCanonical hashes the JSON serialization of obj. encoding/json always
+// serializes map keys in sorted order, which makes the serialization of
+// labels and annotations stable regardless of the order they were set in.
+func hashCanonical(obj interface{}) (string, error) {
+	raw, err := json.Marshal(obj)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(raw)), nil
+}
+
+// hashJob returns a hash of the canonical serialized form of a job. The job
+// is passed by value, its pod spec is copied before being sorted.
+func hashJob(job interface{}) (string, error) {
+	switch j := job.(type) {
+	case prowconfig.Presubmit:
+		if j.Spec != nil {
+			j.Spec = j.Spec.DeepCopy()
+			sortPodSpec(j.Spec)
+		}
+		job = j
+	case prowconfig.Postsubmit:
+		if j.Spec != nil {
+			j.Spec = j.Spec.DeepCopy()
+			sortPodSpec(j.Spec)
+		}
+		job = j
+	case prowconfig.Periodic:
+		if j.Spec != nil {
+			j.Spec = j.Spec.DeepCopy()
+			sortPodSpec(j.Spec)
+		}
+		job = j
+	}
+	return hashCanonical(job)
+}
+
+// JobSetDiff holds the jobs of a kind that differ between two job configs.
+// Presubmits and postsubmits are identified as org/repo/name, followed by
+// @ and their comma-separated branches when they are configured for any, and
+// periodics by their name.
+type JobSetDiff struct {
+	Added   sets.String
+	Removed sets.String
+	Changed sets.String
+}
+
+// JobConfigDiff holds the differences between two job configs, per job kind
+type JobConfigDiff struct {
+	Presubmits  JobSetDiff
+	Postsubmits JobSetDiff
+	Periodics   JobSetDiff
+}
+
+// DiffJobConfig determines which jobs were added, removed or changed going
+// from old to new. Presubmits and postsubmits are matched by repo, name and
+// branches, periodics by name; a job is changed when its canonical
+// serialization differs.
+func DiffJobConfig(old, new *prowconfig.JobConfig) (JobConfigDiff, error) {
+	hashes := func(jobConfig *prowconfig.JobConfig) (presubmits, postsubmits, periodics map[string]string, err error) {
+		presubmits, postsubmits, periodics = map[string]string{}, map[string]string{}, map[string]string{}
+		for repo, jobs := range jobConfig.PresubmitsStatic {
+			for _, job := range jobs {
+				if presubmits[repo+"/"+jobIdentity(job.Name, job.Brancher)], err = hashJob(job); err != nil {
+					return nil, nil, nil, fmt.Errorf("failed to hash presubmit %s: %w", job.Name, err)
+				}
+			}
+		}
+		for repo, jobs := range jobConfig.PostsubmitsStatic {
+			for _, job := range jobs {
+				if postsubmits[repo+"/"+jobIdentity(job.Name, job.Brancher)], err = hashJob(job); err != nil {
+					return nil, nil, nil, fmt.Errorf("failed to hash postsubmit %s: %w", job.Name, err)
+				}
+			}
+		}
+		for _, job := range jobConfig.Periodics {
+			if periodics[job.Name], err = hashJob(job); err != nil {
+				return nil, nil, nil, fmt.Errorf("failed to hash periodic %s: %w", job.Name, err)
+			}
+		}
+		return presubmits, postsubmits, periodics, nil
+	}
+	oldPresubmits, oldPostsubmits, oldPeriodics, err := hashes(old)
+	if err != nil {
+		return JobConfigDiff{}, err
+	}
+	newPresubmits, newPostsubmits, newPeriodics, err := hashes(new)
+	if err != nil {
+		return JobConfigDiff{}, err
+	}
+	return JobConfigDiff{
+		Presubmits:  diffJobHashes(oldPresubmits, newPresubmits),
+		Postsubmits: diffJobHashes(oldPostsubmits, newPostsubmits),
+		Periodics:   diffJobHashes(oldPeriodics, newPeriodics),
+	}, nil
+}
+
+func diffJobHashes(old, new map[string]string) JobSetDiff {
+	diff := JobSetDiff{
+		Added:   sets.StringKeySet(new).Difference(sets.StringKeySet(old)),
+		Removed: sets.StringKeySet(old).Difference(sets.StringKeySet(new)),
+		Changed: sets.NewString(),
+	}
+	for name, hash := range new {
+		if oldHash, ok := old[name]; ok && oldHash != hash {
+			diff.Changed.Insert(name)
+		}
+	}
+	return diff
+}
+
+// JobRelease returns the release a job is configured for, as recorded in
+// its JobReleaseKey label, or an empty string when the label is not set
+func JobRelease(job prowconfig.JobBase) string {
+	return job.Labels[JobReleaseKey]
+}
+
+// ReleasesInDir returns the distinct releases that jobs configured in dir are
+// labeled with. Jobs without a release label are ignored.
+func ReleasesInDir(dir string) (sets.String, error) {
+	releases := sets.NewString()
+	insert := func(job prowconfig.JobBase) {
+		if release := JobRelease(job); release != "" {
+			releases.Insert(release)
+		}
+	}
+	if err := OperateOnJobConfigDir(dir, func(jobConfig *prowconfig.JobConfig, _ *Info) error {
+		for _, jobs := range jobConfig.PresubmitsStatic {
+			for _, job := range jobs {
+				insert(job.JobBase)
+			}
+		}
+		for _, jobs := range jobConfig.PostsubmitsStatic {
+			for _, job := range jobs {
+				insert(job.JobBase)
+			}
+		}
+		for _, job := range jobConfig.Periodics {
+			insert(job.JobBase)
+		}
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("failed to collect releases: %w", err)
+	}
+	return releases, nil
+}
+
+// CollectGCSBuckets returns the sorted, distinct GCS buckets that jobs upload
+// their artifacts to. Jobs without decoration or GCS configuration are ignored.
+func CollectGCSBuckets(jobConfig *prowconfig.JobConfig) []string {
+	buckets := sets.NewString()
+	forEachJob(jobConfig, func(_, _ string, job prowconfig.JobBase) {
+		if job.DecorationConfig == nil || job.DecorationConfig.GCSConfiguration == nil {
+			return
+		}
+		if bucket := job.DecorationConfig.GCSConfiguration.Bucket; bucket != "" {
+			buckets.Insert(bucket)
+		}
+	})
+	return buckets.List()
+}
+
+// broadRunIfChangedProbes are unrelated paths that a run_if_changed pattern
+// matching all of them would match for virtually any change
+var broadRunIfChangedProbes = []string{"README.md", "x", "docs/index.md", "pkg/util/util.go"}
+
+// BroadRunIfChanged is a group of presubmits of a repo that run for virtually
+// every change even though they are configured to run conditionally
+type BroadRunIfChanged struct {
+	// Repo is the org/repo the jobs are configured for
+	Repo string
+	// Jobs are the sorted names of the presubmits in the group
+	Jobs []string
+}
+
+// FindBroadRunIfChanged finds, for every repo, the presubmits whose
+// run_if_changed pattern matches trivial, unrelated paths and therefore
+// always trigger together. Such jobs should either always run or have a
+// narrower pattern. Patterns that do not compile are ignored. The result is
+// meant as advice rather than as a validation failure.
+func FindBroadRunIfChanged(jobConfig *prowconfig.JobConfig) []BroadRunIfChanged {
+	var groups []BroadRunIfChanged
+	for _, repo := range sets.StringKeySet(jobConfig.PresubmitsStatic).List() {
+		var jobs []string
+		for _, job := range jobConfig.PresubmitsStatic[repo] {
+			if job.RunIfChanged == "" {
+				continue
+			}
+			re, err := regexp.Compile(job.RunIfChanged)
+			if err != nil {
+				continue
+			}
+			broad := true
+			for _, probe := range broadRunIfChangedProbes {
+				if !re.MatchString(probe) {
+					broad = false
+					break
+				}
+			}
+			if broad {
+				jobs = append(jobs, job.Name)
+			}
+		}
+		if len(jobs) > 0 {
+			sort.Strings(jobs)
+			groups = append(groups, BroadRunIfChanged{Repo: repo, Jobs: jobs})
+		}
+	}
+	return groups
+}
+
+// OrgStats counts the jobs configured for the repos of an org
+type OrgStats struct {
+	Total       int
+	Presubmits  int
+	Postsubmits int
+	Periodics   int
+	// Generated counts the jobs labeled as generated by any generator
+	Generated int
+	// Manual counts the jobs that are not generated
+	Manual int
+}
+
+// add counts a job of the type described by forEachJob
+func (s *OrgStats) add(jobType, _ string, job prowconfig.JobBase) {
+	switch jobType {
+	case "presubmit":
+		s.Presubmits++
+	case "postsubmit":
+		s.Postsubmits++
+	case "periodic":
+		s.Periodics++
+	}
+	if _, generated := job.Labels[LabelGenerator]; generated {
+		s.Generated++
+	} else {
+		s.Manual++
+	}
+	s.Total++
+}
+
+// JobConfigStats counts the jobs in a job config
+type JobConfigStats struct {
+	OrgStats
+	// Clusters counts the jobs scheduled on each cluster, jobs that do not
+	// set one are counted for the default cluster Prow schedules them on
+	Clusters map[string]int
+}
+
+// Stats counts the jobs in the job config by type, by whether they are
+// generated and by the cluster they are scheduled on
+func Stats(jobConfig *prowconfig.JobConfig) JobConfigStats {
+	stats := JobConfigStats{Clusters: map[string]int{}}
+	forEachJob(jobConfig, func(jobType, repo string, job prowconfig.JobBase) {
+		stats.add(jobType, repo, job)
+		cluster := job.Cluster
+		if cluster == "" {
+			cluster = prowapi.DefaultClusterAlias
+		}
+		stats.Clusters[cluster]++
+	})
+	return stats
+}
+
+// OrgRollup counts the jobs in dir per org, bucketing them by the org
+// directory their files are filed under
+func OrgRollup(dir string) (map[string]OrgStats, error) {
+	rollup := map[string]OrgStats{}
+	if err := OperateOnJobConfigDir(dir, func(jobConfig *prowconfig.JobConfig, info *Info) error {
+		stats := rollup[info.Org]
+		forEachJob(jobConfig, stats.add)
+		rollup[info.Org] = stats
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("failed to count jobs: %w", err)
+	}
+	return rollup, nil
+}
+
+// ClustersInDir returns the clusters the jobs in dir are scheduled on. Jobs
+// that do not set a cluster are recorded as scheduled on the default cluster,
+// like in Stats.
+func ClustersInDir(dir string) (sets.String, error) {
+	clusters := sets.NewString()
+	if err := OperateOnJobConfigDir(dir, func(jobConfig *prowconfig.JobConfig, _ *Info) error {
+		forEachJob(jobConfig, func(_, _ string, job prowconfig.JobBase) {
+			cluster := job.Cluster
+			if cluster == "" {
+				cluster = prowapi.DefaultClusterAlias
+			}
+			clusters.Insert(cluster)
+		})
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("failed to collect clusters: %w", err)
+	}
+	return clusters, nil
+}
+
+// ScheduleBucket is a group of periodics sharing the same schedule
+type ScheduleBucket struct {
+	// Schedule describes the shared schedule, like `cron: 0 0 * * *` or `interval: 24h0m0s`
+	Schedule string
+	// Jobs are the sorted names of the periodics in the bucket
+	Jobs []string
+}
+
+// AnalyzePeriodicSchedules groups periodics by their schedule and returns the
+// groups holding more than maxBucketSize jobs, largest first. Many periodics
+// sharing a schedule fire at the same instant and can overload the build farm,
+// so the result is meant as advice rather than as a validation failure.
+func AnalyzePeriodicSchedules(jobConfig *prowconfig.JobConfig, maxBucketSize int) []ScheduleBucket {
+	schedules := map[string][]string{}
+	for _, job := range jobConfig.Periodics {
+		schedule := periodicSchedule(job)
+		schedules[schedule] = append(schedules[schedule], job.Name)
+	}
+	var buckets []ScheduleBucket
+	for schedule, jobs := range schedules {
+		if len(jobs) <= maxBucketSize {
+			continue
+		}
+		sort.Strings(jobs)
+		buckets = append(buckets, ScheduleBucket{Schedule: schedule, Jobs: jobs})
+	}
+	sort.Slice(buckets, func(i, j int) bool {
+		if len(buckets[i].Jobs) != len(buckets[j].Jobs) {
+			return len(buckets[i].Jobs) > len(buckets[j].Jobs)
+		}
+		return buckets[i].Schedule < buckets[j].Schedule
+	})
+	return buckets
+}
+
+// periodicSchedule describes the schedule of a periodic, normalizing
+// intervals so that equal durations spelled differently compare equal
+func periodicSchedule(job prowconfig.Periodic) string {
+	normalize := func(interval string) string {
+		if d, err := time.ParseDuration(interval); err == nil {
+			return d.String()
+		}
+		return interval
+	}
+	switch {
+	case job.Cron != "":
+		return fmt.Sprintf("cron: %s", job.Cron)
+	case job.Interval != "":
+		return fmt.Sprintf("interval: %s", normalize(job.Interval))
+	case job.MinimumInterval != "":
+		return fmt.Sprintf("minimum_interval: %s", normalize(job.MinimumInterval))
+	default:
+		return "none"
+	}
+}
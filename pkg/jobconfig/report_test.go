@@ -0,0 +1,433 @@
+package jobconfig
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	prowv1 "k8s.io/test-infra/prow/apis/prowjobs/v1"
+	prowconfig "k8s.io/test-infra/prow/config"
+)
+
+func TestFindSpecDuplicates(t *testing.T) {
+	spec := func(args ...string) *v1.PodSpec {
+		return &v1.PodSpec{Containers: []v1.Container{{Name: "test", Command: []string{"ci-operator"}, Args: args}}}
+	}
+	testCases := []struct {
+		name      string
+		jobConfig *prowconfig.JobConfig
+		expected  []SpecDuplicates
+	}{
+		{
+			name: "presubmits differing only in name-derived fields are duplicates",
+			jobConfig: &prowconfig.JobConfig{
+				PresubmitsStatic: map[string][]prowconfig.Presubmit{"org/repo": {
+					{JobBase: prowconfig.JobBase{Name: "pull-ci-org-repo-master-unit", Spec: spec("--target=unit", "--a")}, Reporter: prowconfig.Reporter{Context: "ci/prow/unit"}},
+					{JobBase: prowconfig.JobBase{Name: "pull-ci-org-repo-master-unit-renamed", Spec: spec("--a", "--target=unit")}, Reporter: prowconfig.Reporter{Context: "ci/prow/unit-renamed"}},
+				}},
+			},
+			expected: []SpecDuplicates{{Type: "presubmits", Repo: "org/repo", Names: []string{"pull-ci-org-repo-master-unit", "pull-ci-org-repo-master-unit-renamed"}}},
+		},
+		{
+			name: "jobs differing in one field are not duplicates",
+			jobConfig: &prowconfig.JobConfig{
+				PostsubmitsStatic: map[string][]prowconfig.Postsubmit{"org/repo": {
+					{JobBase: prowconfig.JobBase{Name: "branch-ci-org-repo-master-images", Spec: spec("--target=[images]")}},
+					{JobBase: prowconfig.JobBase{Name: "branch-ci-org-repo-master-images-2", Spec: spec("--target=[images]"), Cluster: "build01"}},
+				}},
+				Periodics: []prowconfig.Periodic{
+					{JobBase: prowconfig.JobBase{Name: "periodic-a", Spec: spec("--target=e2e")}, Interval: "24h"},
+					{JobBase: prowconfig.JobBase{Name: "periodic-b", Spec: spec("--target=e2e")}, Interval: "12h"},
+				},
+			},
+		},
+		{
+			name: "identical jobs in different repos are not duplicates",
+			jobConfig: &prowconfig.JobConfig{
+				PresubmitsStatic: map[string][]prowconfig.Presubmit{
+					"org/repo":  {{JobBase: prowconfig.JobBase{Name: "a", Spec: spec("--target=unit")}}},
+					"org/other": {{JobBase: prowconfig.JobBase{Name: "b", Spec: spec("--target=unit")}}},
+				},
+			},
+		},
+		{
+			name: "periodics identical but for the name are duplicates",
+			jobConfig: &prowconfig.JobConfig{
+				Periodics: []prowconfig.Periodic{
+					{JobBase: prowconfig.JobBase{Name: "periodic-b", Spec: spec("--target=e2e")}, Interval: "24h"},
+					{JobBase: prowconfig.JobBase{Name: "periodic-a", Spec: spec("--target=e2e")}, Interval: "24h"},
+					{JobBase: prowconfig.JobBase{Name: "periodic-c", Spec: spec("--target=other")}, Interval: "24h"},
+				},
+			},
+			expected: []SpecDuplicates{{Type: "periodics", Names: []string{"periodic-a", "periodic-b"}}},
+		},
+		{
+			name: "a job repeated under the same name is not a duplicate",
+			jobConfig: &prowconfig.JobConfig{
+				PresubmitsStatic: map[string][]prowconfig.Presubmit{"org/repo": {
+					{JobBase: prowconfig.JobBase{Name: "unit", Spec: spec("--target=unit")}},
+					{JobBase: prowconfig.JobBase{Name: "unit", Spec: spec("--target=unit")}},
+				}},
+			},
+		},
+		{
+			name: "a repeated job is listed once among its duplicates",
+			jobConfig: &prowconfig.JobConfig{
+				PresubmitsStatic: map[string][]prowconfig.Presubmit{"org/repo": {
+					{JobBase: prowconfig.JobBase{Name: "unit", Spec: spec("--target=unit")}},
+					{JobBase: prowconfig.JobBase{Name: "unit", Spec: spec("--target=unit")}},
+					{JobBase: prowconfig.JobBase{Name: "unit-renamed", Spec: spec("--target=unit")}},
+				}},
+			},
+			expected: []SpecDuplicates{{Type: "presubmits", Repo: "org/repo", Names: []string{"unit", "unit-renamed"}}},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			duplicates, err := FindSpecDuplicates(tc.jobConfig)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(tc.expected, duplicates); diff != "" {
+				t.Errorf("duplicates differ from expected:\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestDiffJobConfig(t *testing.T) {
+	presubmit := func(name, branch, agent string) prowconfig.Presubmit {
+		return prowconfig.Presubmit{JobBase: prowconfig.JobBase{Name: name, Agent: agent}, Brancher: prowconfig.Brancher{Branches: []string{branch}}}
+	}
+	old := &prowconfig.JobConfig{
+		PresubmitsStatic: map[string][]prowconfig.Presubmit{
+			"org/repo": {
+				{JobBase: prowconfig.JobBase{Name: "same", Labels: map[string]string{"a": "1", "b": "2"}}},
+				{JobBase: prowconfig.JobBase{Name: "changed", Agent: "kubernetes"}},
+				{JobBase: prowconfig.JobBase{Name: "removed"}},
+				presubmit("unit", "master", "kubernetes"),
+				presubmit("unit", "release-4.1", "kubernetes"),
+			},
+			"org/other": {presubmit("unit", "master", "kubernetes")},
+		},
+		Periodics: []prowconfig.Periodic{{JobBase: prowconfig.JobBase{Name: "periodic"}, Interval: "1h"}},
+	}
+	new := &prowconfig.JobConfig{
+		PresubmitsStatic: map[string][]prowconfig.Presubmit{
+			"org/repo": {
+				{JobBase: prowconfig.JobBase{Name: "added"}},
+				{JobBase: prowconfig.JobBase{Name: "changed", Agent: "tekton-pipeline"}},
+				{JobBase: prowconfig.JobBase{Name: "same", Labels: map[string]string{"b": "2", "a": "1"}}},
+				presubmit("unit", "master", "kubernetes"),
+				presubmit("unit", "release-4.1", "tekton-pipeline"),
+			},
+			"org/other": {presubmit("unit", "master", "kubernetes")},
+			"org/third": {presubmit("unit", "master", "kubernetes")},
+		},
+		PostsubmitsStatic: map[string][]prowconfig.Postsubmit{"org/repo": {{JobBase: prowconfig.JobBase{Name: "postsubmit"}}}},
+		Periodics:         []prowconfig.Periodic{{JobBase: prowconfig.JobBase{Name: "periodic"}, Interval: "2h"}},
+	}
+	diff, err := DiffJobConfig(old, new)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := JobConfigDiff{
+		Presubmits: JobSetDiff{
+			Added:   sets.NewString("org/repo/added", "org/third/unit@master"),
+			Removed: sets.NewString("org/repo/removed"),
+			Changed: sets.NewString("org/repo/changed", "org/repo/unit@release-4.1"),
+		},
+		Postsubmits: JobSetDiff{Added: sets.NewString("org/repo/postsubmit"), Removed: sets.NewString(), Changed: sets.NewString()},
+		Periodics:   JobSetDiff{Added: sets.NewString(), Removed: sets.NewString(), Changed: sets.NewString("periodic")},
+	}
+	if d := cmp.Diff(expected, diff); d != "" {
+		t.Errorf("diff differs from expected:\n%s", d)
+	}
+}
+
+func TestReleasesInDir(t *testing.T) {
+	dir := t.TempDir()
+	writeJobConfigs(t, dir, map[string]*prowconfig.JobConfig{
+		"org/repo/org-repo-release-4.12-presubmits.yaml": {
+			PresubmitsStatic: map[string][]prowconfig.Presubmit{"org/repo": {
+				{JobBase: prowconfig.JobBase{Name: "a", Labels: map[string]string{JobReleaseKey: "4.12"}}},
+				{JobBase: prowconfig.JobBase{Name: "b"}},
+			}},
+		},
+		"org/repo/org-repo-release-4.13-postsubmits.yaml": {
+			PostsubmitsStatic: map[string][]prowconfig.Postsubmit{"org/repo": {
+				{JobBase: prowconfig.JobBase{Name: "c", Labels: map[string]string{JobReleaseKey: "4.13"}}},
+			}},
+		},
+		"org/repo/org-repo-periodics.yaml": {
+			Periodics: []prowconfig.Periodic{
+				{JobBase: prowconfig.JobBase{Name: "d", Labels: map[string]string{JobReleaseKey: "4.12"}}},
+				{JobBase: prowconfig.JobBase{Name: "e", Labels: map[string]string{JobReleaseKey: "4.11"}}},
+			},
+		},
+	})
+	releases, err := ReleasesInDir(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if diff := cmp.Diff([]string{"4.11", "4.12", "4.13"}, releases.List()); diff != "" {
+		t.Errorf("releases differ from expected:\n%s", diff)
+	}
+}
+
+func TestCollectGCSBuckets(t *testing.T) {
+	decorated := func(name, bucket string) prowconfig.JobBase {
+		return prowconfig.JobBase{Name: name, UtilityConfig: prowconfig.UtilityConfig{
+			DecorationConfig: &prowv1.DecorationConfig{GCSConfiguration: &prowv1.GCSConfiguration{Bucket: bucket}},
+		}}
+	}
+	jobConfig := &prowconfig.JobConfig{
+		PresubmitsStatic: map[string][]prowconfig.Presubmit{"org/repo": {
+			{JobBase: decorated("a", "gs://origin-ci-test")},
+			{JobBase: prowconfig.JobBase{Name: "undecorated"}},
+		}},
+		PostsubmitsStatic: map[string][]prowconfig.Postsubmit{"org/repo": {
+			{JobBase: decorated("b", "s3://legacy")},
+			{JobBase: prowconfig.JobBase{Name: "no-gcs", UtilityConfig: prowconfig.UtilityConfig{DecorationConfig: &prowv1.DecorationConfig{}}}},
+		}},
+		Periodics: []prowconfig.Periodic{
+			{JobBase: decorated("c", "gs://origin-ci-test")},
+			{JobBase: decorated("d", "")},
+		},
+	}
+	expected := []string{"gs://origin-ci-test", "s3://legacy"}
+	if diff := cmp.Diff(expected, CollectGCSBuckets(jobConfig)); diff != "" {
+		t.Errorf("buckets differ from expected:\n%s", diff)
+	}
+}
+
+func TestFindBroadRunIfChanged(t *testing.T) {
+	presubmit := func(name, runIfChanged string) prowconfig.Presubmit {
+		return prowconfig.Presubmit{
+			JobBase:             prowconfig.JobBase{Name: name},
+			RegexpChangeMatcher: prowconfig.RegexpChangeMatcher{RunIfChanged: runIfChanged},
+		}
+	}
+	jobConfig := &prowconfig.JobConfig{PresubmitsStatic: map[string][]prowconfig.Presubmit{
+		"org/repo": {
+			presubmit("everything", ".*"),
+			presubmit("anything", "^."),
+			presubmit("go", `\.go$`),
+			presubmit("docs", "^docs/"),
+			presubmit("always", ""),
+			presubmit("invalid", "(.*"),
+		},
+		"org/narrow": {
+			presubmit("images", "^images/"),
+			presubmit("manifests", `^manifests/.*\.yaml$`),
+		},
+		"org/other": {
+			presubmit("all", "."),
+		},
+	}}
+	expected := []BroadRunIfChanged{
+		{Repo: "org/other", Jobs: []string{"all"}},
+		{Repo: "org/repo", Jobs: []string{"anything", "everything"}},
+	}
+	if diff := cmp.Diff(expected, FindBroadRunIfChanged(jobConfig)); diff != "" {
+		t.Errorf("broad run_if_changed groups differ from expected:\n%s", diff)
+	}
+}
+
+func TestOrgRollup(t *testing.T) {
+	dir := t.TempDir()
+	generated := map[string]string{LabelGenerator: "prowgen"}
+	writeJobConfigs(t, dir, map[string]*prowconfig.JobConfig{
+		"org/repo/org-repo-master-presubmits.yaml": {
+			PresubmitsStatic: map[string][]prowconfig.Presubmit{"org/repo": {
+				{JobBase: prowconfig.JobBase{Name: "generated", Labels: generated}},
+				{JobBase: prowconfig.JobBase{Name: "manual"}},
+			}},
+		},
+		"org/other/org-other-master-postsubmits.yaml": {
+			PostsubmitsStatic: map[string][]prowconfig.Postsubmit{"org/other": {
+				{JobBase: prowconfig.JobBase{Name: "generated", Labels: generated}},
+			}},
+		},
+		"org/other/org-other-master-periodics.yaml": {
+			Periodics: []prowconfig.Periodic{{JobBase: prowconfig.JobBase{Name: "manual"}}},
+		},
+		"another/repo/another-repo-master-periodics.yaml": {
+			Periodics: []prowconfig.Periodic{
+				{JobBase: prowconfig.JobBase{Name: "generated", Labels: map[string]string{LabelGenerator: "cluster-init"}}},
+				{JobBase: prowconfig.JobBase{Name: "manual"}},
+			},
+		},
+	})
+
+	rollup, err := OrgRollup(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := map[string]OrgStats{
+		"org":     {Total: 4, Presubmits: 2, Postsubmits: 1, Periodics: 1, Generated: 2, Manual: 2},
+		"another": {Total: 2, Periodics: 2, Generated: 1, Manual: 1},
+	}
+	if diff := cmp.Diff(expected, rollup); diff != "" {
+		t.Errorf("rollup differs from expected:\n%s", diff)
+	}
+}
+
+func TestClustersInDir(t *testing.T) {
+	dir := t.TempDir()
+	writeJobConfigs(t, dir, map[string]*prowconfig.JobConfig{
+		"org/repo/org-repo-master-presubmits.yaml": {
+			PresubmitsStatic: map[string][]prowconfig.Presubmit{"org/repo": {
+				{JobBase: prowconfig.JobBase{Name: "scheduled", Cluster: "build01"}},
+				{JobBase: prowconfig.JobBase{Name: "unscheduled"}},
+			}},
+		},
+		"org/repo/org-repo-master-postsubmits.yaml": {
+			PostsubmitsStatic: map[string][]prowconfig.Postsubmit{"org/repo": {
+				{JobBase: prowconfig.JobBase{Name: "scheduled", Cluster: "build02"}},
+			}},
+		},
+		"another/repo/another-repo-periodics.yaml": {
+			Periodics: []prowconfig.Periodic{
+				{JobBase: prowconfig.JobBase{Name: "scheduled", Cluster: "build01"}},
+			},
+		},
+	})
+
+	clusters, err := ClustersInDir(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// the unscheduled presubmit runs on the default cluster
+	if diff := cmp.Diff([]string{"build01", "build02", prowv1.DefaultClusterAlias}, clusters.List()); diff != "" {
+		t.Errorf("clusters differ from expected:\n%s", diff)
+	}
+}
+
+func TestStats(t *testing.T) {
+	generated := map[string]string{LabelGenerator: "prowgen"}
+	jobConfig := &prowconfig.JobConfig{
+		PresubmitsStatic: map[string][]prowconfig.Presubmit{
+			"org/repo": {
+				{JobBase: prowconfig.JobBase{Name: "generated", Labels: generated, Cluster: "build01"}},
+				{JobBase: prowconfig.JobBase{Name: "manual"}},
+			},
+			"org/other": {{JobBase: prowconfig.JobBase{Name: "generated", Labels: generated, Cluster: "build02"}}},
+		},
+		PostsubmitsStatic: map[string][]prowconfig.Postsubmit{"org/repo": {
+			{JobBase: prowconfig.JobBase{Name: "generated", Labels: generated, Cluster: "build01"}},
+		}},
+		Periodics: []prowconfig.Periodic{
+			{JobBase: prowconfig.JobBase{Name: "generated", Labels: map[string]string{LabelGenerator: "cluster-init"}, Cluster: "default"}},
+			{JobBase: prowconfig.JobBase{Name: "manual", Cluster: "build02"}},
+		},
+	}
+	expected := JobConfigStats{
+		OrgStats: OrgStats{Total: 6, Presubmits: 3, Postsubmits: 1, Periodics: 2, Generated: 4, Manual: 2},
+		Clusters: map[string]int{"build01": 2, "build02": 2, "default": 2},
+	}
+	if diff := cmp.Diff(expected, Stats(jobConfig)); diff != "" {
+		t.Errorf("stats differ from expected:\n%s", diff)
+	}
+	if diff := cmp.Diff(JobConfigStats{Clusters: map[string]int{}}, Stats(&prowconfig.JobConfig{})); diff != "" {
+		t.Errorf("stats for an empty job config differ from expected:\n%s", diff)
+	}
+}
+
+func TestAnalyzePeriodicSchedules(t *testing.T) {
+	periodic := func(name, interval, cron string) prowconfig.Periodic {
+		return prowconfig.Periodic{JobBase: prowconfig.JobBase{Name: name}, Interval: interval, Cron: cron}
+	}
+	testCases := []struct {
+		name      string
+		periodics []prowconfig.Periodic
+		expected  []ScheduleBucket
+	}{
+		{
+			name: "spread out schedules are not flagged",
+			periodics: []prowconfig.Periodic{
+				periodic("a", "24h", ""),
+				periodic("b", "12h", ""),
+				periodic("c", "", "0 1 * * *"),
+				periodic("d", "", "0 2 * * *"),
+			},
+		},
+		{
+			name: "clustered schedules are flagged, largest first",
+			periodics: []prowconfig.Periodic{
+				periodic("d", "24h", ""),
+				periodic("a", "1440m", ""),
+				periodic("c", "24h0m0s", ""),
+				periodic("e", "", "0 0 * * *"),
+				periodic("f", "", "0 0 * * *"),
+				periodic("g", "", "0 0 * * *"),
+				periodic("h", "", "0 0 * * *"),
+				periodic("b", "", "0 1 * * *"),
+			},
+			expected: []ScheduleBucket{
+				{Schedule: "cron: 0 0 * * *", Jobs: []string{"e", "f", "g", "h"}},
+				{Schedule: "interval: 24h0m0s", Jobs: []string{"a", "c", "d"}},
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			buckets := AnalyzePeriodicSchedules(&prowconfig.JobConfig{Periodics: tc.periodics}, 2)
+			if diff := cmp.Diff(tc.expected, buckets); diff != "" {
+				t.Errorf("buckets differ from expected:\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestHashJobConfigLabelOrder(t *testing.T) {
+	keys := []string{LabelGenerator, ProwJobLabelVariant, JobReleaseKey, CanBeRehearsedLabel, "a", "z", "m"}
+	newJobConfig := func(keys []string) *prowconfig.JobConfig {
+		labels, annotations := map[string]string{}, map[string]string{}
+		for _, key := range keys {
+			labels[key] = "value-" + key
+			annotations[key] = "annotation-" + key
+		}
+		return &prowconfig.JobConfig{
+			PresubmitsStatic: map[string][]prowconfig.Presubmit{"org/repo": {{JobBase: prowconfig.JobBase{Name: "job", Labels: labels, Annotations: annotations}}}},
+			Periodics:        []prowconfig.Periodic{{JobBase: prowconfig.JobBase{Name: "periodic", Labels: labels, Annotations: annotations}}},
+		}
+	}
+	reversed := make([]string, len(keys))
+	for i, key := range keys {
+		reversed[len(keys)-1-i] = key
+	}
+	forward, backward := newJobConfig(keys), newJobConfig(reversed)
+
+	forwardHash, err := HashJobConfig(forward)
+	if err != nil {
+		t.Fatalf("failed to hash: %v", err)
+	}
+	backwardHash, err := HashJobConfig(backward)
+	if err != nil {
+		t.Fatalf("failed to hash: %v", err)
+	}
+	if forwardHash != backwardHash {
+		t.Errorf("expected identical hashes, got %s and %s", forwardHash, backwardHash)
+	}
+
+	for _, opts := range [][]WriteOption{nil, {WithKeyOrder(ProwKeyOrder...)}} {
+		forwardYAML, err := newWriteOptions(opts).marshal(forward)
+		if err != nil {
+			t.Fatalf("failed to marshal: %v", err)
+		}
+		backwardYAML, err := newWriteOptions(opts).marshal(backward)
+		if err != nil {
+			t.Fatalf("failed to marshal: %v", err)
+		}
+		if diff := cmp.Diff(string(forwardYAML), string(backwardYAML)); diff != "" {
+			t.Errorf("serialized forms differ:\n%s", diff)
+		}
+		if !strings.Contains(string(forwardYAML), "labels:\n      a: value-a\n      ci-operator.openshift.io/variant") {
+			t.Errorf("expected labels to be serialized in sorted order, got:\n%s", forwardYAML)
+		}
+	}
+}
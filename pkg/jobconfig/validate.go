@@ -0,0 +1,315 @@
+package jobconfig
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/robfig/cron.v2"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/validation"
+	prowconfig "k8s.io/test-infra/prow/config"
+
+	cioperatorapi "github.com/openshift/ci-tools/pkg/api"
+)
+
+// ValidateFileRepoConsistency checks that every job configuration file in dir
+// only holds jobs for the org/repo the file is filed under: presubmits and
+// postsubmits must be keyed by that org/repo and periodics with extra refs
+// must have that org/repo as their primary ref, i.e. the ref cloned into the
+// working directory or, when none is marked as such, the first one.
+func ValidateFileRepoConsistency(dir string) error {
+	return OperateOnJobConfigDir(dir, func(jobConfig *prowconfig.JobConfig, info *Info) error {
+		return validateFileRepoConsistency(jobConfig, info)
+	})
+}
+
+func validateFileRepoConsistency(jobConfig *prowconfig.JobConfig, info *Info) error {
+	expected := fmt.Sprintf("%s/%s", info.Org, info.Repo)
+	var errs []error
+	for repo, jobs := range jobConfig.PresubmitsStatic {
+		if repo != expected {
+			for _, job := range jobs {
+				errs = append(errs, fmt.Errorf("%s: presubmit %s is configured for %s, expected %s", info.Filename, job.Name, repo, expected))
+			}
+		}
+	}
+	for repo, jobs := range jobConfig.PostsubmitsStatic {
+		if repo != expected {
+			for _, job := range jobs {
+				errs = append(errs, fmt.Errorf("%s: postsubmit %s is configured for %s, expected %s", info.Filename, job.Name, repo, expected))
+			}
+		}
+	}
+	for _, job := range jobConfig.Periodics {
+		if ref := primaryRef(job); ref != nil && (ref.Org != info.Org || ref.Repo != info.Repo) {
+			errs = append(errs, fmt.Errorf("%s: periodic %s is configured for %s/%s, expected %s", info.Filename, job.Name, ref.Org, ref.Repo, expected))
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// ValidateFilePlacement checks that no job configuration file in dir is
+// named for another org and repo than the directory it is filed under. Such
+// files are otherwise skipped when reading dir, so their jobs are silently
+// lost.
+func ValidateFilePlacement(dir string, opts ...WalkOption) error {
+	var errs []error
+	collectMisplaced := func(o *WalkOptions) {
+		o.onSkipped = func(path string, err error) {
+			if errors.Is(err, ErrMisplacedFile) {
+				errs = append(errs, fmt.Errorf("%s: %w", path, err))
+			}
+		}
+	}
+	if err := OperateOnJobConfigSubdirPaths(dir, "", func(*Info) error { return nil }, append(opts, collectMisplaced)...); err != nil {
+		errs = append(errs, err)
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// ValidateNoGeneratedManualNameClash checks that no job name is used both by a
+// job generated by the provided Generator and by a job that is not generated.
+// Presubmits and postsubmits are checked per repo, periodics globally.
+func ValidateNoGeneratedManualNameClash(jobConfig *prowconfig.JobConfig, generator Generator) error {
+	generatedSelector, err := generatedSelectorFor(generator)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	check := func(jobType, repo string, jobs []prowconfig.JobBase) {
+		generated, manual := sets.NewString(), sets.NewString()
+		for _, job := range jobs {
+			if generatedSelector.Matches(labels.Set(job.Labels)) {
+				generated.Insert(job.Name)
+			} else {
+				manual.Insert(job.Name)
+			}
+		}
+		for _, name := range generated.Intersection(manual).List() {
+			if repo == "" {
+				errs = append(errs, fmt.Errorf("%s %s is defined both as a generated and as a manual job", jobType, name))
+			} else {
+				errs = append(errs, fmt.Errorf("%s %s for %s is defined both as a generated and as a manual job", jobType, name, repo))
+			}
+		}
+	}
+	for _, repo := range sets.StringKeySet(jobConfig.PresubmitsStatic).List() {
+		var jobs []prowconfig.JobBase
+		for _, job := range jobConfig.PresubmitsStatic[repo] {
+			jobs = append(jobs, job.JobBase)
+		}
+		check("presubmit", repo, jobs)
+	}
+	for _, repo := range sets.StringKeySet(jobConfig.PostsubmitsStatic).List() {
+		var jobs []prowconfig.JobBase
+		for _, job := range jobConfig.PostsubmitsStatic[repo] {
+			jobs = append(jobs, job.JobBase)
+		}
+		check("postsubmit", repo, jobs)
+	}
+	var periodics []prowconfig.JobBase
+	for _, job := range jobConfig.Periodics {
+		periodics = append(periodics, job.JobBase)
+	}
+	check("periodic", "", periodics)
+	return utilerrors.NewAggregate(errs)
+}
+
+// promotionMaxConcurrency is the MaxConcurrency that promotion postsubmits are
+// generated with, as promotions for a branch must never run concurrently
+const promotionMaxConcurrency = 1
+
+// ValidatePromotionMaxConcurrency checks that promotion postsubmits carry the
+// generated MaxConcurrency. It is owned by the generator: mergePostsubmits
+// does not keep a value set by an operator on promotion jobs, so any other
+// value in the committed configuration would be lost on regeneration. Zero is
+// flagged too: it means unlimited concurrency to Prow, while pkg/prowgen
+// generates promotion postsubmits with a MaxConcurrency of 1.
+func ValidatePromotionMaxConcurrency(jobConfig *prowconfig.JobConfig) error {
+	var errs []error
+	for _, repo := range sets.StringKeySet(jobConfig.PostsubmitsStatic).List() {
+		for _, job := range jobConfig.PostsubmitsStatic[repo] {
+			if !cioperatorapi.IsPromotionJob(job.Labels) {
+				continue
+			}
+			if job.MaxConcurrency != promotionMaxConcurrency {
+				errs = append(errs, fmt.Errorf("promotion postsubmit %s for %s has max_concurrency %d, expected %d", job.Name, repo, job.MaxConcurrency, promotionMaxConcurrency))
+			}
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// forEachJob calls fn for every job in the job config, in a stable order.
+// The repo is the org/repo presubmits and postsubmits are configured for and
+// is empty for periodics.
+func forEachJob(jobConfig *prowconfig.JobConfig, fn func(jobType, repo string, job prowconfig.JobBase)) {
+	for _, repo := range sets.StringKeySet(jobConfig.PresubmitsStatic).List() {
+		for _, job := range jobConfig.PresubmitsStatic[repo] {
+			fn("presubmit", repo, job.JobBase)
+		}
+	}
+	for _, repo := range sets.StringKeySet(jobConfig.PostsubmitsStatic).List() {
+		for _, job := range jobConfig.PostsubmitsStatic[repo] {
+			fn("postsubmit", repo, job.JobBase)
+		}
+	}
+	for _, job := range jobConfig.Periodics {
+		fn("periodic", "", job.JobBase)
+	}
+}
+
+// describeJob identifies a job in error messages
+func describeJob(jobType, repo, name string) string {
+	if repo == "" {
+		return fmt.Sprintf("%s %s", jobType, name)
+	}
+	return fmt.Sprintf("%s %s for %s", jobType, name, repo)
+}
+
+// generatedNamePrefixes are the prefixes of the names generators give jobs,
+// keyed by the job type described by forEachJob
+var generatedNamePrefixes = map[string]string{
+	"presubmit":  PresubmitPrefix + "-ci-",
+	"postsubmit": PostsubmitPrefix + "-ci-",
+	"periodic":   PeriodicPrefix + "-ci-",
+}
+
+// ValidateGeneratedLabels checks that all jobs named like generated jobs carry
+// the LabelGenerator label. Jobs without it are considered hand-written and
+// are never pruned, so a generator forgetting the label leaks stale jobs.
+func ValidateGeneratedLabels(jobConfig *prowconfig.JobConfig) error {
+	var errs []error
+	forEachJob(jobConfig, func(jobType, repo string, job prowconfig.JobBase) {
+		if !strings.HasPrefix(job.Name, generatedNamePrefixes[jobType]) {
+			return
+		}
+		if _, ok := job.Labels[LabelGenerator]; !ok {
+			errs = append(errs, fmt.Errorf("%s: named like a generated job but missing the %s label", describeJob(jobType, repo, job.Name), LabelGenerator))
+		}
+	})
+	return utilerrors.NewAggregate(errs)
+}
+
+// ValidateEnvNames checks that the names of all environment variables set on
+// job containers are C identifiers, as required by Kubernetes
+func ValidateEnvNames(jobConfig *prowconfig.JobConfig) error {
+	var errs []error
+	forEachJob(jobConfig, func(jobType, repo string, job prowconfig.JobBase) {
+		if job.Spec == nil {
+			return
+		}
+		containers := append(append([]v1.Container{}, job.Spec.InitContainers...), job.Spec.Containers...)
+		for _, container := range containers {
+			for _, env := range container.Env {
+				for _, msg := range validation.IsCIdentifier(env.Name) {
+					errs = append(errs, fmt.Errorf("%s: container %s: invalid environment variable name %q: %s", describeJob(jobType, repo, job.Name), container.Name, env.Name, msg))
+				}
+			}
+		}
+	})
+	return utilerrors.NewAggregate(errs)
+}
+
+// ValidateTriggerRegexes checks that the trigger and rerun command of every
+// presubmit compile as regular expressions, as Prow fails to handle commands
+// for the whole repo otherwise
+func ValidateTriggerRegexes(jobConfig *prowconfig.JobConfig) error {
+	var errs []error
+	for _, repo := range sets.StringKeySet(jobConfig.PresubmitsStatic).List() {
+		for _, job := range jobConfig.PresubmitsStatic[repo] {
+			for _, field := range []struct{ name, value string }{{"trigger", job.Trigger}, {"rerun_command", job.RerunCommand}} {
+				if field.value == "" {
+					continue
+				}
+				if _, err := regexp.Compile(field.value); err != nil {
+					errs = append(errs, fmt.Errorf("%s: invalid %s %q: %w", describeJob("presubmit", repo, job.Name), field.name, field.value, err))
+				}
+			}
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// ValidateDecorationTimeouts checks that the decoration timeout of every job
+// does not exceed maxTimeout and that its grace period is at least
+// minGracePeriod. Values that are not set are not checked, as Prow defaults
+// apply to them, and a bound that is zero is not enforced.
+func ValidateDecorationTimeouts(jobConfig *prowconfig.JobConfig, maxTimeout, minGracePeriod time.Duration) error {
+	var errs []error
+	forEachJob(jobConfig, func(jobType, repo string, job prowconfig.JobBase) {
+		if job.DecorationConfig == nil {
+			return
+		}
+		if timeout := job.DecorationConfig.Timeout; timeout != nil && maxTimeout > 0 && timeout.Duration > maxTimeout {
+			errs = append(errs, fmt.Errorf("%s: timeout %s exceeds the maximum of %s", describeJob(jobType, repo, job.Name), timeout.Duration, maxTimeout))
+		}
+		if gracePeriod := job.DecorationConfig.GracePeriod; gracePeriod != nil && minGracePeriod > 0 && gracePeriod.Duration < minGracePeriod {
+			errs = append(errs, fmt.Errorf("%s: grace period %s is below the minimum of %s", describeJob(jobType, repo, job.Name), gracePeriod.Duration, minGracePeriod))
+		}
+	})
+	return utilerrors.NewAggregate(errs)
+}
+
+// ValidatePeriodics checks that every periodic is scheduled by exactly one of
+// cron, interval and minimum_interval, and that the value set parses, as Prow
+// only rejects periodics that do not at runtime.
+func ValidatePeriodics(jobConfig *prowconfig.JobConfig) error {
+	var errs []error
+	for _, job := range jobConfig.Periodics {
+		var set []string
+		for field, value := range map[string]string{"cron": job.Cron, "interval": job.Interval, "minimum_interval": job.MinimumInterval} {
+			if value != "" {
+				set = append(set, field)
+			}
+		}
+		sort.Strings(set)
+		switch len(set) {
+		case 0:
+			errs = append(errs, fmt.Errorf("%s: one of cron, interval and minimum_interval must be set", describeJob("periodic", "", job.Name)))
+			continue
+		case 1:
+		default:
+			errs = append(errs, fmt.Errorf("%s: only one of cron, interval and minimum_interval may be set, got %s", describeJob("periodic", "", job.Name), strings.Join(set, ", ")))
+			continue
+		}
+		var err error
+		switch set[0] {
+		case "cron":
+			_, err = cron.Parse(job.Cron)
+		case "interval":
+			_, err = time.ParseDuration(job.Interval)
+		case "minimum_interval":
+			_, err = time.ParseDuration(job.MinimumInterval)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: invalid %s: %w", describeJob("periodic", "", job.Name), set[0], err))
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// ValidateRoundTrip checks that the file name info produces with Basename is
+// parsed back into the same org, repo, branch and type
+func ValidateRoundTrip(info *Info) error {
+	path := info.RelativePath()
+	parsed, err := extractInfoFromPathWithSeparator(path, info.separator())
+	if err != nil {
+		return fmt.Errorf("%s cannot be parsed: %w", path, err)
+	}
+	expected := Info{Org: info.Org, Repo: info.Repo, Branch: info.Branch, Type: info.Type}
+	actual := Info{Org: parsed.Org, Repo: parsed.Repo, Branch: parsed.Branch, Type: parsed.Type}
+	if actual != expected {
+		return fmt.Errorf("%s is parsed as org %q, repo %q, branch %q and type %q instead of org %q, repo %q, branch %q and type %q",
+			path, actual.Org, actual.Repo, actual.Branch, actual.Type, expected.Org, expected.Repo, expected.Branch, expected.Type)
+	}
+	return nil
+}
@@ -0,0 +1,465 @@
+package jobconfig
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	v1 "k8s.io/api/core/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	prowapi "k8s.io/test-infra/prow/apis/prowjobs/v1"
+	prowconfig "k8s.io/test-infra/prow/config"
+
+	cioperatorapi "github.com/openshift/ci-tools/pkg/api"
+	"github.com/openshift/ci-tools/pkg/testhelper"
+)
+
+func TestValidateFileRepoConsistency(t *testing.T) {
+	testCases := []struct {
+		name        string
+		files       map[string]*prowconfig.JobConfig
+		expectedErr bool
+	}{
+		{
+			name: "correctly filed jobs are valid",
+			files: map[string]*prowconfig.JobConfig{
+				"org/repo/org-repo-master-presubmits.yaml": {
+					PresubmitsStatic: map[string][]prowconfig.Presubmit{"org/repo": {{JobBase: prowconfig.JobBase{Name: "job"}}}},
+				},
+				"org/repo/org-repo-master-periodics.yaml": {
+					Periodics: []prowconfig.Periodic{{JobBase: prowconfig.JobBase{Name: "periodic", UtilityConfig: prowconfig.UtilityConfig{
+						ExtraRefs: []prowapi.Refs{{Org: "org", Repo: "repo", BaseRef: "master"}},
+					}}}},
+				},
+				"org/repo/org-repo-periodics.yaml": {
+					Periodics: []prowconfig.Periodic{{JobBase: prowconfig.JobBase{Name: "misc"}}},
+				},
+			},
+		},
+		{
+			name: "presubmit filed under another repo is invalid",
+			files: map[string]*prowconfig.JobConfig{
+				"org/repo/org-repo-master-presubmits.yaml": {
+					PresubmitsStatic: map[string][]prowconfig.Presubmit{"org/other": {{JobBase: prowconfig.JobBase{Name: "job"}}}},
+				},
+			},
+			expectedErr: true,
+		},
+		{
+			name: "periodic for another repo is invalid",
+			files: map[string]*prowconfig.JobConfig{
+				"org/repo/org-repo-master-periodics.yaml": {
+					Periodics: []prowconfig.Periodic{{JobBase: prowconfig.JobBase{Name: "periodic", UtilityConfig: prowconfig.UtilityConfig{
+						ExtraRefs: []prowapi.Refs{{Org: "other", Repo: "repo", BaseRef: "master"}},
+					}}}},
+				},
+			},
+			expectedErr: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeJobConfigs(t, dir, tc.files)
+			err := ValidateFileRepoConsistency(dir)
+			if (err != nil) != tc.expectedErr {
+				t.Errorf("expected error: %t, got: %v", tc.expectedErr, err)
+			}
+		})
+	}
+}
+
+func TestValidateFilePlacement(t *testing.T) {
+	dir := t.TempDir()
+	writeJobConfigs(t, dir, map[string]*prowconfig.JobConfig{
+		"org/repo/org-repo-master-presubmits.yaml": {
+			PresubmitsStatic: map[string][]prowconfig.Presubmit{"org/repo": {{JobBase: prowconfig.JobBase{Name: "job"}}}},
+		},
+		"org/repo/other-repo-master-presubmits.yaml": {
+			PresubmitsStatic: map[string][]prowconfig.Presubmit{"other/repo": {{JobBase: prowconfig.JobBase{Name: "misplaced"}}}},
+		},
+	})
+	if err := os.WriteFile(filepath.Join(dir, "org", "repo", "notes.yaml"), []byte("notes: []\n"), 0644); err != nil {
+		t.Fatalf("failed to write notes: %v", err)
+	}
+
+	misplaced := filepath.Join(dir, "org", "repo", "other-repo-master-presubmits.yaml")
+	expected := utilerrors.NewAggregate([]error{
+		fmt.Errorf("%s: %w", misplaced, fmt.Errorf("%w: file name was not prefixed with %q: %q", ErrMisplacedFile, "org-repo-", "other-repo-master-presubmits")),
+	})
+	if diff := cmp.Diff(expected, ValidateFilePlacement(dir), testhelper.EquateErrorMessage); diff != "" {
+		t.Errorf("error differs from expected:\n%s", diff)
+	}
+	if err := os.Remove(misplaced); err != nil {
+		t.Fatalf("failed to remove misplaced file: %v", err)
+	}
+	if err := ValidateFilePlacement(dir); err != nil {
+		t.Errorf("expected correctly placed files to be valid, got: %v", err)
+	}
+}
+
+func TestValidateNoGeneratedManualNameClash(t *testing.T) {
+	generated := map[string]string{LabelGenerator: "prowgen"}
+	testCases := []struct {
+		name      string
+		jobConfig *prowconfig.JobConfig
+		expected  error
+	}{
+		{
+			name: "distinct names are valid",
+			jobConfig: &prowconfig.JobConfig{
+				PresubmitsStatic: map[string][]prowconfig.Presubmit{"org/repo": {
+					{JobBase: prowconfig.JobBase{Name: "generated", Labels: generated}},
+					{JobBase: prowconfig.JobBase{Name: "manual"}},
+				}},
+				Periodics: []prowconfig.Periodic{
+					{JobBase: prowconfig.JobBase{Name: "generated", Labels: generated}},
+					{JobBase: prowconfig.JobBase{Name: "manual"}},
+				},
+			},
+		},
+		{
+			name: "same name in different repos is valid",
+			jobConfig: &prowconfig.JobConfig{
+				PostsubmitsStatic: map[string][]prowconfig.Postsubmit{
+					"org/repo":  {{JobBase: prowconfig.JobBase{Name: "job", Labels: generated}}},
+					"org/other": {{JobBase: prowconfig.JobBase{Name: "job"}}},
+				},
+			},
+		},
+		{
+			name: "clashes are reported",
+			jobConfig: &prowconfig.JobConfig{
+				PresubmitsStatic: map[string][]prowconfig.Presubmit{"org/repo": {
+					{JobBase: prowconfig.JobBase{Name: "job", Labels: generated}},
+					{JobBase: prowconfig.JobBase{Name: "job"}},
+				}},
+				Periodics: []prowconfig.Periodic{
+					{JobBase: prowconfig.JobBase{Name: "periodic", Labels: generated}},
+					{JobBase: prowconfig.JobBase{Name: "periodic", Labels: map[string]string{LabelGenerator: "cluster-init"}}},
+				},
+			},
+			expected: utilerrors.NewAggregate([]error{
+				errors.New("presubmit job for org/repo is defined both as a generated and as a manual job"),
+				errors.New("periodic periodic is defined both as a generated and as a manual job"),
+			}),
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := ValidateNoGeneratedManualNameClash(tc.jobConfig, "prowgen")
+			if diff := cmp.Diff(tc.expected, err, testhelper.EquateErrorMessage); diff != "" {
+				t.Errorf("unexpected error:\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestValidatePromotionMaxConcurrency(t *testing.T) {
+	promotion := map[string]string{cioperatorapi.PromotionJobLabelKey: "true"}
+	testCases := []struct {
+		name     string
+		jobs     []prowconfig.Postsubmit
+		expected error
+	}{
+		{
+			name: "promotion job with generated max concurrency is valid",
+			jobs: []prowconfig.Postsubmit{{JobBase: prowconfig.JobBase{Name: "promote", Labels: promotion, MaxConcurrency: 1}}},
+		},
+		{
+			name: "non-promotion job with operator-set max concurrency is valid",
+			jobs: []prowconfig.Postsubmit{{JobBase: prowconfig.JobBase{Name: "other", MaxConcurrency: 3}}},
+		},
+		{
+			name: "promotion job without max concurrency is invalid",
+			jobs: []prowconfig.Postsubmit{{JobBase: prowconfig.JobBase{Name: "promote", Labels: promotion}}},
+			expected: utilerrors.NewAggregate([]error{
+				errors.New("promotion postsubmit promote for org/repo has max_concurrency 0, expected 1"),
+			}),
+		},
+		{
+			name: "promotion job with operator-set max concurrency is invalid",
+			jobs: []prowconfig.Postsubmit{{JobBase: prowconfig.JobBase{Name: "promote", Labels: promotion, MaxConcurrency: 3}}},
+			expected: utilerrors.NewAggregate([]error{
+				errors.New("promotion postsubmit promote for org/repo has max_concurrency 3, expected 1"),
+			}),
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := ValidatePromotionMaxConcurrency(&prowconfig.JobConfig{PostsubmitsStatic: map[string][]prowconfig.Postsubmit{"org/repo": tc.jobs}})
+			if diff := cmp.Diff(tc.expected, err, testhelper.EquateErrorMessage); diff != "" {
+				t.Errorf("unexpected error:\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestValidateGeneratedLabels(t *testing.T) {
+	generated := map[string]string{LabelGenerator: "prowgen"}
+	jobConfig := &prowconfig.JobConfig{
+		PresubmitsStatic: map[string][]prowconfig.Presubmit{"org/repo": {
+			{JobBase: prowconfig.JobBase{Name: "pull-ci-org-repo-master-unit", Labels: generated}},
+			{JobBase: prowconfig.JobBase{Name: "pull-ci-org-repo-master-e2e"}},
+			{JobBase: prowconfig.JobBase{Name: "handwritten"}},
+		}},
+		PostsubmitsStatic: map[string][]prowconfig.Postsubmit{"org/repo": {
+			{JobBase: prowconfig.JobBase{Name: "branch-ci-org-repo-master-images"}},
+			{JobBase: prowconfig.JobBase{Name: "pull-ci-org-repo-master-misfiled"}},
+		}},
+		Periodics: []prowconfig.Periodic{
+			{JobBase: prowconfig.JobBase{Name: "periodic-ci-org-repo-master-nightly", Labels: map[string]string{"other": "label"}}},
+			{JobBase: prowconfig.JobBase{Name: "periodic-handwritten"}},
+		},
+	}
+	expected := utilerrors.NewAggregate([]error{
+		errors.New("presubmit pull-ci-org-repo-master-e2e for org/repo: named like a generated job but missing the ci.openshift.io/generator label"),
+		errors.New("postsubmit branch-ci-org-repo-master-images for org/repo: named like a generated job but missing the ci.openshift.io/generator label"),
+		errors.New("periodic periodic-ci-org-repo-master-nightly: named like a generated job but missing the ci.openshift.io/generator label"),
+	})
+	if diff := cmp.Diff(expected, ValidateGeneratedLabels(jobConfig), testhelper.EquateErrorMessage); diff != "" {
+		t.Errorf("error differs from expected:\n%s", diff)
+	}
+}
+
+func TestValidateEnvNames(t *testing.T) {
+	spec := func(names ...string) *v1.PodSpec {
+		var env []v1.EnvVar
+		for _, name := range names {
+			env = append(env, v1.EnvVar{Name: name, Value: "value"})
+		}
+		return &v1.PodSpec{Containers: []v1.Container{{Name: "test", Env: env}}}
+	}
+	testCases := []struct {
+		name        string
+		jobConfig   *prowconfig.JobConfig
+		expectedErr bool
+	}{
+		{
+			name: "valid names",
+			jobConfig: &prowconfig.JobConfig{
+				PresubmitsStatic: map[string][]prowconfig.Presubmit{"org/repo": {{JobBase: prowconfig.JobBase{Name: "job", Spec: spec("HOME", "_private", "ARTIFACT_DIR2")}}}},
+				Periodics:        []prowconfig.Periodic{{JobBase: prowconfig.JobBase{Name: "no-spec"}}},
+			},
+		},
+		{
+			name: "name with a dash is invalid",
+			jobConfig: &prowconfig.JobConfig{
+				PostsubmitsStatic: map[string][]prowconfig.Postsubmit{"org/repo": {{JobBase: prowconfig.JobBase{Name: "job", Spec: spec("MY-VAR")}}}},
+			},
+			expectedErr: true,
+		},
+		{
+			name: "name starting with a digit is invalid",
+			jobConfig: &prowconfig.JobConfig{
+				Periodics: []prowconfig.Periodic{{JobBase: prowconfig.JobBase{Name: "job", Spec: spec("1VAR")}}},
+			},
+			expectedErr: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := ValidateEnvNames(tc.jobConfig)
+			if (err != nil) != tc.expectedErr {
+				t.Errorf("expected error: %t, got: %v", tc.expectedErr, err)
+			}
+		})
+	}
+}
+
+func TestValidateTriggerRegexes(t *testing.T) {
+	presubmit := func(trigger, rerun string) *prowconfig.JobConfig {
+		return &prowconfig.JobConfig{PresubmitsStatic: map[string][]prowconfig.Presubmit{"org/repo": {
+			{JobBase: prowconfig.JobBase{Name: "job"}, Reporter: prowconfig.Reporter{Context: "ci/prow/job"}, Trigger: trigger, RerunCommand: rerun},
+		}}}
+	}
+	testCases := []struct {
+		name        string
+		jobConfig   *prowconfig.JobConfig
+		expectedErr error
+	}{
+		{
+			name:      "valid patterns",
+			jobConfig: presubmit(`(?m)^/test( | .* )(job|all),?($|\s.*)`, "/test job"),
+		},
+		{
+			name:      "unset patterns",
+			jobConfig: presubmit("", ""),
+		},
+		{
+			name:        "invalid trigger",
+			jobConfig:   presubmit(`(?m)^/test (job`, "/test job"),
+			expectedErr: errors.New("presubmit job for org/repo: invalid trigger \"(?m)^/test (job\": error parsing regexp: missing closing ): `(?m)^/test (job`"),
+		},
+		{
+			name:        "invalid rerun command",
+			jobConfig:   presubmit("", "/test [job"),
+			expectedErr: errors.New("presubmit job for org/repo: invalid rerun_command \"/test [job\": error parsing regexp: missing closing ]: `[job`"),
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if diff := cmp.Diff(tc.expectedErr, ValidateTriggerRegexes(tc.jobConfig), testhelper.EquateErrorMessage); diff != "" {
+				t.Errorf("error differs from expected:\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestValidateDecorationTimeouts(t *testing.T) {
+	decoration := func(timeout, gracePeriod time.Duration) prowconfig.UtilityConfig {
+		config := &prowapi.DecorationConfig{}
+		if timeout != 0 {
+			config.Timeout = &prowapi.Duration{Duration: timeout}
+		}
+		if gracePeriod != 0 {
+			config.GracePeriod = &prowapi.Duration{Duration: gracePeriod}
+		}
+		return prowconfig.UtilityConfig{DecorationConfig: config}
+	}
+	testCases := []struct {
+		name        string
+		jobConfig   *prowconfig.JobConfig
+		expectedErr error
+	}{
+		{
+			name: "within bounds, unset and undecorated",
+			jobConfig: &prowconfig.JobConfig{
+				PresubmitsStatic: map[string][]prowconfig.Presubmit{"org/repo": {
+					{JobBase: prowconfig.JobBase{Name: "within", UtilityConfig: decoration(4*time.Hour, time.Hour)}},
+					{JobBase: prowconfig.JobBase{Name: "unset", UtilityConfig: decoration(0, 0)}},
+					{JobBase: prowconfig.JobBase{Name: "undecorated"}},
+				}},
+			},
+		},
+		{
+			name: "timeout over the maximum",
+			jobConfig: &prowconfig.JobConfig{
+				PostsubmitsStatic: map[string][]prowconfig.Postsubmit{"org/repo": {
+					{JobBase: prowconfig.JobBase{Name: "long", UtilityConfig: decoration(8*time.Hour, time.Hour)}},
+				}},
+			},
+			expectedErr: errors.New("postsubmit long for org/repo: timeout 8h0m0s exceeds the maximum of 4h0m0s"),
+		},
+		{
+			name: "grace period under the minimum",
+			jobConfig: &prowconfig.JobConfig{
+				Periodics: []prowconfig.Periodic{
+					{JobBase: prowconfig.JobBase{Name: "hasty", UtilityConfig: decoration(time.Hour, 10*time.Second)}},
+				},
+			},
+			expectedErr: errors.New("periodic hasty: grace period 10s is below the minimum of 15m0s"),
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := ValidateDecorationTimeouts(tc.jobConfig, 4*time.Hour, 15*time.Minute)
+			if diff := cmp.Diff(tc.expectedErr, err, testhelper.EquateErrorMessage); diff != "" {
+				t.Errorf("error differs from expected:\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestValidatePeriodics(t *testing.T) {
+	periodic := func(name, cron, interval, minimumInterval string) prowconfig.Periodic {
+		return prowconfig.Periodic{JobBase: prowconfig.JobBase{Name: name}, Cron: cron, Interval: interval, MinimumInterval: minimumInterval}
+	}
+	testCases := []struct {
+		name        string
+		periodics   []prowconfig.Periodic
+		expectedErr error
+	}{
+		{
+			name: "periodics scheduled once are valid",
+			periodics: []prowconfig.Periodic{
+				periodic("cron", "0 0 * * *", "", ""),
+				periodic("interval", "", "24h", ""),
+				periodic("minimum-interval", "", "", "12h"),
+			},
+		},
+		{
+			name: "periodics scheduled twice or never are invalid",
+			periodics: []prowconfig.Periodic{
+				periodic("both", "0 0 * * *", "24h", ""),
+				periodic("neither", "", "", ""),
+			},
+			expectedErr: utilerrors.NewAggregate([]error{
+				errors.New("periodic both: only one of cron, interval and minimum_interval may be set, got cron, interval"),
+				errors.New("periodic neither: one of cron, interval and minimum_interval must be set"),
+			}),
+		},
+		{
+			name: "periodics with values that do not parse are invalid",
+			periodics: []prowconfig.Periodic{
+				periodic("bad-cron", "0 0 * *", "", ""),
+				periodic("bad-interval", "", "daily", ""),
+			},
+			expectedErr: utilerrors.NewAggregate([]error{
+				errors.New("periodic bad-cron: invalid cron: Expected 5 or 6 fields, found 4: 0 0 * *"),
+				errors.New(`periodic bad-interval: invalid interval: time: invalid duration "daily"`),
+			}),
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := ValidatePeriodics(&prowconfig.JobConfig{Periodics: tc.periodics})
+			if diff := cmp.Diff(tc.expectedErr, err, testhelper.EquateErrorMessage); diff != "" {
+				t.Errorf("error differs from expected:\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestValidateRoundTrip(t *testing.T) {
+	testCases := []struct {
+		name        string
+		info        *Info
+		expectedErr bool
+	}{
+		{
+			name: "presubmits for a branch",
+			info: &Info{Org: "org", Repo: "repo", Branch: "release-4.12", Type: "presubmits"},
+		},
+		{
+			name: "periodics without a branch",
+			info: &Info{Org: "org", Repo: "repo", Type: "periodics"},
+		},
+		{
+			name: "periodics for a branch",
+			info: &Info{Org: "org", Repo: "repo", Branch: "master", Type: "periodics"},
+		},
+		{
+			name: "alternate separator with dashes in the repo",
+			info: &Info{Org: "org", Repo: "my-repo", Branch: "release-4.12", Type: "postsubmits", Separator: "__"},
+		},
+		{
+			name:        "branch with a slash",
+			info:        &Info{Org: "org", Repo: "repo", Branch: "release/4.12", Type: "presubmits"},
+			expectedErr: true,
+		},
+		{
+			name:        "unknown type",
+			info:        &Info{Org: "org", Repo: "repo", Branch: "master", Type: "jobs"},
+			expectedErr: true,
+		},
+		{
+			name:        "org with a slash",
+			info:        &Info{Org: "org/sub", Repo: "repo", Branch: "master", Type: "presubmits"},
+			expectedErr: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := ValidateRoundTrip(tc.info)
+			if (err != nil) != tc.expectedErr {
+				t.Errorf("expected error: %t, got: %v", tc.expectedErr, err)
+			}
+		})
+	}
+}
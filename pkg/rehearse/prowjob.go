@@ -0,0 +1,42 @@
+package rehearse
+
+import (
+	"strconv"
+
+	prowapi "k8s.io/test-infra/prow/apis/prowjobs/v1"
+	prowconfig "k8s.io/test-infra/prow/config"
+	"k8s.io/test-infra/prow/kube"
+	"k8s.io/test-infra/prow/pjutil"
+)
+
+// PresubmitProwJob returns the skeleton of the ProwJob that Prow would create
+// to run the presubmit for refs, without contacting Prow. The job's labels and
+// annotations, including the generator and variant labels, are carried over.
+func PresubmitProwJob(job prowconfig.Presubmit, refs prowapi.Refs) prowapi.ProwJob {
+	labels := map[string]string{}
+	for k, v := range job.Labels {
+		labels[k] = v
+	}
+	labels[kube.IsOptionalLabel] = strconv.FormatBool(job.Optional)
+	return newProwJob(pjutil.PresubmitSpec(job, refs), labels, job.Annotations)
+}
+
+// PostsubmitProwJob returns the skeleton of the ProwJob that Prow would create
+// to run the postsubmit for refs, without contacting Prow.
+func PostsubmitProwJob(job prowconfig.Postsubmit, refs prowapi.Refs) prowapi.ProwJob {
+	return newProwJob(pjutil.PostsubmitSpec(job, refs), job.Labels, job.Annotations)
+}
+
+// PeriodicProwJob returns the skeleton of the ProwJob that Prow would create
+// to run the periodic, without contacting Prow.
+func PeriodicProwJob(job prowconfig.Periodic) prowapi.ProwJob {
+	return newProwJob(pjutil.PeriodicSpec(job), job.Labels, job.Annotations)
+}
+
+func newProwJob(spec prowapi.ProwJobSpec, labels, annotations map[string]string) prowapi.ProwJob {
+	pj := pjutil.NewProwJob(spec, labels, annotations)
+	// the name and status are only meaningful for a ProwJob that was created
+	pj.Name = ""
+	pj.Status = prowapi.ProwJobStatus{}
+	return pj
+}
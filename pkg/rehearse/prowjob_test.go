@@ -0,0 +1,110 @@
+package rehearse
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	prowapi "k8s.io/test-infra/prow/apis/prowjobs/v1"
+	prowconfig "k8s.io/test-infra/prow/config"
+	"k8s.io/test-infra/prow/kube"
+
+	"github.com/openshift/ci-tools/pkg/jobconfig"
+)
+
+func TestPresubmitProwJob(t *testing.T) {
+	spec := &v1.PodSpec{Containers: []v1.Container{{Name: "test", Command: []string{"ci-operator"}}}}
+	job := prowconfig.Presubmit{
+		JobBase: prowconfig.JobBase{
+			Name:   "pull-ci-org-repo-master-unit",
+			Agent:  "kubernetes",
+			Labels: map[string]string{jobconfig.LabelGenerator: "prowgen", jobconfig.ProwJobLabelVariant: "variant"},
+			Spec:   spec,
+		},
+		Reporter: prowconfig.Reporter{Context: "ci/prow/unit"},
+	}
+	refs := prowapi.Refs{Org: "org", Repo: "repo", BaseRef: "master", Pulls: []prowapi.Pull{{Number: 1}}}
+
+	pj := PresubmitProwJob(job, refs)
+	expected := prowapi.ProwJob{
+		TypeMeta: metav1.TypeMeta{APIVersion: "prow.k8s.io/v1", Kind: "ProwJob"},
+		ObjectMeta: metav1.ObjectMeta{
+			Labels: map[string]string{
+				jobconfig.LabelGenerator:      "prowgen",
+				jobconfig.ProwJobLabelVariant: "variant",
+				kube.IsOptionalLabel:          "false",
+				kube.CreatedByProw:            "true",
+				kube.ProwJobTypeLabel:         "presubmit",
+				kube.ProwJobAnnotation:        "pull-ci-org-repo-master-unit",
+				kube.OrgLabel:                 "org",
+				kube.RepoLabel:                "repo",
+				kube.BaseRefLabel:             "master",
+				kube.PullLabel:                "1",
+				kube.ContextAnnotation:        "unit",
+			},
+			Annotations: map[string]string{
+				kube.ProwJobAnnotation: "pull-ci-org-repo-master-unit",
+				kube.ContextAnnotation: "ci/prow/unit",
+			},
+		},
+		Spec: prowapi.ProwJobSpec{
+			Type:    prowapi.PresubmitJob,
+			Agent:   prowapi.KubernetesAgent,
+			Job:     "pull-ci-org-repo-master-unit",
+			Refs:    &prowapi.Refs{Org: "org", Repo: "repo", BaseRef: "master", Pulls: []prowapi.Pull{{Number: 1}}},
+			Context: "ci/prow/unit",
+			Report:  true,
+			PodSpec: spec,
+		},
+	}
+	if diff := cmp.Diff(expected, pj); diff != "" {
+		t.Errorf("ProwJob differs from expected:\n%s", diff)
+	}
+}
+
+func TestPeriodicProwJob(t *testing.T) {
+	job := prowconfig.Periodic{
+		JobBase: prowconfig.JobBase{
+			Name:   "periodic-ci-org-repo-master-e2e",
+			Agent:  "kubernetes",
+			Labels: map[string]string{jobconfig.LabelGenerator: "prowgen"},
+			UtilityConfig: prowconfig.UtilityConfig{
+				ExtraRefs: []prowapi.Refs{{Org: "org", Repo: "repo", BaseRef: "master"}},
+			},
+		},
+		Cron: "0 0 * * *",
+	}
+
+	pj := PeriodicProwJob(job)
+	expected := prowapi.ProwJob{
+		TypeMeta: metav1.TypeMeta{APIVersion: "prow.k8s.io/v1", Kind: "ProwJob"},
+		ObjectMeta: metav1.ObjectMeta{
+			Labels: map[string]string{
+				jobconfig.LabelGenerator: "prowgen",
+				kube.CreatedByProw:       "true",
+				kube.ProwJobTypeLabel:    "periodic",
+				kube.ProwJobAnnotation:   "periodic-ci-org-repo-master-e2e",
+				kube.OrgLabel:            "org",
+				kube.RepoLabel:           "repo",
+				kube.BaseRefLabel:        "master",
+				kube.ContextAnnotation:   "",
+			},
+			Annotations: map[string]string{
+				kube.ProwJobAnnotation: "periodic-ci-org-repo-master-e2e",
+				kube.ContextAnnotation: "",
+			},
+		},
+		Spec: prowapi.ProwJobSpec{
+			Type:      prowapi.PeriodicJob,
+			Agent:     prowapi.KubernetesAgent,
+			Job:       "periodic-ci-org-repo-master-e2e",
+			ExtraRefs: []prowapi.Refs{{Org: "org", Repo: "repo", BaseRef: "master"}},
+			Report:    true,
+		},
+	}
+	if diff := cmp.Diff(expected, pj); diff != "" {
+		t.Errorf("ProwJob differs from expected:\n%s", diff)
+	}
+}
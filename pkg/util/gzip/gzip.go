@@ -31,15 +31,26 @@ func ReadBytesMaybeGZIP(data []byte) ([]byte, error) {
 	return ioutil.ReadAll(gzipReader)
 }
 
-func CompressStringAndBase64(data string) (string, error) {
+// Compress returns the data gzipped with the best compression
+func Compress(data []byte) ([]byte, error) {
 	buf := new(bytes.Buffer)
 	writer, err := gzip.NewWriterLevel(buf, gzip.BestCompression)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	if _, err := writer.Write([]byte(data)); err != nil {
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func CompressStringAndBase64(data string) (string, error) {
+	compressed, err := Compress([]byte(data))
+	if err != nil {
 		return "", err
 	}
-	writer.Close()
-	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+	return base64.StdEncoding.EncodeToString(compressed), nil
 }